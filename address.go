@@ -0,0 +1,278 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+	"github.com/corollari/neo-ws-pub-sub/neoutils"
+)
+
+const (
+	// Mempool transactions that aren't included in a block within this time are forgotten
+	pendingTxLifetime = time.Hour
+
+	// Outputs of the transactions seen or fetched, kept to resolve the sender of inputs
+	outputCacheSize = 10000
+)
+
+// AddressActivity is published on address/<address> for everything touching the address
+type AddressActivity struct {
+	Type      string        `json:"type"` // mempool | nep5_transfer | confirmed
+	Address   string        `json:"address"`
+	TxId      string        `json:"txid"`
+	Direction string        `json:"direction,omitempty"` // in | out | self
+	Block     *int64        `json:"block,omitempty"`
+	BlockHash string        `json:"blockHash,omitempty"`
+	Tx        interface{}   `json:"tx,omitempty"`
+	Transfer  *NEP5Transfer `json:"transfer,omitempty"`
+}
+
+// addressWatch is the index of an address, activity is only computed for addresses with subscribers
+type addressWatch string
+
+type pendingTx struct {
+	seen      time.Time
+	addresses map[string]string // address -> direction
+}
+
+var (
+	addressMutex sync.Mutex
+	watched      = map[string]int{}        // subscriptions per address
+	pendingTxs   = map[string]*pendingTx{} // mempool transactions touching a watched address, by txid
+
+	outputMutex sync.Mutex
+	outputs     = map[string][]string{}           // addresses of the outputs of a transaction, by txid
+	outputOrder = make([]string, outputCacheSize) // ring of the txids in outputs, the next one stored replaces the oldest
+	outputNext  int
+)
+
+func validAddress(address string) bool {
+	_, err := neoutils.AddressToScriptHash(address)
+	return err == nil
+}
+
+func (a addressWatch) retain() {
+	addressMutex.Lock()
+	watched[string(a)]++
+	addressMutex.Unlock()
+}
+
+func (a addressWatch) release() {
+	addressMutex.Lock()
+	if watched[string(a)]--; watched[string(a)] <= 0 {
+		delete(watched, string(a))
+	}
+	addressMutex.Unlock()
+}
+
+func watchedAddresses(candidates map[string]string) map[string]string {
+	addressMutex.Lock()
+	defer addressMutex.Unlock()
+	matched := map[string]string{}
+	for address, direction := range candidates {
+		if watched[address] > 0 {
+			matched[address] = direction
+		}
+	}
+	return matched
+}
+
+func addDirection(parties map[string]string, address string, direction string) {
+	if address == "" {
+		return
+	}
+	if current, ok := parties[address]; ok && current != direction {
+		direction = "self"
+	}
+	parties[address] = direction
+}
+
+func publishActivity(a AddressActivity) {
+	sendMessage("address/"+a.Address, a)
+}
+
+// publishMempoolActivity reports a mempool transaction to the addresses it pays or spends from.
+// Inputs are resolved from the outputs of the transactions already seen, when some of them
+// weren't and p2p.rpcFallback is set the previous transactions are asked to rpcNode in the
+// background, so the P2P messages aren't held up by the node.
+func publishMempoolActivity(tx neorpc.GetRawTransactionResult, rpcNode string) {
+	storeOutputs(tx.Txid, outputAddresses(tx))
+	addressMutex.Lock()
+	watching := len(watched) > 0
+	addressMutex.Unlock()
+	if !watching {
+		return
+	}
+
+	parties, resolved := mempoolParties(tx, "")
+	if !resolved && rpcFallback() {
+		go func() {
+			parties, _ := mempoolParties(tx, rpcNode)
+			reportMempoolActivity(tx, parties)
+		}()
+		return
+	}
+	reportMempoolActivity(tx, parties)
+}
+
+// mempoolParties returns the watched addresses a transaction pays or spends from, and whether
+// the owner of every input was found. Inputs missing from the output cache are fetched from
+// rpcNode unless it is empty.
+func mempoolParties(tx neorpc.GetRawTransactionResult, rpcNode string) (map[string]string, bool) {
+	parties := map[string]string{}
+	for _, out := range tx.Vout {
+		addDirection(parties, out.Address, "in")
+	}
+	resolved := true
+	for _, in := range tx.Vin {
+		address, ok := inputAddress(in.Txid, in.Vout, rpcNode)
+		resolved = resolved && ok
+		addDirection(parties, address, "out")
+	}
+	return watchedAddresses(parties), resolved
+}
+
+func reportMempoolActivity(tx neorpc.GetRawTransactionResult, parties map[string]string) {
+	if len(parties) == 0 {
+		return
+	}
+
+	addressMutex.Lock()
+	pendingTxs[tx.Txid] = &pendingTx{seen: time.Now(), addresses: parties}
+	addressMutex.Unlock()
+	for address, direction := range parties {
+		publishActivity(AddressActivity{Type: "mempool", Address: address, TxId: tx.Txid, Direction: direction, Tx: tx})
+	}
+}
+
+// outputAddresses lists the addresses paid by each output of a transaction
+func outputAddresses(tx neorpc.GetRawTransactionResult) []string {
+	addresses := make([]string, len(tx.Vout))
+	for _, out := range tx.Vout {
+		if out.N >= 0 && out.N < len(addresses) {
+			addresses[out.N] = out.Address
+		}
+	}
+	return addresses
+}
+
+// storeOutputs remembers who the outputs of a transaction pay, so the inputs spending them
+// later are resolved without a RPC call
+func storeOutputs(txid string, addresses []string) {
+	if txid == "" {
+		return
+	}
+	outputMutex.Lock()
+	if _, ok := outputs[txid]; !ok {
+		if oldest := outputOrder[outputNext]; oldest != "" {
+			delete(outputs, oldest)
+		}
+		outputOrder[outputNext] = txid
+		outputNext = (outputNext + 1) % len(outputOrder)
+	}
+	outputs[txid] = addresses
+	outputMutex.Unlock()
+}
+
+// inputAddress returns the address owning output n of a transaction, or "" if it isn't known,
+// ok tells if the outputs of the transaction were found. When they weren't recorded the
+// transaction is fetched from rpcNode, if one is given.
+func inputAddress(txid string, n int, rpcNode string) (address string, ok bool) {
+	outputMutex.Lock()
+	addresses, ok := outputs[txid]
+	outputMutex.Unlock()
+	if !ok {
+		if rpcNode == "" {
+			return "", false
+		}
+		raw := neorpc.NewClient(rpcNode).GetRawTransaction(txid)
+		if raw.ErrorResponse != nil || raw.Result.Txid == "" {
+			return "", false
+		}
+		addresses = outputAddresses(raw.Result)
+		storeOutputs(txid, addresses)
+	}
+	if n < 0 || n >= len(addresses) {
+		return "", true
+	}
+	return addresses[n], true
+}
+
+// publishTransferActivity reports a NEP-5 transfer to its sender and receiver
+func publishTransferActivity(t NEP5Transfer) {
+	parties := map[string]string{}
+	if t.From != nil {
+		addDirection(parties, t.From.Address, "out")
+	}
+	if t.To != nil {
+		addDirection(parties, t.To.Address, "in")
+	}
+	for address, direction := range watchedAddresses(parties) {
+		transfer := t
+		publishActivity(AddressActivity{Type: "nep5_transfer", Address: address, TxId: t.TxId, Direction: direction, Transfer: &transfer})
+	}
+}
+
+// publishBlockActivity confirms the pending transactions included in a block, along with
+// the transactions paying a watched address that weren't seen in the mempool.
+func publishBlockActivity(block map[string]interface{}) {
+	index, _ := block["index"].(float64)
+	height := int64(index)
+	hash, _ := block["hash"].(string)
+	txs, _ := block["tx"].([]interface{})
+
+	type confirmation struct {
+		txid    string
+		parties map[string]string
+	}
+	confirmed := []confirmation{}
+	for _, t := range txs {
+		tx, _ := t.(map[string]interface{})
+		txid, _ := tx["txid"].(string)
+		vout, _ := tx["vout"].([]interface{})
+		addresses := make([]string, len(vout))
+		for i, o := range vout {
+			out, _ := o.(map[string]interface{})
+			addresses[i], _ = out["address"].(string)
+		}
+		storeOutputs(txid, addresses)
+	}
+	addressMutex.Lock()
+	for _, t := range txs {
+		tx, _ := t.(map[string]interface{})
+		txid, _ := tx["txid"].(string)
+		parties := map[string]string{}
+		if pending, ok := pendingTxs[txid]; ok {
+			for address, direction := range pending.addresses {
+				parties[address] = direction
+			}
+			delete(pendingTxs, txid)
+		}
+		vout, _ := tx["vout"].([]interface{})
+		for _, o := range vout {
+			out, _ := o.(map[string]interface{})
+			address, _ := out["address"].(string)
+			if watched[address] > 0 {
+				if _, ok := parties[address]; !ok {
+					parties[address] = "in"
+				}
+			}
+		}
+		if len(parties) > 0 {
+			confirmed = append(confirmed, confirmation{txid, parties})
+		}
+	}
+	for txid, pending := range pendingTxs {
+		if time.Since(pending.seen) > pendingTxLifetime {
+			delete(pendingTxs, txid)
+		}
+	}
+	addressMutex.Unlock()
+
+	for _, c := range confirmed {
+		for address, direction := range c.parties {
+			publishActivity(AddressActivity{Type: "confirmed", Address: address, TxId: c.txid, Direction: direction, Block: &height, BlockHash: hash})
+		}
+	}
+}
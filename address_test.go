@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+)
+
+const neoAsset = "0xc56f33fc6ecfcd0c225c4ab356fee59390af8560be0e930faebe74a6daff7c9b"
+
+func rawTx(t *testing.T, data string) neorpc.GetRawTransactionResult {
+	var tx neorpc.GetRawTransactionResult
+	if err := json.Unmarshal([]byte(data), &tx); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestAddressActivity(t *testing.T) {
+	alice, bob := "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA", "AUWGapjQ1rThjZDYF3rK1HPfY4UjENhXom"
+	var calls int64
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-100,"message":"Unknown transaction"}}`))
+	}))
+	defer rpc.Close()
+
+	c, _ := newTestClient(true)
+	if r := c.handleCommand(command{Op: opSubscribe, Channel: "address/" + alice}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	defer c.unsubscribe("1")
+
+	// alice is paid, then spends what she got paying bob and herself the change
+	funding := rawTx(t, `{"txid":"0xe1","vin":[{"txid":"0xe0","vout":0}],"vout":[{"n":0,"asset":"`+neoAsset+`","value":"10","address":"`+alice+`"}]}`)
+	spending := rawTx(t, `{"txid":"0xe2","vin":[{"txid":"0xe1","vout":0}],"vout":[{"n":0,"asset":"`+neoAsset+`","value":"4","address":"`+bob+`"},{"n":1,"asset":"`+neoAsset+`","value":"6","address":"`+alice+`"}]}`)
+	publishMempoolActivity(funding, rpc.URL)
+	publishMempoolActivity(spending, rpc.URL)
+	publishBlockActivity(map[string]interface{}{
+		"index": float64(20),
+		"hash":  "0xb20",
+		"tx": []interface{}{
+			map[string]interface{}{"txid": "0xe2"},
+			map[string]interface{}{"txid": "0xe3", "vout": []interface{}{map[string]interface{}{"address": alice}}},
+			map[string]interface{}{"txid": "0xe4", "vout": []interface{}{map[string]interface{}{"address": bob}}},
+		},
+	})
+
+	// The output of a block transaction is resolved without the node too
+	if address, _ := inputAddress("0xe3", 0, ""); address != alice {
+		t.Errorf("the output of 0xe3 belongs to %q", address)
+	}
+
+	expected := []AddressActivity{
+		{Type: "mempool", Address: alice, TxId: "0xe1", Direction: "in"},
+		{Type: "mempool", Address: alice, TxId: "0xe2", Direction: "self"},
+		{Type: "confirmed", Address: alice, TxId: "0xe2", Direction: "self"},
+		{Type: "confirmed", Address: alice, TxId: "0xe3", Direction: "in"},
+	}
+	frames := receive(t, c, len(expected)+1)[1:]
+	for i, frame := range frames {
+		var e struct {
+			Data AddressActivity `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(frame), &e); err != nil {
+			t.Fatal(err)
+		}
+		a := e.Data
+		if i >= len(expected) || a.Type != expected[i].Type || a.TxId != expected[i].TxId || a.Direction != expected[i].Direction || a.Address != alice {
+			t.Errorf("unexpected activity %s", frame)
+		}
+		if a.Type == "confirmed" && (a.Block == nil || *a.Block != 20 || a.BlockHash != "0xb20") {
+			t.Errorf("unexpected block in %s", frame)
+		}
+	}
+	// The unknown input of the first transaction isn't asked to the node without p2p.rpcFallback
+	if n := atomic.LoadInt64(&calls); n != 0 {
+		t.Errorf("%d RPC calls", n)
+	}
+}
+
+func TestAddressActivityRPCFallback(t *testing.T) {
+	defer setConfig(func(config *Configuration) { config.P2P = &P2PConfig{RPCFallback: true} })()
+	bob := "AUWGapjQ1rThjZDYF3rK1HPfY4UjENhXom"
+	rpc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"txid":"0xd0","vin":[],"vout":[{"n":0,"asset":"` + neoAsset + `","value":"1","address":"` + bob + `"}]}}`))
+	}))
+	defer rpc.Close()
+
+	c, _ := newTestClient(true)
+	if r := c.handleCommand(command{Op: opSubscribe, Channel: "address/" + bob}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	defer c.unsubscribe("1")
+
+	// The input is resolved by the node in the background
+	publishMempoolActivity(rawTx(t, `{"txid":"0xd1","vin":[{"txid":"0xd0","vout":0}],"vout":[]}`), rpc.URL)
+	var e struct {
+		Data AddressActivity `json:"data"`
+	}
+	json.Unmarshal([]byte(receive(t, c, 2)[1]), &e)
+	if e.Data.Type != "mempool" || e.Data.TxId != "0xd1" || e.Data.Direction != "out" {
+		t.Errorf("unexpected activity %+v", e.Data)
+	}
+}
+
+func TestOutputCacheEvictsTheOldest(t *testing.T) {
+	for i := 0; i <= outputCacheSize; i++ {
+		storeOutputs(fmt.Sprintf("0xf%d", i), []string{"A"})
+	}
+	if _, ok := inputAddress("0xf0", 0, ""); ok {
+		t.Error("the oldest transaction is still cached")
+	}
+	if _, ok := inputAddress("0xf1", 0, ""); !ok {
+		t.Error("the cache was emptied")
+	}
+	outputMutex.Lock()
+	size := len(outputs)
+	outputMutex.Unlock()
+	if size != outputCacheSize {
+		t.Errorf("%d cached transactions", size)
+	}
+}
+
+func TestTransferActivity(t *testing.T) {
+	alice, bob := "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA", "AUWGapjQ1rThjZDYF3rK1HPfY4UjENhXom"
+	c, _ := newTestClient(true)
+	if r := c.handleCommand(command{Op: opSubscribe, Channel: "address/" + bob}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	defer c.unsubscribe("1")
+	publishTransferActivity(NEP5Transfer{TxId: "0xe5", From: &NEP5Account{Address: alice}, To: &NEP5Account{Address: bob}})
+
+	var e struct {
+		Data AddressActivity `json:"data"`
+	}
+	json.Unmarshal([]byte(receive(t, c, 2)[1]), &e)
+	if e.Data.Type != "nep5_transfer" || e.Data.Direction != "in" || e.Data.Transfer == nil || e.Data.Transfer.TxId != "0xe5" {
+		t.Errorf("unexpected activity %+v", e.Data)
+	}
+}
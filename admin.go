@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin protects the admin endpoints with the adminToken of the config file,
+// they are disabled when no token is configured.
+func requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := getConfig().AdminToken
+		if token == "" {
+			http.Error(w, "The admin API is not enabled", 404)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
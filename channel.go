@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReplayBufferSize = 1000
+
+// Channels defined by clients (contracts, filters, addresses...) are dropped once they have
+// had no subscriber for this long, the built-in ones live as long as the process.
+var idleChannelTTL = 10 * time.Minute
+
+var builtinChannels = map[string]bool{
+	"event":            true,
+	"block":            true,
+	"consensus":        true,
+	"mempool/tx":       true,
+	"nep5/transfer":    true,
+	"nep5/diagnostics": true,
+}
+
+// Close code sent to path based clients whose resume cursor can't be honoured
+const closeBadCursor = 4001
+
+var (
+	channels      = map[string]*channelState{}
+	channelsMutex sync.Mutex
+
+	// Last sequence number of the channels dropped for being idle, a channel created again
+	// carries on from it so the cursors of its previous life can't match other messages.
+	expiredSeqs = map[string]uint64{}
+
+	// Index of the last block published, messages are tagged with it so clients can resume by block
+	lastBlockIndex int64 = -1
+)
+
+// backlogEntry is a message as it was published on a channel
+type backlogEntry struct {
+	seq   uint64
+	block int64
+	data  json.RawMessage
+}
+
+// cursorError is returned when the messages a cursor asks for can't be replayed
+type cursorError string
+
+func (e cursorError) Error() string {
+	return string(e)
+}
+
+// cursor tells where a subscription wants to resume from, a nil cursor only receives live messages
+type cursor struct {
+	since     *uint64 // Replay messages with a higher sequence number
+	fromBlock *int64  // Replay messages tagged with this block index or a later one
+	all       bool    // Replay the whole backlog
+}
+
+// channelState holds the subscribers of a channel together with the last messages published on
+// it, each with a monotonically increasing sequence number.
+type channelState struct {
+	mu       sync.Mutex
+	key      string
+	seq      uint64
+	backlog  []backlogEntry // ring buffer, oldest entry at start. It grows up to capacity as messages arrive
+	capacity int
+	start    int
+	count    int
+	subs     []*subscription
+	expiry   *time.Timer // Pending removal of an idle channel
+	removed  bool        // Dropped from the table, it has to be looked up again
+}
+
+func getChannel(key string) *channelState {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	ch, ok := channels[key]
+	if !ok {
+		size := getConfig().ReplayBufferSize
+		if size < 1 {
+			size = defaultReplayBufferSize
+		}
+		ch = &channelState{key: key, capacity: size, seq: expiredSeqs[key]}
+		delete(expiredSeqs, key)
+		ch.scheduleExpiry()
+		channels[key] = ch
+	}
+	return ch
+}
+
+// lockChannel returns the channel with its lock held, creating it if needed
+func lockChannel(key string) *channelState {
+	for {
+		ch := getChannel(key)
+		ch.mu.Lock()
+		if !ch.removed {
+			return ch
+		}
+		// Expired or closed since it was looked up
+		ch.mu.Unlock()
+	}
+}
+
+// scheduleExpiry starts the countdown to drop a channel that has no subscriber, built-in
+// channels are never dropped.
+func (ch *channelState) scheduleExpiry() {
+	if builtinChannels[ch.key] || ch.expiry != nil {
+		return
+	}
+	ch.expiry = time.AfterFunc(idleChannelTTL, func() { expireChannel(ch) })
+}
+
+func (ch *channelState) cancelExpiry() {
+	if ch.expiry != nil {
+		ch.expiry.Stop()
+		ch.expiry = nil
+	}
+}
+
+// expireChannel drops an idle channel with its backlog unless it got a subscriber or a webhook meanwhile
+func expireChannel(ch *channelState) {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.expiry = nil
+	if ch.removed || len(ch.subs) > 0 {
+		return
+	}
+	if webhooks.Watched(ch.key) {
+		ch.scheduleExpiry()
+		return
+	}
+	ch.removed = true
+	if channels[ch.key] == ch {
+		delete(channels, ch.key)
+		if ch.seq > 0 {
+			expiredSeqs[ch.key] = ch.seq
+		}
+	}
+}
+
+// lookupChannel returns the state of a channel without creating it, nil if it doesn't exist
+func lookupChannel(key string) *channelState {
+	channelsMutex.Lock()
+	defer channelsMutex.Unlock()
+	return channels[key]
+}
+
+func (ch *channelState) entry(i int) backlogEntry {
+	return ch.backlog[(ch.start+i)%len(ch.backlog)]
+}
+
+func (ch *channelState) push(e backlogEntry) {
+	if len(ch.backlog) < ch.capacity {
+		// start stays at 0 until the buffer is full
+		ch.backlog = append(ch.backlog, e)
+		ch.count++
+		return
+	}
+	ch.backlog[ch.start] = e
+	ch.start = (ch.start + 1) % len(ch.backlog)
+}
+
+// replay returns the messages a cursor asks for, or an error if they have already been evicted
+func (ch *channelState) replay(c *cursor) ([]backlogEntry, error) {
+	if c == nil || (c.since == nil && c.fromBlock == nil && !c.all) {
+		return nil, nil
+	}
+	first := 0
+	if c.since != nil {
+		since := *c.since
+		if since > ch.seq {
+			return nil, cursorError(fmt.Sprintf("cursor %d is ahead of the stream (last sequence number is %d)", since, ch.seq))
+		}
+		oldest := ch.seq - uint64(ch.count) + 1
+		if since+1 < oldest {
+			return nil, cursorError(fmt.Sprintf("cursor %d is no longer available, the oldest buffered message is %d", since, oldest))
+		}
+		first = int(since + 1 - oldest)
+	} else if c.fromBlock != nil {
+		if ch.count == 0 || ch.entry(0).block > *c.fromBlock {
+			return nil, cursorError(fmt.Sprintf("block %d is no longer available in the replay buffer", *c.fromBlock))
+		}
+		for first < ch.count && ch.entry(first).block < *c.fromBlock {
+			first++
+		}
+	}
+
+	entries := make([]backlogEntry, 0, ch.count-first)
+	for i := first; i < ch.count; i++ {
+		entries = append(entries, ch.entry(i))
+	}
+	return entries, nil
+}
+
+// subscribe registers a subscription, handing it the acknowledgement and the backlog selected
+// by the cursor first. Both happen under the channel lock so no message is missed or delivered twice.
+func subscribe(sub *subscription, c *cursor, ack json.RawMessage) error {
+	ch := lockChannel(sub.key)
+	defer ch.mu.Unlock()
+	entries, err := ch.replay(c)
+	if err != nil {
+		return err
+	}
+	ch.cancelExpiry()
+	if ack != nil || len(entries) > 0 {
+		sub.client.queueReplay(replay{sub, ack, entries})
+	}
+	ch.subs = append(ch.subs, sub)
+	if sub.index != nil {
+		sub.index.retain()
+	}
+	connectedClients.With(channelLabel(sub.key)).Inc()
+	return nil
+}
+
+func unsubscribe(sub *subscription) {
+	ch := lookupChannel(sub.key)
+	if ch == nil {
+		// Already ended by closeChannel
+		return
+	}
+	ch.mu.Lock()
+	newSubs := []*subscription{}
+	for _, s := range ch.subs {
+		if s != sub {
+			newSubs = append(newSubs, s)
+		}
+	}
+	if len(newSubs) < len(ch.subs) {
+		if sub.index != nil {
+			sub.index.release()
+		}
+		connectedClients.With(channelLabel(sub.key)).Dec()
+	}
+	ch.subs = newSubs
+	if len(ch.subs) == 0 && !ch.removed {
+		ch.scheduleExpiry()
+	}
+	ch.mu.Unlock()
+}
+
+// closeChannel ends a channel whose stream is complete, every subscription is ended once it has
+// received the messages already published and the backlog is dropped.
+func closeChannel(key string, reason string) {
+	channelsMutex.Lock()
+	ch, ok := channels[key]
+	if !ok {
+		channelsMutex.Unlock()
+		return
+	}
+	ch.mu.Lock()
+	delete(channels, key)
+	if ch.seq > 0 {
+		expiredSeqs[key] = ch.seq
+	}
+	subs := ch.subs
+	ch.subs = nil
+	ch.removed = true
+	ch.cancelExpiry()
+	ch.mu.Unlock()
+	channelsMutex.Unlock()
+	for _, sub := range subs {
+		if sub.index != nil {
+			sub.index.release()
+		}
+		connectedClients.With(channelLabel(sub.key)).Dec()
+		sub.client.end(sub, reason)
+	}
+}
+
+func sendMessage(channel string, message WebSocketMessage) {
+	ingested := time.Now()
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("can't encode message for %s: %v", channel, err)
+		return
+	}
+	publishedMessages.With(channelLabel(channel)).Inc()
+
+	ch := lockChannel(channel)
+	defer ch.mu.Unlock()
+	ch.seq++
+	ch.push(backlogEntry{seq: ch.seq, block: atomic.LoadInt64(&lastBlockIndex), data: data})
+	for _, s := range ch.subs {
+		s.client.enqueue(delivery{sub: s, seq: ch.seq, data: data, ingested: ingested})
+	}
+	webhooks.Publish(channel, ch.seq, data)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	ch := &channelState{key: "test", capacity: 3}
+	for seq, block := range []int64{9, 10, 10, 11, 12} {
+		ch.seq++
+		ch.push(backlogEntry{seq: uint64(seq + 1), block: block})
+	}
+	since := func(n uint64) *cursor { return &cursor{since: &n} }
+	fromBlock := func(n int64) *cursor { return &cursor{fromBlock: &n} }
+
+	tests := []struct {
+		name   string
+		cursor *cursor
+		seqs   []uint64
+		err    string
+	}{
+		{"live only", nil, nil, ""},
+		{"since", since(3), []uint64{4, 5}, ""},
+		{"since the oldest", since(2), []uint64{3, 4, 5}, ""},
+		{"up to date", since(5), nil, ""},
+		{"evicted", since(1), nil, "no longer available"},
+		{"ahead", since(6), nil, "ahead of the stream"},
+		{"from block", fromBlock(11), []uint64{4, 5}, ""},
+		{"from the oldest block", fromBlock(10), []uint64{3, 4, 5}, ""},
+		{"from a future block", fromBlock(13), nil, ""},
+		{"from an evicted block", fromBlock(9), nil, "no longer available"},
+	}
+	for _, test := range tests {
+		entries, err := ch.replay(test.cursor)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		seqs := []uint64{}
+		for _, e := range entries {
+			seqs = append(seqs, e.seq)
+		}
+		if len(seqs) != len(test.seqs) {
+			t.Errorf("%s: got %v, expected %v", test.name, seqs, test.seqs)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != test.seqs[i] {
+				t.Errorf("%s: got %v, expected %v", test.name, seqs, test.seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestBacklogGrowsAsMessagesArrive(t *testing.T) {
+	ch := &channelState{key: "test", capacity: defaultReplayBufferSize}
+	ch.push(backlogEntry{seq: 1})
+	ch.push(backlogEntry{seq: 2})
+	if len(ch.backlog) != 2 || ch.count != 2 {
+		t.Errorf("backlog of %d entries for %d messages", len(ch.backlog), ch.count)
+	}
+}
+
+func TestIdleChannelsExpire(t *testing.T) {
+	ttl := idleChannelTTL
+	idleChannelTTL = 20 * time.Millisecond
+	defer func() { idleChannelTTL = ttl }()
+
+	idle := "0x00000000000000000000000000000000000000e1"
+	sendMessage(idle, map[string]int{"n": 1})
+	sendMessage("block", map[string]int{"n": 1})
+
+	c, _ := newTestClient(true)
+	subscribed := "0x00000000000000000000000000000000000000e2"
+	sub := &subscription{id: "1", channel: "event", key: subscribed, client: c}
+	if err := subscribe(sub, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if lookupChannel(idle) != nil {
+		t.Error("the idle channel wasn't dropped")
+	}
+	// Its sequence numbers carry on if it is used again, so old cursors don't match new messages
+	sendMessage(idle, map[string]int{"n": 2})
+	if ch := lookupChannel(idle); ch == nil || ch.seq != 2 {
+		t.Errorf("the sequence numbers of the channel restarted: %+v", ch)
+	}
+	stale := uint64(0)
+	late := &subscription{id: "2", channel: "event", key: idle, client: c}
+	if err := subscribe(late, &cursor{since: &stale}, nil); err == nil {
+		t.Error("a cursor from before the channel expired was accepted")
+	}
+	if lookupChannel("block") == nil {
+		t.Error("a built-in channel was dropped")
+	}
+	if lookupChannel(subscribed) == nil {
+		t.Error("a channel with a subscriber was dropped")
+	}
+
+	unsubscribe(sub)
+	time.Sleep(100 * time.Millisecond)
+	if lookupChannel(subscribed) != nil {
+		t.Error("the channel wasn't dropped after its last subscriber left")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx"
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+const (
+	defaultPort = 8080
+
+	// Every field of the config file can be overridden by an environment variable
+	// named after it, eg: websocketEventsProvider -> PUBSUB_WEBSOCKET_EVENTS_PROVIDER
+	envPrefix = "PUBSUB_"
+)
+
+// Magic numbers of the networks that can be chosen with -network
+var networkMagics = map[string]network.NEONetworkMagic{
+	"main": neotx.NEOMainNet,
+	"test": neotx.NEOTestNet,
+}
+
+// Config file used for each network when -config isn't given
+var networkConfigFiles = map[string]string{
+	"main": "config.json",
+	"test": "config.testnet.json",
+}
+
+func defaultConfiguration() Configuration {
+	return Configuration{
+		Port:                defaultPort,
+		SubscriberQueueSize: defaultQueueSize,
+		OverflowPolicy:      string(overflowDropOldest),
+		ReplayBufferSize:    defaultReplayBufferSize,
+	}
+}
+
+// Where the config is read from, set from the command line
+var (
+	configFile    string
+	configNetwork string // The config has to be for this network, not checked when empty
+	portFlag      int    // Overrides the port of the config when set
+)
+
+// readConfiguration loads the config file, applies the overrides of the environment and
+// the command line and validates the result.
+func readConfiguration() (Configuration, error) {
+	config, err := loadConfigurationFile(configFile)
+	if err != nil {
+		return config, err
+	}
+	if portFlag != 0 {
+		config.Port = portFlag
+	}
+	if err := config.validate(configNetwork); err != nil {
+		return config, fmt.Errorf("%s: %v", configFile, err)
+	}
+	return config, nil
+}
+
+// loadConfigurationFile reads a config file rejecting unknown fields and applies the
+// environment overrides.
+func loadConfigurationFile(file string) (Configuration, error) {
+	configuration := defaultConfiguration()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return configuration, err
+	}
+	jsonParser := json.NewDecoder(bytes.NewReader(data))
+	jsonParser.DisallowUnknownFields()
+	if err := jsonParser.Decode(&configuration); err != nil {
+		return configuration, fmt.Errorf("%s: %v", file, describeJSONError(data, err))
+	}
+	if err := applyEnvironment(&configuration, os.LookupEnv); err != nil {
+		return configuration, err
+	}
+	return configuration, nil
+}
+
+// describeJSONError adds the line and column to the errors that only carry a byte offset, which
+// is right after the invalid character or value
+func describeJSONError(data []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n') - 1
+	if column < 1 {
+		column = 1
+	}
+	return fmt.Errorf("line %d, column %d: %v", line, column, err)
+}
+
+// envName turns a json field name into its environment variable
+func envName(field string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range field {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnvironment overrides the config fields whose variable is set. Strings are
+// taken as they are, any other field (numbers, the node list, sections...) is JSON.
+func applyEnvironment(config *Configuration, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if field == "" || field == "-" {
+			continue
+		}
+		name := envName(field)
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		target := v.Field(i)
+		if target.Kind() == reflect.String {
+			target.SetString(value)
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(target.Addr().Interface()); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the whole config and reports every problem found, one per line
+func (config Configuration) validate(mode string) error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(config.Nodes) == 0 {
+		add("nodes: at least one node is required")
+	}
+	for i, node := range config.Nodes {
+		if err := validateHostPort(node.P2P); err != nil {
+			add("nodes[%d].p2p: %v", i, err)
+		}
+		if err := validateURL(node.RPC, "http", "https"); err != nil {
+			add("nodes[%d].rpc: %v", i, err)
+		}
+	}
+	if err := validateURL(config.WebsocketEventsProvider, "ws", "wss"); err != nil {
+		add("websocketEventsProvider: %v", err)
+	}
+
+	if config.Magic <= 0 || int64(config.Magic) > 0xffffffff {
+		add("magic: %d is not a valid network magic", config.Magic)
+	} else if expected, ok := networkMagics[mode]; ok && network.NEONetworkMagic(config.Magic) != expected {
+		add("magic: %d doesn't match the %s network, which uses %d", config.Magic, mode, expected)
+	}
+
+	if config.Port < 1 || config.Port > 65535 {
+		add("port: %d is out of range", config.Port)
+	}
+	if config.SubscriberQueueSize < 1 {
+		add("subscriberQueueSize: must be at least 1")
+	}
+	if _, err := parseOverflowPolicy(config.OverflowPolicy); err != nil {
+		add("overflowPolicy: %v", err)
+	}
+	if config.ReplayBufferSize < 0 {
+		add("replayBufferSize: can't be negative")
+	}
+	if p := config.P2P; p != nil {
+		if p.MaxPeers < 0 {
+			add("p2p.maxPeers: can't be negative")
+		}
+		if p.SeenSeconds < 0 {
+			add("p2p.seenSeconds: can't be negative")
+		}
+		if p.MaxViolations < 0 {
+			add("p2p.maxViolations: can't be negative")
+		}
+		if p.HandshakeSeconds < 0 {
+			add("p2p.handshakeSeconds: can't be negative")
+		}
+		if p.IdleSeconds < 0 {
+			add("p2p.idleSeconds: can't be negative")
+		}
+	}
+	if t := config.TxTracking; t != nil {
+		if t.ConfirmationDepth < 0 {
+			add("txTracking.confirmationDepth: can't be negative")
+		}
+		if t.TimeoutSeconds < 0 {
+			add("txTracking.timeoutSeconds: can't be negative")
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+}
+
+func validateHostPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host in %q", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func validateURL(address string, schemes ...string) error {
+	if address == "" {
+		return fmt.Errorf("is required")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q must be a %s url", address, strings.Join(schemes, " or "))
+}
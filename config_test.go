@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func validConfiguration() Configuration {
+	config := defaultConfiguration()
+	config.Nodes = []NodeAddresses{{P2P: "seed1.ngd.network:10333", RPC: "http://seed1.ngd.network:10332"}}
+	config.WebsocketEventsProvider = "wss://pubsub.main.neologin.io/ws/"
+	config.Magic = int(networkMagics["main"])
+	return config
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfiguration().validate("main"); err != nil {
+		t.Fatalf("a valid config was rejected: %v", err)
+	}
+	tests := map[string]func(*Configuration){
+		"nodes: at least one node is required":                  func(c *Configuration) { c.Nodes = nil },
+		"nodes[0].p2p: address seed1.ngd.network: missing port": func(c *Configuration) { c.Nodes[0].P2P = "seed1.ngd.network" },
+		`nodes[0].rpc: "ws://seed1" must be a http`:             func(c *Configuration) { c.Nodes[0].RPC = "ws://seed1" },
+		"websocketEventsProvider: is required":                  func(c *Configuration) { c.WebsocketEventsProvider = "" },
+		"magic: 0 is not a valid network magic":                 func(c *Configuration) { c.Magic = 0 },
+		"doesn't match the main network":                        func(c *Configuration) { c.Magic = int(networkMagics["test"]) },
+		"port: 70000 is out of range":                           func(c *Configuration) { c.Port = 70000 },
+		"subscriberQueueSize: must be at least 1":               func(c *Configuration) { c.SubscriberQueueSize = 0 },
+		`overflowPolicy: unknown overflow policy "x"`:           func(c *Configuration) { c.OverflowPolicy = "x" },
+		"replayBufferSize: can't be negative":                   func(c *Configuration) { c.ReplayBufferSize = -1 },
+		"p2p.idleSeconds: can't be negative":                    func(c *Configuration) { c.P2P = &P2PConfig{IdleSeconds: -1} },
+		"txTracking.timeoutSeconds: can't be negative": func(c *Configuration) {
+			c.TxTracking = &TxTrackingConfig{TimeoutSeconds: -1}
+		},
+	}
+	for expected, change := range tests {
+		config := validConfiguration()
+		change(&config)
+		if err := config.validate("main"); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+
+	// The magic isn't checked against a network without -network
+	config := validConfiguration()
+	config.Magic = int(networkMagics["test"])
+	if err := config.validate(""); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Every problem is reported at once
+	config.Port, config.Nodes = 0, nil
+	if err := config.validate(""); err == nil || strings.Count(err.Error(), "\n") != 2 {
+		t.Errorf("expected 2 problems, got %v", err)
+	}
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	env := map[string]string{
+		"PUBSUB_WEBSOCKET_EVENTS_PROVIDER": "wss://node/ws/",
+		"PUBSUB_PORT":                      "9000",
+		"PUBSUB_NODES":                     `[{"p2p":"seed2.ngd.network:10333","rpc":"http://seed2.ngd.network:10332"}]`,
+		"PUBSUB_READINESS":                 `{"blockWindowSeconds":60}`,
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	config := validConfiguration()
+	if err := applyEnvironment(&config, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if config.WebsocketEventsProvider != "wss://node/ws/" || config.Port != 9000 {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if len(config.Nodes) != 1 || config.Nodes[0].P2P != "seed2.ngd.network:10333" {
+		t.Errorf("unexpected nodes %+v", config.Nodes)
+	}
+	if config.Readiness == nil || config.Readiness.BlockWindowSeconds != 60 {
+		t.Errorf("unexpected readiness section %+v", config.Readiness)
+	}
+	// Untouched fields keep their value
+	if config.OverflowPolicy != string(overflowDropOldest) {
+		t.Errorf("overflowPolicy changed to %q", config.OverflowPolicy)
+	}
+
+	for name, value := range map[string]string{"PUBSUB_PORT": "nine", "PUBSUB_READINESS": `{"blockWindow":60}`} {
+		config := validConfiguration()
+		err := applyEnvironment(&config, func(n string) (string, bool) { return value, n == name })
+		if err == nil || !strings.HasPrefix(err.Error(), name+":") {
+			t.Errorf("%s=%s: expected an error naming the variable, got %v", name, value, err)
+		}
+	}
+}
+
+func TestDescribeJSONError(t *testing.T) {
+	tests := map[string]string{
+		"{\n  \"port\": 8080,\n  \"magic\": x\n}": "line 3, column 12:",
+		"{\n  \"port\": \"8080\"\n}":              "line 2, column 16:",
+		"{\"nodes\": [{\"p2p\": 1}]}":             "line 1, column 20:",
+	}
+	for data, expected := range tests {
+		var config Configuration
+		err := describeJSONError([]byte(data), json.Unmarshal([]byte(data), &config))
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("%q: expected %q, got %v", data, expected, err)
+		}
+	}
+	var config Configuration
+	if err := describeJSONError(nil, json.Unmarshal([]byte("{"), &config)); err == nil {
+		t.Error("the error was lost")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for field, expected := range map[string]string{"port": "PUBSUB_PORT", "websocketEventsProvider": "PUBSUB_WEBSOCKET_EVENTS_PROVIDER", "readiness": "PUBSUB_READINESS"} {
+		if name := envName(field); name != expected {
+			t.Errorf("%s: got %s, expected %s", field, name, expected)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+	"github.com/corollari/neo-ws-pub-sub/neoutils"
+)
+
+// ConsensusMessage is published on the consensus channel for every dBFT message the validators relay
+type ConsensusMessage struct {
+	Type          string `json:"type"` // ChangeView | PrepareRequest | PrepareResponse | Unknown
+	Block         uint32 `json:"block"`
+	View          uint8  `json:"view"`
+	Validator     uint16 `json:"validator"`
+	Timestamp     uint32 `json:"timestamp"`
+	Hash          string `json:"hash"`
+	NewView       uint8  `json:"newView,omitempty"`       // ChangeView
+	Nonce         string `json:"nonce,omitempty"`         // PrepareRequest
+	NextConsensus string `json:"nextConsensus,omitempty"` // PrepareRequest
+	Transactions  int    `json:"transactions,omitempty"`  // PrepareRequest, proposed for the block
+}
+
+// consensusMessage describes a payload, messages that aren't dBFT 1.0 are published as Unknown
+// with the view number they start with.
+func consensusMessage(p *network.ConsensusPayload) ConsensusMessage {
+	m := ConsensusMessage{
+		Type:      "Unknown",
+		Block:     p.BlockIndex,
+		Validator: p.ValidatorIndex,
+		Timestamp: p.Timestamp,
+		Hash:      hashString(p.Hash()),
+	}
+	message, err := p.Message()
+	if err != nil {
+		if len(p.Data) > 1 {
+			m.View = p.Data[1]
+		}
+		return m
+	}
+	m.Type = message.Type.String()
+	m.View = message.ViewNumber
+	switch message.Type {
+	case network.ChangeViewMessage:
+		m.NewView = message.NewViewNumber
+	case network.PrepareRequestMessage:
+		m.Nonce = fmt.Sprintf("%016x", message.Nonce)
+		m.NextConsensus, _ = neoutils.ScriptHashToAddress(message.NextConsensus[:])
+		m.Transactions = len(message.TransactionHashes)
+	}
+	return m
+}
@@ -0,0 +1,388 @@
+// Package eventlog is an append-only log of the messages published by the server,
+// stored on disk as a sequence of segment files so history survives restarts.
+package eventlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentSize = 64 * 1024 * 1024 // 64MB
+	DefaultQueryLimit  = 100
+
+	segmentExtension = ".log"
+	recordHeaderSize = 8 // length(4) + crc32(4)
+	maxRecordSize    = 16 * 1024 * 1024
+)
+
+// Record is a single message stored in the log
+type Record struct {
+	Channel string          `json:"c"`
+	Key     string          `json:"k,omitempty"` // Secondary key, the contract for events
+	Block   int64           `json:"b"`
+	Time    int64           `json:"t"` // Unix time the record was appended
+	Data    json.RawMessage `json:"d"`
+}
+
+// Options configure the size of the segments and how long they are retained.
+// A zero MaxBytes or MaxAge disables that retention limit.
+type Options struct {
+	SegmentSize int64
+	MaxBytes    int64
+	MaxAge      time.Duration
+}
+
+// Query selects records of a channel, optionally restricted to a key and a block range.
+// Cursor is the value returned by a previous query to fetch the next page.
+type Query struct {
+	Channel   string
+	Key       string
+	FromBlock int64
+	ToBlock   int64 // Inclusive, negative means no upper bound
+	Limit     int
+	Cursor    string
+}
+
+type segment struct {
+	id       uint64
+	path     string
+	size     int64
+	minBlock int64
+	maxBlock int64
+	lastTime int64
+}
+
+// Log is safe for concurrent use, appends are serialized and queries read a snapshot of the segments
+type Log struct {
+	dir     string
+	options Options
+
+	mu       sync.Mutex
+	segments []*segment // oldest first, the last one is open for appending
+	file     *os.File
+}
+
+// Open loads the segments found in dir, creating it if needed. A record left half written
+// by a crash at the end of the last segment is discarded.
+func Open(dir string, options Options) (*Log, error) {
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, options: options}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		s := &segment{id: id, path: filepath.Join(dir, f.Name())}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i].id < l.segments[j].id })
+
+	if len(l.segments) == 0 {
+		if err := l.rotate(); err != nil {
+			return nil, err
+		}
+	} else {
+		last := l.segments[len(l.segments)-1]
+		if err := os.Truncate(last.path, last.size); err != nil {
+			return nil, err
+		}
+		l.file, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := l.enforceRetention(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, segmentExtension)
+}
+
+// load scans a segment to find its valid size and the blocks it covers
+func (s *segment) load() error {
+	s.minBlock, s.maxBlock = -1, -1
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		rec, n, err := readRecord(r)
+		if err != nil {
+			// EOF or a torn write, everything before is valid
+			return nil
+		}
+		s.add(rec, n)
+	}
+}
+
+func (s *segment) add(rec Record, n int64) {
+	if s.minBlock < 0 || rec.Block < s.minBlock {
+		s.minBlock = rec.Block
+	}
+	if rec.Block > s.maxBlock {
+		s.maxBlock = rec.Block
+	}
+	s.lastTime = rec.Time
+	s.size += n
+}
+
+func readRecord(r io.Reader) (Record, int64, error) {
+	var rec Record
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return rec, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return rec, 0, fmt.Errorf("record of %d bytes is too large", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return rec, 0, fmt.Errorf("record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, err
+	}
+	return rec, int64(recordHeaderSize + length), nil
+}
+
+// Append writes a record at the end of the log, Time is filled in if it is zero
+func (l *Log) Append(rec Record) error {
+	if rec.Time == 0 {
+		rec.Time = time.Now().Unix()
+	}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("event log is closed")
+	}
+	active := l.segments[len(l.segments)-1]
+	if active.size > 0 && active.size+int64(len(buf)) > l.options.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		if err := l.enforceRetention(time.Now()); err != nil {
+			return err
+		}
+		active = l.segments[len(l.segments)-1]
+	}
+	if _, err := l.file.Write(buf); err != nil {
+		return err
+	}
+	active.add(rec, int64(len(buf)))
+	return nil
+}
+
+// rotate closes the active segment and starts a new one
+func (l *Log) rotate() error {
+	var id uint64 = 1
+	if len(l.segments) > 0 {
+		id = l.segments[len(l.segments)-1].id + 1
+	}
+	s := &segment{id: id, path: filepath.Join(l.dir, segmentName(id)), minBlock: -1, maxBlock: -1}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	l.segments = append(l.segments, s)
+	return nil
+}
+
+// enforceRetention deletes the oldest sealed segments until the limits are met, the
+// active segment is never removed.
+func (l *Log) enforceRetention(now time.Time) error {
+	var total int64
+	for _, s := range l.segments {
+		total += s.size
+	}
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		tooBig := l.options.MaxBytes > 0 && total > l.options.MaxBytes
+		tooOld := l.options.MaxAge > 0 && now.Sub(time.Unix(oldest.lastTime, 0)) > l.options.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= oldest.size
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// Compact applies the retention limits, it is meant to be called periodically so
+// old segments are removed even when nothing is being appended.
+func (l *Log) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enforceRetention(time.Now())
+}
+
+// Close closes the active segment, the log can't be appended to afterwards
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+type position struct {
+	segment uint64
+	offset  int64
+}
+
+func parseCursor(c string) (position, error) {
+	var p position
+	if c == "" {
+		return p, nil
+	}
+	parts := strings.Split(c, "-")
+	if len(parts) != 2 {
+		return p, fmt.Errorf("invalid cursor %q", c)
+	}
+	var err error
+	if p.segment, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return p, fmt.Errorf("invalid cursor %q", c)
+	}
+	if p.offset, err = strconv.ParseInt(parts[1], 10, 64); err != nil || p.offset < 0 {
+		return p, fmt.Errorf("invalid cursor %q", c)
+	}
+	return p, nil
+}
+
+func (p position) String() string {
+	return fmt.Sprintf("%d-%d", p.segment, p.offset)
+}
+
+// Query returns the matching records in the order they were appended. When the page is
+// full a cursor for the next one is returned as well, it is empty otherwise.
+func (l *Log) Query(q Query) ([]Record, string, error) {
+	from, err := parseCursor(q.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultQueryLimit
+	}
+
+	// Snapshot the segments, records appended after this point are not visible to this query
+	l.mu.Lock()
+	segments := make([]segment, len(l.segments))
+	for i, s := range l.segments {
+		segments[i] = *s
+	}
+	l.mu.Unlock()
+
+	records := []Record{}
+	for _, s := range segments {
+		if s.id < from.segment || s.minBlock < 0 {
+			continue
+		}
+		if s.maxBlock < q.FromBlock || (q.ToBlock >= 0 && s.minBlock > q.ToBlock) {
+			continue
+		}
+		offset := int64(0)
+		if s.id == from.segment {
+			offset = from.offset
+		}
+		next, err := s.scan(offset, q, &records)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(records) == q.Limit {
+			return records, position{s.id, next}.String(), nil
+		}
+	}
+	return records, "", nil
+}
+
+// scan appends the records matching q found from offset on, stopping when the limit is reached.
+// It returns the offset following the last record read.
+func (s segment) scan(offset int64, q Query, records *[]Record) (int64, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		// Removed by retention while querying
+		return s.size, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(io.LimitReader(f, s.size-offset))
+	for offset < s.size {
+		rec, n, err := readRecord(r)
+		if err != nil {
+			return 0, err
+		}
+		offset += n
+		if rec.Channel != q.Channel || (q.Key != "" && rec.Key != q.Key) {
+			continue
+		}
+		if rec.Block < q.FromBlock || (q.ToBlock >= 0 && rec.Block > q.ToBlock) {
+			continue
+		}
+		*records = append(*records, rec)
+		if len(*records) == q.Limit {
+			break
+		}
+	}
+	return offset, nil
+}
@@ -0,0 +1,123 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempLog(t *testing.T, options Options) (*Log, string) {
+	dir, err := ioutil.TempDir("", "eventlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, dir
+}
+
+func appendBlocks(t *testing.T, l *Log, from, to int64) {
+	for i := from; i <= to; i++ {
+		data := json.RawMessage(fmt.Sprintf(`{"index":%d}`, i))
+		if err := l.Append(Record{Channel: "block", Block: i, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("0x%02d", i%2)
+		if err := l.Append(Record{Channel: "event", Key: key, Block: i, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueryPaging(t *testing.T) {
+	l, dir := tempLog(t, Options{SegmentSize: 256})
+	defer os.RemoveAll(dir)
+	appendBlocks(t, l, 1, 20)
+
+	var blocks []int64
+	cursor := ""
+	for {
+		records, next, err := l.Query(Query{Channel: "block", FromBlock: 5, ToBlock: 14, Limit: 3, Cursor: cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range records {
+			blocks = append(blocks, r.Block)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(blocks) != 10 || blocks[0] != 5 || blocks[9] != 14 {
+		t.Fatalf("unexpected blocks %v", blocks)
+	}
+
+	records, _, err := l.Query(Query{Channel: "event", Key: "0x01", ToBlock: -1, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 10 {
+		t.Fatalf("expected 10 events for 0x01, got %d", len(records))
+	}
+}
+
+func TestReopen(t *testing.T) {
+	l, dir := tempLog(t, Options{SegmentSize: 256})
+	defer os.RemoveAll(dir)
+	appendBlocks(t, l, 1, 10)
+	l.Close()
+
+	// Simulate a write torn by a crash
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0xff, 0x00, 0x00})
+	f.Close()
+
+	l, err = Open(dir, Options{SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendBlocks(t, l, 11, 12)
+	records, _, err := l.Query(Query{Channel: "block", ToBlock: -1, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 12 || records[11].Block != 12 {
+		t.Fatalf("expected 12 blocks after reopening, got %d", len(records))
+	}
+}
+
+func TestRetention(t *testing.T) {
+	l, dir := tempLog(t, Options{SegmentSize: 256, MaxBytes: 1024})
+	defer os.RemoveAll(dir)
+	appendBlocks(t, l, 1, 50)
+
+	records, _, err := l.Query(Query{Channel: "block", ToBlock: -1, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || records[0].Block == 1 || records[len(records)-1].Block != 50 {
+		t.Fatalf("oldest blocks should have been removed, got %d records", len(records))
+	}
+
+	l.options = Options{SegmentSize: 256, MaxAge: time.Hour}
+	l.mu.Lock()
+	err = l.enforceRetention(time.Now().Add(2 * time.Hour))
+	l.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.segments) != 1 {
+		t.Fatalf("only the active segment should be left, got %d", len(l.segments))
+	}
+}
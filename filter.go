@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/corollari/neo-ws-pub-sub/neoutils"
+)
+
+const (
+	maxFilterAlternatives = 16
+	maxFilterConditions   = 16
+	maxFilterArgument     = 64
+)
+
+// eventCondition matches a single field of an event notification
+type eventCondition struct {
+	arg    int // Index in the notification arguments, -1 for the event name
+	value  string
+	prefix bool
+}
+
+func (c eventCondition) String() string {
+	field := "name"
+	if c.arg >= 0 {
+		field = "arg" + strconv.Itoa(c.arg)
+	}
+	value := c.value
+	if c.prefix {
+		value += "*"
+	}
+	return field + ":" + value
+}
+
+// eventFilter selects the events of the event channel a group of subscribers is interested in.
+// An event matches when it satisfies every condition of any of the alternatives.
+//
+// Subscriptions asking for the same filter share it, it is evaluated once per event and the
+// matching events are published under its key like any other channel.
+type eventFilter struct {
+	key          string
+	contract     string
+	alternatives [][]eventCondition
+	refs         int // Subscriptions using the filter, guarded by eventFiltersMutex
+}
+
+// Filters with at least one subscriber, by key
+var (
+	eventFilters      = map[string]*eventFilter{}
+	eventFiltersMutex sync.Mutex
+)
+
+// parseEventFilter builds a filter from the filter parameters of a subscription. Each one is
+// an alternative made of comma separated conditions, eg: "name:transfer,arg1:30074a2d88ba*".
+// Arguments are matched against the hex of the byte arrays as they are in the notification.
+func parseEventFilter(contract string, specs []string) (*eventFilter, error) {
+	if len(specs) > maxFilterAlternatives {
+		return nil, fmt.Errorf("at most %d filters can be combined", maxFilterAlternatives)
+	}
+	f := &eventFilter{contract: contract}
+	canonical := []string{}
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		alternative, err := parseFilterAlternative(spec)
+		if err != nil {
+			return nil, err
+		}
+		text := ""
+		for i, c := range alternative {
+			if i > 0 {
+				text += ","
+			}
+			text += c.String()
+		}
+		if seen[text] {
+			continue
+		}
+		seen[text] = true
+		canonical = append(canonical, text)
+		f.alternatives = append(f.alternatives, alternative)
+	}
+	sort.Strings(canonical)
+	f.key = "event?contract=" + contract + "&filter=" + strings.Join(canonical, "|")
+	return f, nil
+}
+
+func parseFilterAlternative(spec string) ([]eventCondition, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxFilterConditions {
+		return nil, fmt.Errorf("a filter can have at most %d conditions", maxFilterConditions)
+	}
+	conditions := []eventCondition{}
+	for _, part := range parts {
+		i := strings.Index(part, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid filter condition %q, expected field:value", part)
+		}
+		c := eventCondition{arg: -1, value: part[i+1:]}
+		switch field := part[:i]; {
+		case field == "name":
+		case strings.HasPrefix(field, "arg"):
+			n, err := strconv.Atoi(field[3:])
+			if err != nil || n < 0 || n >= maxFilterArgument {
+				return nil, fmt.Errorf("invalid filter field %q, arguments go from arg0 to arg%d", field, maxFilterArgument-1)
+			}
+			c.arg = n
+			c.value = strings.ToLower(c.value)
+		default:
+			return nil, fmt.Errorf("unknown filter field %q, use name or argN", field)
+		}
+		if strings.HasSuffix(c.value, "*") {
+			c.prefix = true
+			c.value = strings.TrimSuffix(c.value, "*")
+		}
+		if c.arg >= 0 && strings.HasPrefix(c.value, "0x") {
+			value, err := littleEndianHex(c.value, c.prefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter value %q: %v", part[i+1:], err)
+			}
+			c.value = value
+		}
+		conditions = append(conditions, c)
+	}
+	sort.Slice(conditions, func(i, j int) bool { return conditions[i].String() < conditions[j].String() })
+	return conditions, nil
+}
+
+// littleEndianHex converts a 0x prefixed big endian value, the way script hashes are usually
+// written, into the little endian hex of the byte arrays of the notifications
+func littleEndianHex(value string, prefix bool) (string, error) {
+	if prefix {
+		// The leading bytes of a big endian value are the trailing ones of its byte array
+		return "", fmt.Errorf("0x values can't be matched by prefix")
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(value, "0x"))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(neoutils.ReverseBytes(b)), nil
+}
+
+// eventView is an event decoded once so every filter can be checked against it
+type eventView struct {
+	contract string
+	name     string
+	args     []string
+	present  []bool
+}
+
+func newEventView(m EventMessage) eventView {
+	v := eventView{contract: m.Contract}
+	params, _ := m.Event.([]interface{})
+	for i, p := range params {
+		param, _ := p.(map[string]interface{})
+		value := ""
+		ok := false
+		if param != nil && param["value"] != nil {
+			// Arguments are compared ignoring case, byte arrays are hex
+			value, ok = strings.ToLower(fmt.Sprint(param["value"])), true
+		}
+		v.args = append(v.args, value)
+		v.present = append(v.present, ok)
+		if i == 0 {
+			v.name = eventName(param)
+		}
+	}
+	return v
+}
+
+// eventName is the first argument of a notification, a byte array holding its UTF-8 name
+func eventName(param map[string]interface{}) string {
+	value, _ := param["value"].(string)
+	if param["type"] != "ByteArray" {
+		return value
+	}
+	name, err := hex.DecodeString(value)
+	if err != nil || !utf8.Valid(name) {
+		return ""
+	}
+	return string(name)
+}
+
+func (c eventCondition) match(v eventView) bool {
+	value := v.name
+	if c.arg >= 0 {
+		if c.arg >= len(v.args) || !v.present[c.arg] {
+			return false
+		}
+		value = v.args[c.arg]
+	}
+	if c.prefix {
+		return strings.HasPrefix(value, c.value)
+	}
+	return value == c.value
+}
+
+func (f *eventFilter) match(v eventView) bool {
+	if f.contract != "" && f.contract != v.contract {
+		return false
+	}
+	if len(f.alternatives) == 0 {
+		return true
+	}
+	for _, alternative := range f.alternatives {
+		matched := true
+		for _, c := range alternative {
+			if !c.match(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// retain starts evaluating a filter, or counts one more user of it
+func (f *eventFilter) retain() {
+	eventFiltersMutex.Lock()
+	defer eventFiltersMutex.Unlock()
+	active, ok := eventFilters[f.key]
+	if !ok {
+		active = f
+		eventFilters[f.key] = f
+	}
+	active.refs++
+}
+
+// release stops evaluating a filter once its last subscription is gone
+func (f *eventFilter) release() {
+	eventFiltersMutex.Lock()
+	defer eventFiltersMutex.Unlock()
+	if active, ok := eventFilters[f.key]; ok {
+		active.refs--
+		if active.refs <= 0 {
+			delete(eventFilters, f.key)
+		}
+	}
+}
+
+// publishFilteredEvent publishes an event under the key of every active filter it matches
+func publishFilteredEvent(m EventMessage) {
+	eventFiltersMutex.Lock()
+	if len(eventFilters) == 0 {
+		eventFiltersMutex.Unlock()
+		return
+	}
+	filters := make([]*eventFilter, 0, len(eventFilters))
+	for _, f := range eventFilters {
+		filters = append(filters, f)
+	}
+	eventFiltersMutex.Unlock()
+
+	v := newEventView(m)
+	for _, f := range filters {
+		if f.match(v) {
+			sendMessage(f.key, m)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const transferHex = "7472616e73666572" // "transfer"
+
+func event(contract string, args ...string) EventMessage {
+	params := []interface{}{}
+	for _, arg := range args {
+		params = append(params, map[string]interface{}{"type": "ByteArray", "value": arg})
+	}
+	return EventMessage{Contract: contract, Event: params}
+}
+
+func TestParseEventFilter(t *testing.T) {
+	contract := "0xfb84b0950e8fd366af566b2911d6183e4b0367f7"
+	a, err := parseEventFilter(contract, []string{"arg1:ABCD*,name:transfer", "name:refund"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := parseEventFilter(contract, []string{"name:refund", "name:transfer,arg1:abcd*", "name:refund"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "event?contract=" + contract + "&filter=arg1:abcd*,name:transfer|name:refund"
+	if a.key != expected || b.key != expected {
+		t.Errorf("got %q and %q, expected %q", a.key, b.key, expected)
+	}
+
+	tests := map[string]string{
+		"transfer":       "expected field:value",
+		"value:transfer": "unknown filter field",
+		"argx:1":         "invalid filter field",
+		"arg64:1":        "invalid filter field",
+		"name:a," + strings.Repeat("arg0:1,", 16): "at most 16 conditions",
+		"arg1:0xf6db01d4*":                        "can't be matched by prefix",
+		"arg1:0xf6db01d4z":                        "invalid filter value",
+	}
+	for spec, message := range tests {
+		if _, err := parseEventFilter("", []string{spec}); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected %q, got %v", spec, message, err)
+		}
+	}
+	if _, err := parseEventFilter("", make([]string, 17)); err == nil {
+		t.Error("too many alternatives were accepted")
+	}
+}
+
+// Byte arrays are little endian in the notifications, 0x values are big endian like the script
+// hashes shown by explorers and converted
+func TestEventFilterByteOrder(t *testing.T) {
+	littleEndian, err := parseEventFilter("", []string{"name:transfer,arg1:30074a2d88bab26f74142c188231e92ad401dbf6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigEndian, err := parseEventFilter("", []string{"name:transfer,arg1:0xF6DB01D42AE93182182C14746FB2BA882D4A0730"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bigEndian.key != littleEndian.key {
+		t.Errorf("got %q, expected %q", bigEndian.key, littleEndian.key)
+	}
+	v := newEventView(mainnetTransfer())
+	if !bigEndian.match(v) || !littleEndian.match(v) {
+		t.Error("the sender of the transfer didn't match")
+	}
+	if f, _ := parseEventFilter("", []string{"arg1:f6db01d42ae93182182c14746fb2ba882d4a0730"}); f.match(v) {
+		t.Error("big endian hex without 0x matched the little endian byte array")
+	}
+	if f, _ := parseEventFilter("", []string{"arg3:0x00d09dc300"}); !f.match(v) {
+		t.Error("the amount didn't match")
+	}
+}
+
+func TestEventFilterMatch(t *testing.T) {
+	contract := "0xfb84b0950e8fd366af566b2911d6183e4b0367f7"
+	f, err := parseEventFilter(contract, []string{"name:transfer,arg1:ABCD*", "name:refund"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		event   EventMessage
+		matched bool
+	}{
+		{event(contract, transferHex, "abcdef", "00"), true},
+		{event(contract, transferHex, "ABCDEF", "00"), true},
+		{event(contract, transferHex, "abce", "abcd"), false},
+		{event(contract, transferHex), false},
+		{event(contract, "726566756e64"), true},
+		{event("0x0000000000000000000000000000000000000001", transferHex, "abcdef", "00"), false},
+		{event(contract, "ff"), false},
+	}
+	for _, test := range tests {
+		if matched := f.match(newEventView(test.event)); matched != test.matched {
+			t.Errorf("%+v: matched %v", test.event, matched)
+		}
+	}
+}
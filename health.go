@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+const (
+	defaultProviderGraceSeconds = 30
+	defaultBlockWindowSeconds   = 120
+)
+
+type ReadinessConfig struct {
+	ProviderGraceSeconds int `json:"providerGraceSeconds"` //how long the events provider may be disconnected
+	BlockWindowSeconds   int `json:"blockWindowSeconds"`   //how long we may go without receiving a block
+}
+
+// upstreamState tracks the connections the server gets its data from
+type upstreamState struct {
+	mu                sync.Mutex
+	startedAt         time.Time
+	p2pPeers          map[string]network.Version // NEO nodes connected to, with the version they sent
+	providerConnected bool
+	providerChangedAt time.Time
+	lastBlockAt       time.Time
+}
+
+var upstream = &upstreamState{startedAt: time.Now(), providerChangedAt: time.Now(), p2pPeers: map[string]network.Version{}}
+
+func (u *upstreamState) setP2P(connected bool, peer string, v network.Version) {
+	u.mu.Lock()
+	if connected {
+		u.p2pPeers[peer] = v
+	} else {
+		delete(u.p2pPeers, peer)
+	}
+	u.mu.Unlock()
+}
+
+func (u *upstreamState) setProvider(connected bool) {
+	u.mu.Lock()
+	if u.providerConnected != connected {
+		u.providerConnected = connected
+		u.providerChangedAt = time.Now()
+	}
+	u.mu.Unlock()
+}
+
+func (u *upstreamState) blockReceived() {
+	u.mu.Lock()
+	u.lastBlockAt = time.Now()
+	u.mu.Unlock()
+}
+
+type componentStatus struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type readiness struct {
+	Ready      bool                       `json:"ready"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+func (u *upstreamState) readiness(config *ReadinessConfig, now time.Time) readiness {
+	grace := time.Duration(defaultProviderGraceSeconds) * time.Second
+	window := time.Duration(defaultBlockWindowSeconds) * time.Second
+	if config != nil && config.ProviderGraceSeconds > 0 {
+		grace = time.Duration(config.ProviderGraceSeconds) * time.Second
+	}
+	if config != nil && config.BlockWindowSeconds > 0 {
+		window = time.Duration(config.BlockWindowSeconds) * time.Second
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r := readiness{Ready: true, Components: map[string]componentStatus{}}
+	set := func(name string, ok bool, detail string) {
+		r.Components[name] = componentStatus{ok, detail}
+		r.Ready = r.Ready && ok
+	}
+
+	if len(u.p2pPeers) > 0 {
+		peers := []string{}
+		for peer, v := range u.p2pPeers {
+			peers = append(peers, fmt.Sprintf("%s (%s at height %d)", peer, v.UserAgent, v.StartHeight))
+		}
+		sort.Strings(peers)
+		set("p2p", true, "connected to "+strings.Join(peers, ", "))
+	} else {
+		set("p2p", false, "not connected to any NEO node")
+	}
+
+	since := now.Sub(u.providerChangedAt).Round(time.Second)
+	if u.providerConnected {
+		set("eventsProvider", true, fmt.Sprintf("connected for %v", since))
+	} else {
+		set("eventsProvider", since <= grace, fmt.Sprintf("disconnected for %v", since))
+	}
+
+	last := u.lastBlockAt
+	if last.IsZero() {
+		last = u.startedAt
+	}
+	age := now.Sub(last).Round(time.Second)
+	if u.lastBlockAt.IsZero() {
+		set("blocks", age <= window, fmt.Sprintf("no block received since start %v ago", age))
+	} else {
+		set("blocks", age <= window, fmt.Sprintf("last block received %v ago", age))
+	}
+	return r
+}
+
+// Serves /healthz, the process is up and answering requests
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Serves /readyz, fails with 503 when an upstream component is unhealthy
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := upstream.readiness(getConfig().Readiness, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(status)
+}
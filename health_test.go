@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+func TestReadiness(t *testing.T) {
+	start := time.Date(2020, 3, 19, 12, 0, 0, 0, time.UTC)
+	node := network.Version{UserAgent: "/Neo:2.10.3/", StartHeight: 5249790}
+	tests := []struct {
+		name     string
+		state    *upstreamState
+		config   *ReadinessConfig
+		now      time.Time
+		ready    bool
+		failing  string
+		detailed string
+	}{
+		{
+			name:    "starting",
+			state:   &upstreamState{startedAt: start, providerChangedAt: start},
+			now:     start.Add(10 * time.Second),
+			failing: "p2p",
+		},
+		{
+			name:     "healthy",
+			state:    &upstreamState{startedAt: start, providerChangedAt: start, providerConnected: true, lastBlockAt: start.Add(time.Minute), p2pPeers: map[string]network.Version{"seed1:10333": node}},
+			now:      start.Add(2 * time.Minute),
+			ready:    true,
+			detailed: "seed1:10333 (/Neo:2.10.3/ at height 5249790)",
+		},
+		{
+			name:     "provider down for too long",
+			state:    &upstreamState{startedAt: start, providerChangedAt: start, lastBlockAt: start, p2pPeers: map[string]network.Version{"seed1:10333": node}},
+			now:      start.Add(31 * time.Second),
+			failing:  "eventsProvider",
+			detailed: "disconnected for 31s",
+		},
+		{
+			name:   "provider down within the grace period",
+			state:  &upstreamState{startedAt: start, providerChangedAt: start, lastBlockAt: start, p2pPeers: map[string]network.Version{"seed1:10333": node}},
+			config: &ReadinessConfig{ProviderGraceSeconds: 60},
+			now:    start.Add(31 * time.Second),
+			ready:  true,
+		},
+		{
+			name:     "no block",
+			state:    &upstreamState{startedAt: start, providerChangedAt: start, providerConnected: true, p2pPeers: map[string]network.Version{"seed1:10333": node}},
+			config:   &ReadinessConfig{BlockWindowSeconds: 60},
+			now:      start.Add(61 * time.Second),
+			failing:  "blocks",
+			detailed: "no block received since start 1m1s ago",
+		},
+		{
+			name:     "stale blocks",
+			state:    &upstreamState{startedAt: start, providerChangedAt: start, providerConnected: true, lastBlockAt: start, p2pPeers: map[string]network.Version{"seed1:10333": node}},
+			now:      start.Add(3 * time.Minute),
+			failing:  "blocks",
+			detailed: "last block received 3m0s ago",
+		},
+	}
+	for _, test := range tests {
+		r := test.state.readiness(test.config, test.now)
+		if r.Ready != test.ready {
+			t.Errorf("%s: ready is %v", test.name, r.Ready)
+		}
+		for name, status := range r.Components {
+			if status.OK != (name != test.failing) {
+				t.Errorf("%s: unexpected status of %s %+v", test.name, name, status)
+			}
+		}
+		if test.detailed == "" {
+			continue
+		}
+		found := false
+		for _, status := range r.Components {
+			found = found || strings.Contains(status.Detail, test.detailed)
+		}
+		if !found {
+			t.Errorf("%s: no component says %q: %+v", test.name, test.detailed, r.Components)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/eventlog"
+)
+
+const maxHistoryLimit = 1000
+
+// Where the history of every channel is persisted, nil when disabled in the config
+var history *eventlog.Log
+
+type HistoryConfig struct {
+	Dir          string `json:"dir"`
+	SegmentBytes int64  `json:"segmentBytes"`
+	MaxBytes     int64  `json:"maxBytes"`    //0 means no size limit
+	MaxAgeHours  int    `json:"maxAgeHours"` //0 means no age limit
+}
+
+type historyItem struct {
+	Block int64           `json:"block"`
+	Time  int64           `json:"time"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type historyPage struct {
+	Items  []historyItem `json:"items"`
+	Cursor string        `json:"cursor,omitempty"` // Pass it back to get the next page
+}
+
+func openHistory(config *HistoryConfig) error {
+	if config == nil || config.Dir == "" {
+		return nil
+	}
+	l, err := eventlog.Open(config.Dir, eventlog.Options{
+		SegmentSize: config.SegmentBytes,
+		MaxBytes:    config.MaxBytes,
+		MaxAge:      time.Duration(config.MaxAgeHours) * time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+	history = l
+
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			if err := l.Compact(); err != nil {
+				log.Printf("history compaction failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// recordHistory appends a published message to the event log, key is the contract for events
+func recordHistory(channel string, key string, message WebSocketMessage) {
+	if history == nil {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	err = history.Append(eventlog.Record{
+		Channel: channel,
+		Key:     key,
+		Block:   atomic.LoadInt64(&lastBlockIndex),
+		Data:    data,
+	})
+	if err != nil {
+		log.Printf("can't record %s in history: %v", channel, err)
+	}
+}
+
+// Serves GET /history/<channel>?contract=&fromBlock=&toBlock=&limit=&cursor=
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		http.Error(w, "History is not enabled on this server", 404)
+		return
+	}
+	channel := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/history/"), "/")
+	if _, err := resolveChannel(channel, nil); err != nil {
+		http.Error(w, "This endpoint is not available", 404)
+		return
+	}
+
+	query := r.URL.Query()
+	q := eventlog.Query{
+		Channel: channel,
+		Key:     query.Get("contract"),
+		ToBlock: -1,
+		Limit:   eventlog.DefaultQueryLimit,
+		Cursor:  query.Get("cursor"),
+	}
+	var err error
+	if v := query.Get("fromBlock"); v != "" {
+		if q.FromBlock, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid fromBlock parameter", 400)
+			return
+		}
+	}
+	if v := query.Get("toBlock"); v != "" {
+		if q.ToBlock, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid toBlock parameter", 400)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxHistoryLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit), 400)
+			return
+		}
+	}
+
+	records, cursor, err := history.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	page := historyPage{Items: make([]historyItem, len(records)), Cursor: cursor}
+	for i, rec := range records {
+		page.Items[i] = historyItem{Block: rec.Block, Time: rec.Time, Data: rec.Data}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -5,19 +5,23 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/corollari/neo-ws-pub-sub/neotx"
 	"github.com/corollari/neo-ws-pub-sub/neotx/network"
 
+	"github.com/corollari/neo-ws-pub-sub/metrics"
 	"github.com/corollari/neo-ws-pub-sub/neoutils"
 	"github.com/corollari/neo-ws-pub-sub/neorpc"
 )
@@ -44,11 +48,6 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-var (
-	subscriptions      = map[string][]chan WebSocketMessage{}
-	subscriptionsMutex sync.Mutex
-)
-
 var (
 	connected int64
 	failed    int64
@@ -71,64 +70,126 @@ type Configuration struct {
 	Nodes      []NodeAddresses `json:"nodes"`
 	WebsocketEventsProvider   string `json:"websocketEventsProvider"`
 	Magic         int      `json:"magic"` //network ID.
+	Port int `json:"port"`
+	SubscriberQueueSize int `json:"subscriberQueueSize"` //messages buffered per connection
+	OverflowPolicy string `json:"overflowPolicy"` //dropOldest | dropNewest | disconnect
+	ReplayBufferSize int `json:"replayBufferSize"` //messages kept per channel for resuming clients
+	History *HistoryConfig `json:"history"` //on-disk event log, disabled when missing
+	Webhooks *WebhooksConfig `json:"webhooks"`
+	AdminToken string `json:"adminToken"` //bearer token for the /admin endpoints, disabled when empty
+	Readiness *ReadinessConfig `json:"readiness"`
+	Shutdown *ShutdownConfig `json:"shutdown"`
+	TxTracking *TxTrackingConfig `json:"txTracking"`
+	P2P *P2PConfig `json:"p2p"` //connections to the NEO nodes, changes need a restart
 }
 
-func loadConfigurationFile(file string) (Configuration, error) {
-	configuration := Configuration{}
-	configFile, err := os.Open(file)
-	defer configFile.Close()
-	if err != nil {
-		return configuration, err
-	}
-	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&configuration)
-	return configuration, nil
-}
+var (
+	configMutex   sync.RWMutex
+	currentConfig Configuration
+)
 
-var currentConfig Configuration
+// getConfig returns the configuration in use, it is replaced when the config is reloaded
+func getConfig() Configuration {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return currentConfig
+}
 
 //Base on the article 10M Concurrent websocket on https://goroutines.com/10m
 func main() {
 	mode := flag.String("network", "main", "Network to connect to. main | test")
-	portInt := flag.Int("port", 8080, "Port to bind to")
+	flag.StringVar(&configFile, "config", "", "Path of the config file, defaults to the one of the network")
+	flag.IntVar(&portFlag, "port", 0, "Port to bind to, overrides the port of the config (8080 by default)")
+	printStats := flag.Bool("stats", false, "Print connection stats to stdout every second")
 	flag.Parse()
 
-	var file string
-	if *mode == "main" {
-		file = "config.json"
-	} else if *mode == "test" {
-		file = "config.testnet.json"
+	networkSet := false
+	flag.Visit(func(f *flag.Flag) { networkSet = networkSet || f.Name == "network" })
+	if _, ok := networkConfigFiles[*mode]; !ok {
+		fmt.Printf("Unknown network %q, use main or test\n", *mode)
+		os.Exit(2)
+	}
+	// An explicit config file is only checked against the network when one was asked for
+	if configFile == "" || networkSet {
+		configNetwork = *mode
+	}
+	if configFile == "" {
+		configFile = networkConfigFiles[*mode]
 	}
 
-	fmt.Printf("Loading config file:%v\n", file)
+	fmt.Printf("Loading config file:%v\n", configFile)
 
-	config, err := loadConfigurationFile(file)
+	config, err := readConfiguration()
 
 	if err != nil {
-		fmt.Printf("Error loading config file: %v", err)
-		return
+		fmt.Printf("Error loading config file: %v\n", err)
+		os.Exit(1)
 	}
 	//assign the current configuration to global
+	configMutex.Lock()
 	currentConfig = config
+	configMutex.Unlock()
+	rand.Seed(time.Now().UnixNano())
 
-	go func() {
-		start := time.Now()
-		for {
-			fmt.Printf("server elapsed=%0.0fs connected=%d failed=%d\n", time.Now().Sub(start).Seconds(), atomic.LoadInt64(&connected), atomic.LoadInt64(&failed))
-			time.Sleep(1 * time.Second)
-		}
-	}()
+	if err := openHistory(config.History); err != nil {
+		fmt.Printf("Error opening history: %v\n", err)
+		os.Exit(1)
+	}
+	if err := startWebhooks(config.Webhooks); err != nil {
+		fmt.Printf("Error loading webhooks: %v\n", err)
+		os.Exit(1)
+	}
 
+	if *printStats {
+		go func() {
+			start := time.Now()
+			for {
+				fmt.Printf("server elapsed=%0.0fs connected=%d failed=%d\n", time.Now().Sub(start).Seconds(), atomic.LoadInt64(&connected), atomic.LoadInt64(&failed))
+				time.Sleep(1 * time.Second)
+			}
+		}()
+	}
+
+	http.Handle("/metrics", metrics.Default.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/history/", handleHistory)
+	http.HandleFunc("/sse/", handleSSE)
+	http.Handle("/admin/reload", requireAdmin(http.HandlerFunc(handleReload)))
+	http.Handle("/admin/webhooks/", requireAdmin(http.StripPrefix("/admin/webhooks", webhooks.Handler())))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		channel := r.URL.Path[1:]
-        if channel[len(channel)-1] == '/' {
-            channel = channel[:len(channel)-1] // Remove trailing slash
-        }
-		contract := r.URL.Query().Get("contract")
+		channel := strings.TrimSuffix(r.URL.Path[1:], "/") // Remove trailing slash
+
+		if isClosing() {
+			http.Error(w, "The server is shutting down", 503)
+			return
+		}
+
+		// The root endpoint is multiplexed, the channels are chosen through subscribe commands
+		if channel == "" {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			go handleMultiplexedConnection(ws)
+			return
+		}
 
 		// Close connection if endpoint is not one of the accepted ones
-		if channel != "event" && channel != "ping" && channel != "mempool/tx" && channel != "block" {
-			http.Error(w, "This endpoint is not available", 404)
+		if channel != "ping" {
+			if _, err := resolveChannel(channel, r.URL.Query()); err != nil {
+				if _, unknown := err.(unknownChannelError); unknown {
+					http.Error(w, "This endpoint is not available", 404)
+				} else {
+					http.Error(w, err.Error(), 400)
+				}
+				return
+			}
+		}
+
+		from, err := parseCursor(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
 			return
 		}
 
@@ -140,22 +201,36 @@ func main() {
 
 		// launch a new goroutine so that this function can return and the http server can free up
 		// buffers associated with this connection
-		if contract != "" && channel == "event" {
-			go handleConnection(ws, contract)
-		} else if channel == "ping" {
+		if channel == "ping" {
 			go handlePingConnection(ws)
 		} else {
-			go handleConnection(ws, channel)
+			go handleConnection(ws, channel, r.URL.Query(), from)
 		}
 	})
 
-	go startConnectToSeed(config, 0)
+	go decodeTransfers()
+	go startPeers(config)
 	go relayEvents(config.WebsocketEventsProvider)
 
-	port := fmt.Sprintf(":%d", *portInt)
-	fmt.Printf("Websocket running at port %v\n", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatal(err)
+	port := fmt.Sprintf(":%d", config.Port)
+	server := &http.Server{Addr: port}
+	go func() {
+		fmt.Printf("Websocket running at port %v\n", port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reloadConfiguration()
+			continue
+		}
+		log.Printf("received %v, shutting down", sig)
+		shutdown(server)
+		return
 	}
 }
 
@@ -163,6 +238,7 @@ func main() {
 // TODO: Add deadlines for pings in order to prevent connections being left open?
 func handlePingConnection(ws *websocket.Conn) {
 	defer ws.Close()
+	defer trackPing(ws)()
 	for {
 		_, message, err := ws.ReadMessage()
 		if err != nil {
@@ -179,73 +255,36 @@ func handlePingConnection(ws *websocket.Conn) {
 
 //Handle websocket connection
 //Available channels are block, event and mempool/tx.
-func handleConnection(ws *websocket.Conn, channel string) {
-	sub := subscribe(channel)
-	atomic.AddInt64(&connected, 1)
-	t := time.NewTicker(clientPingPeriod)
-
-	var message WebSocketMessage
-	var ping bool
-
-	for {
-		select {
-		case <-t.C:
-			ping = true
-		case message = <-sub:
-			ping = false
-		}
-
-		ws.SetWriteDeadline(time.Now().Add(30 * time.Second))
-		var err error
-		if ping == true {
-			err = ws.WriteMessage(websocket.PingMessage, nil)
-		} else {
-			err = ws.WriteJSON(message)
-		}
-		if err != nil {
-			break
-		}
+func handleConnection(ws *websocket.Conn, channel string, params url.Values, from *cursor) {
+	c := newClient(ws, false)
+	c.meta = params.Get("meta") == "true"
+	if _, err := c.subscribe(channel, params, from, nil); err != nil {
+		message := websocket.FormatCloseMessage(closeBadCursor, err.Error())
+		ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+		ws.Close()
+		return
 	}
-	atomic.AddInt64(&connected, -1)
-	atomic.AddInt64(&failed, 1)
-
-	t.Stop()
-	ws.Close()
-	unsubscribe(channel, sub)
-}
-
-func subscribe(channel string) chan WebSocketMessage {
-	sub := make(chan WebSocketMessage)
-	subscriptionsMutex.Lock()
-	subscriptions[channel] = append(subscriptions[channel], sub)
-	subscriptionsMutex.Unlock()
-	return sub
+	c.writeLoop()
 }
 
-func unsubscribe(channel string, sub chan WebSocketMessage) {
-	subscriptionsMutex.Lock()
-	newSubs := []chan WebSocketMessage{}
-	subs := subscriptions[channel]
-	for _, s := range subs {
-		if s != sub {
-			newSubs = append(newSubs, s)
+// parseCursor reads the since and fromBlock query parameters used to resume a stream
+func parseCursor(r *http.Request) (*cursor, error) {
+	from := &cursor{}
+	if since := r.URL.Query().Get("since"); since != "" {
+		seq, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since parameter: %v", since)
 		}
+		from.since = &seq
 	}
-	subscriptions[channel] = newSubs
-	subscriptionsMutex.Unlock()
-}
-
-func sendMessage(channel string, message WebSocketMessage) {
-	subscriptionsMutex.Lock()
-	subs := subscriptions[channel]
-	subscriptionsMutex.Unlock()
-	for _, s := range subs {
-		select {
-		case s <- message:
-		default:
-			// drop the message if nobody is ready to receive it
+	if fromBlock := r.URL.Query().Get("fromBlock"); fromBlock != "" {
+		index, err := strconv.ParseInt(fromBlock, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fromBlock parameter: %v", fromBlock)
 		}
+		from.fromBlock = &index
 	}
+	return from, nil
 }
 
 // Adapted from https://github.com/gorilla/websocket/blob/master/examples/echo/client.go
@@ -255,16 +294,40 @@ func relayEvents(WebsocketEventsProvider string) {
 
 	c, _, err := websocket.DefaultDialer.Dial(WebsocketEventsProvider, nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		log.Println("dial:", err)
+		upstream.setProvider(false)
+		select {
+		case <-closing:
+		case <-time.After(10 * time.Second):
+			go relayEvents(getConfig().WebsocketEventsProvider)
+		}
+		return
 	}
 	defer c.Close()
+	if !setRelayConn(c) {
+		return
+	}
+	upstream.setProvider(true)
 
 	// Restart connection when lost
 	defer func() {
+		upstream.setProvider(false)
+		if isClosing() {
+			return
+		}
+		// A reload changed the provider, switch to it right away
+		if provider := getConfig().WebsocketEventsProvider; provider != WebsocketEventsProvider {
+			go relayEvents(provider)
+			return
+		}
 		log.Printf("connection to %s lost, reconnecting...", WebsocketEventsProvider)
+		relayReconnects.Inc()
 		// TODO: Set up exponential back-off system
-		time.Sleep(10 * time.Second)
-		go relayEvents(WebsocketEventsProvider)
+		select {
+		case <-closing:
+		case <-time.After(10 * time.Second):
+			go relayEvents(getConfig().WebsocketEventsProvider)
+		}
 	}()
 
 	done := make(chan struct{})
@@ -279,7 +342,10 @@ func relayEvents(WebsocketEventsProvider string) {
 				return
 			}
 
-			go broadcastMessage(message)
+			// Kept in order so sequence numbers and block indexes follow the chain
+			if err := broadcastMessage(message); err != nil {
+				log.Printf("skipping message from the events provider: %v", err)
+			}
 		}
 	}()
 
@@ -304,30 +370,73 @@ func relayEvents(WebsocketEventsProvider string) {
 	}
 }
 
-func broadcastMessage(message []byte) {
+// broadcastMessage publishes a message of the events provider, messages that don't
+// have the expected shape are rejected without publishing anything.
+func broadcastMessage(message []byte) error {
 	var decodedMessage map[string]interface{}
 	if err := json.Unmarshal(message, &decodedMessage); err != nil {
-        panic(err)
-    }
+		return err
+	}
 
-    msgType := decodedMessage["type"].(string)
-    msgPayload := decodedMessage["data"].(map[string]interface{})
+    msgType, _ := decodedMessage["type"].(string)
+    msgPayload, ok := decodedMessage["data"].(map[string]interface{})
+    if !ok {
+        return fmt.Errorf("%q message without data", msgType)
+    }
 
     if msgType == "events" {
-        contract := msgPayload["contract"].(string)
+        contract, ok := msgPayload["contract"].(string)
+        if !ok {
+            return fmt.Errorf("event without contract")
+        }
+        txid, ok := msgPayload["txid"].(string)
+        if !ok {
+            return fmt.Errorf("event of %s without txid", contract)
+        }
+        call, ok := msgPayload["call"].(map[string]interface{})
+        if !ok {
+            return fmt.Errorf("event %s without call", txid)
+        }
         log.Printf("received event on %s", contract)
 
         m := EventMessage {
-            msgPayload["txid"].(string),
+            txid,
             contract,
-            msgPayload["call"].(map[string]interface{})["value"],
+            call["value"],
         }
 
         sendMessage("event", m)
         sendMessage(contract, m)
+        publishFilteredEvent(m)
+        trackTxEvent(m)
+        queueTransfer(m)
+        recordHistory("event", contract, m)
     } else if msgType == "blocks" {
-        sendMessage("block", msgPayload)
+        publishBlock(msgPayload)
     }
+    return nil
+}
+
+// Blocks come from the events provider and from the P2P network, they are published one at a time
+var publishBlockMutex sync.Mutex
+
+// publishBlock publishes a block the first time one of the sources delivers it, blocks that
+// aren't above the last one published are dropped.
+func publishBlock(block map[string]interface{}) {
+	index, ok := block["index"].(float64)
+	publishBlockMutex.Lock()
+	defer publishBlockMutex.Unlock()
+	if ok && int64(index) <= atomic.LoadInt64(&lastBlockIndex) {
+		return
+	}
+	upstream.blockReceived()
+	if ok {
+		atomic.StoreInt64(&lastBlockIndex, int64(index))
+	}
+	sendMessage("block", block)
+	publishBlockActivity(block)
+	trackTxBlock(block)
+	recordHistory("block", "", block)
 }
 
 func getBestNode(list []string) *neoutils.SeedNodeResponse {
@@ -335,80 +444,171 @@ func getBestNode(list []string) *neoutils.SeedNodeResponse {
 	return neoutils.SelectBestSeedNode(commaSeparated)
 }
 
-var connectedToNEONode = false
-
 //this is NEO part
-func startConnectToSeed(config Configuration, iteration int) {
-	node := config.Nodes[iteration]
-	host, port, err := net.SplitHostPort(node.P2P)
-	if err != nil {
-		fmt.Printf("%v", err)
-		os.Exit(-1)
+func startPeers(config Configuration) {
+	neoHandler.addNodes(config.Nodes)
+	maxPeers, seenTTL := p2pSettings(config)
+	framing, maxViolations := framingPolicy(config)
+	handshakeTimeout, idleTimeout := p2pTimeouts(config)
+	var book *neotx.AddressBook
+	if discovery(config) {
+		var err error
+		if book, err = neotx.NewAddressBook(config.P2P.AddressBook, 0); err != nil {
+			fmt.Printf("can't load the address book: %v\n", err)
+			os.Exit(-1)
+		}
 	}
-	portInt, err := strconv.Atoi(port)
+	peers, err := neotx.NewPeerManager(neotx.PeerManagerConfig{
+		Network:           network.NEONetworkMagic(config.Magic),
+		Peers:             p2pAddresses(config.Nodes),
+		MaxPeers:          maxPeers,
+		SeenTTL:           seenTTL,
+		FetchTransactions: true,
+		FetchBlocks:       true,
+		FetchConsensus:    true,
+		AddressBook:       book,
+		Framing:           framing,
+		MaxViolations:     maxViolations,
+		HandshakeTimeout:  handshakeTimeout,
+		IdleTimeout:       idleTimeout,
+	}, neoHandler)
 	if err != nil {
-		fmt.Printf("%v", err)
+		fmt.Printf("%v\n", err)
 		os.Exit(-1)
 	}
-	var neoNodeConfig = neotx.Config{
-		Network:   network.NEONetworkMagic(config.Magic),
-		Port:      uint16(portInt),
-		IPAddress: host,
+	if !setPeerManager(peers) {
+		return
+	}
+	if book != nil {
+		fmt.Printf("connecting to %d of %d nodes and %d discovered ones...\n", maxPeers, len(config.Nodes), book.Len())
+	} else {
+		fmt.Printf("connecting to %d of %d nodes...\n", maxPeers, len(config.Nodes))
 	}
-	client := neotx.NewClient(neoNodeConfig)
-	handler := &NEOConnectionHandler{}
-	handler.config = config
-	handler.nodeNumber = iteration
+	peers.Start()
+}
 
-	client.SetDelegate(handler)
+type NEOConnectionHandler struct {
+	mu sync.Mutex
+	nodes map[string]NodeAddresses //by p2p address, kept even if a reload removes them from the node list
+	defaultRPC string //for the discovered nodes, whose RPC endpoint isn't known
+}
 
-	fmt.Printf("connecting to %v:%v...\n", neoNodeConfig.IPAddress, neoNodeConfig.Port)
-	err = client.Start()
-	if err != nil {
-		if iteration < len(config.Nodes){
-			go startConnectToSeed(config, iteration + 1)
-		} else {
-			fmt.Printf("%v", err)
-			os.Exit(-1)
-		}
+var neoHandler = &NEOConnectionHandler{nodes: map[string]NodeAddresses{}}
+
+func (h *NEOConnectionHandler) addNodes(nodes []NodeAddresses) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, node := range nodes {
+		h.nodes[node.P2P] = node
+	}
+	if len(nodes) > 0 {
+		h.defaultRPC = nodes[0].RPC
 	}
 }
 
-type NEOConnectionHandler struct {
-	config Configuration
-	nodeNumber int
+func (h *NEOConnectionHandler) rpcNode(peer string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if node, ok := h.nodes[peer]; ok {
+		return node.RPC
+	}
+	return h.defaultRPC
+}
+
+// peerLabel is the label of a node in the P2P metrics, the configured nodes get their own and the
+// discovered ones share "discovered" so the number of series stays bounded.
+func (h *NEOConnectionHandler) peerLabel(peer string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.nodes[peer]; ok {
+		return peer
+	}
+	return "discovered"
 }
 
 //implement the message protocol
 func (h *NEOConnectionHandler) OnReceive(tx neotx.TX) {
 
 	if tx.Type == network.InventotyTypeTX {
-		//Call getrawtransaction to get the transaction detail by txid
+		// The transaction itself is fetched by the peer manager and arrives on OnTransaction
+		p2pFirstAnnouncements.With(h.peerLabel(tx.Peer)).Inc()
+		trackTxSeen(tx.ID)
+		return
+	}
+	// Blocks and consensus payloads are fetched like transactions
+}
 
-		rpcNode := h.config.Nodes[h.nodeNumber].RPC //Has to communicate with the same node that it got the transaction from, otherwise another node might not know about the tx
+func (h *NEOConnectionHandler) OnTransaction(peer string, t *network.Transaction) {
+	m := transactionResult(t)
+	publishMempoolTx(m, h.rpcNode(peer))
+}
 
-		client := neorpc.NewClient(rpcNode)
-		raw := client.GetRawTransaction(tx.ID)
+func (h *NEOConnectionHandler) OnBlock(peer string, b *network.Block) {
+	publishBlock(blockPayload(blockResult(b)))
+}
 
-		if raw.ErrorResponse != nil {
-			return
-		}
+// blockPayload gives a block the form of the ones received from the events provider
+func blockPayload(block neorpc.GetBlockResult) map[string]interface{} {
+	raw, _ := json.Marshal(block)
+	var payload map[string]interface{}
+	json.Unmarshal(raw, &payload)
+	return payload
+}
 
-		m := raw.Result
+func (h *NEOConnectionHandler) OnConsensus(peer string, p *network.ConsensusPayload) {
+	sendMessage("consensus", consensusMessage(p))
+}
 
-		fmt.Printf(" %v: %+v", tx.ID, raw.Result.Type)
-		sendMessage("mempool/tx", m)
+func (h *NEOConnectionHandler) OnFetchFailed(tx neotx.TX) {
+	if tx.Type == network.InventotyTypeConsensus {
+		// Consensus payloads are only relayed while their block is being agreed on
 		return
 	}
-	// The remaining type of inv message are consensus and block, we ignore them
+	if !rpcFallback() {
+		log.Printf("%v %v announced by %v couldn't be fetched", tx.Type, tx.ID, tx.Peer)
+		return
+	}
+
+	rpcNode := h.rpcNode(tx.Peer) //Has to communicate with the same node that it got the inventory from, otherwise another node might not know about it
+
+	client := neorpc.NewClient(rpcNode)
+	if tx.Type == network.InventotyTypeBlock {
+		block := client.GetBlock(tx.ID)
+		if block.ErrorResponse == nil && block.Result.Hash != "" {
+			publishBlock(blockPayload(block.Result))
+		}
+		return
+	}
+	//Call getrawtransaction to get the transaction detail by txid
+	raw := client.GetRawTransaction(tx.ID)
+
+	if raw.ErrorResponse != nil || raw.Result.Txid == "" {
+		return
+	}
+
+	m := raw.Result
+
+	publishMempoolTx(m, rpcNode)
+}
+
+func publishMempoolTx(m neorpc.GetRawTransactionResult, rpcNode string) {
+	sendMessage("mempool/tx", m)
+	publishFilteredMempoolTx(m)
+	recordHistory("mempool/tx", "", m)
+	publishMempoolActivity(m, rpcNode)
+}
+
+func (h *NEOConnectionHandler) OnConnected(peer string, c network.Version) {
+	fmt.Printf("connected to %v %+v\n", peer, c)
+	upstream.setP2P(true, peer, c)
 }
 
-func (h *NEOConnectionHandler) OnConnected(c network.Version) {
-	fmt.Printf("connected %+v\n", c)
-	connectedToNEONode = true
+func (h *NEOConnectionHandler) OnViolation(peer string, e *network.MessageError) {
+	p2pViolations.With(h.peerLabel(peer), e.Kind.String()).Inc()
 }
 
-func (h *NEOConnectionHandler) OnError(e error) {
-	fmt.Printf("Disconnected from host. Trying to connect to a different host...")
-	go startConnectToSeed(currentConfig, (h.nodeNumber + 1) % len(h.config.Nodes))
+func (h *NEOConnectionHandler) OnDisconnected(peer string, e error) {
+	fmt.Printf("Disconnected from %v: %v. Trying to connect to a different host...\n", peer, e)
+	upstream.setP2P(false, peer, network.Version{})
+	p2pReconnects.Inc()
 }
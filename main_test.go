@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	currentConfig = defaultConfiguration()
+	os.Exit(m.Run())
+}
+
+// setConfig changes the configuration for a test, the returned function restores it
+func setConfig(change func(*Configuration)) func() {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	previous := currentConfig
+	change(&currentConfig)
+	return func() {
+		configMutex.Lock()
+		currentConfig = previous
+		configMutex.Unlock()
+	}
+}
+
+func TestBroadcastMessageRejectsMalformedMessages(t *testing.T) {
+	for _, message := range []string{
+		`not json`,
+		`{"type":"events"}`,
+		`{"type":"events","data":{"txid":"0x01","call":{"value":[]}}}`,
+		`{"type":"events","data":{"contract":"0x01","call":{"value":[]}}}`,
+		`{"type":"events","data":{"txid":"0x01","contract":"0x01","call":"transfer"}}`,
+		`{"type":"blocks","data":[]}`,
+	} {
+		if err := broadcastMessage([]byte(message)); err == nil {
+			t.Errorf("%s was accepted", message)
+		}
+	}
+}
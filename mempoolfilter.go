@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+)
+
+// Hashes of the native assets, they can be given by name in the asset parameter
+var assetAliases = map[string]string{
+	"neo": "0xc56f33fc6ecfcd0c225c4ab356fee59390af8560be0e930faebe74a6daff7c9b",
+	"gas": "0x602c79718b16e442de58778e148d0b1084e3b2dffd5de6b7b16cee7969282de7",
+}
+
+var transactionTypes = []string{
+	"MinerTransaction",
+	"IssueTransaction",
+	"ClaimTransaction",
+	"EnrollmentTransaction",
+	"RegisterTransaction",
+	"ContractTransaction",
+	"StateTransaction",
+	"PublishTransaction",
+	"InvocationTransaction",
+}
+
+// Query parameters understood by mempool/tx, values of the same parameter are alternatives
+var mempoolFilterParams = []string{"type", "asset", "address", "minValue", "attribute"}
+
+// mempoolFilter selects the transactions of the mempool/tx channel a group of subscribers is
+// interested in. A transaction matches when its type and one of its attributes are among the
+// requested ones and a single output satisfies the asset, address and minValue conditions.
+//
+// Like event filters, subscriptions asking for the same filter share it and it is evaluated once
+// per transaction.
+type mempoolFilter struct {
+	key        string
+	types      map[string]bool
+	assets     map[string]bool
+	addresses  map[string]bool
+	attributes map[string]bool
+	minValue   *big.Rat
+	refs       int // Subscriptions using the filter, guarded by mempoolFiltersMutex
+}
+
+// Filters with at least one subscriber, by key
+var (
+	mempoolFilters      = map[string]*mempoolFilter{}
+	mempoolFiltersMutex sync.Mutex
+)
+
+func hasMempoolFilter(params url.Values) bool {
+	for _, name := range mempoolFilterParams {
+		if _, ok := params[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMempoolFilter builds a filter from the query parameters of a subscription,
+// eg: type=ContractTransaction&asset=neo&minValue=100
+func parseMempoolFilter(params url.Values) (*mempoolFilter, error) {
+	f := &mempoolFilter{}
+	canonical := url.Values{}
+	var err error
+	if f.types, err = filterSet(params["type"], canonical, "type", canonicalTransactionType); err != nil {
+		return nil, err
+	}
+	if f.assets, err = filterSet(params["asset"], canonical, "asset", canonicalAsset); err != nil {
+		return nil, err
+	}
+	if f.addresses, err = filterSet(params["address"], canonical, "address", func(address string) (string, error) {
+		if !validAddress(address) {
+			return "", fmt.Errorf("invalid NEO address %q", address)
+		}
+		return address, nil
+	}); err != nil {
+		return nil, err
+	}
+	if f.attributes, err = filterSet(params["attribute"], canonical, "attribute", func(usage string) (string, error) {
+		if usage == "" {
+			return "", fmt.Errorf("empty attribute usage")
+		}
+		return strings.ToLower(usage), nil
+	}); err != nil {
+		return nil, err
+	}
+	if values, ok := params["minValue"]; ok {
+		if len(values) != 1 {
+			return nil, fmt.Errorf("minValue can only be given once")
+		}
+		min, ok := new(big.Rat).SetString(values[0])
+		if !ok || min.Sign() < 0 {
+			return nil, fmt.Errorf("invalid minValue %q", values[0])
+		}
+		f.minValue = min
+		canonical.Set("minValue", min.FloatString(8))
+	}
+	f.key = "mempool/tx?" + canonical.Encode()
+	return f, nil
+}
+
+// filterSet normalizes the values of a parameter, adding them sorted to the canonical form of the filter
+func filterSet(values []string, canonical url.Values, name string, normalize func(string) (string, error)) (map[string]bool, error) {
+	if len(values) > maxFilterAlternatives {
+		return nil, fmt.Errorf("at most %d values can be given for %s", maxFilterAlternatives, name)
+	}
+	set := map[string]bool{}
+	for _, value := range values {
+		normalized, err := normalize(value)
+		if err != nil {
+			return nil, err
+		}
+		if !set[normalized] {
+			set[normalized] = true
+			canonical.Add(name, normalized)
+		}
+	}
+	sort.Strings(canonical[name])
+	return set, nil
+}
+
+func canonicalTransactionType(t string) (string, error) {
+	for _, known := range transactionTypes {
+		if strings.EqualFold(t, known) || strings.EqualFold(t+"Transaction", known) {
+			return known, nil
+		}
+	}
+	return "", fmt.Errorf("unknown transaction type %q", t)
+}
+
+func canonicalAsset(asset string) (string, error) {
+	if hash, ok := assetAliases[strings.ToLower(asset)]; ok {
+		return hash, nil
+	}
+	hash := normalizeTxID(asset)
+	if !validTxID(hash) {
+		return "", fmt.Errorf("invalid asset %q, expected neo, gas or an asset hash", asset)
+	}
+	return hash, nil
+}
+
+func (f *mempoolFilter) match(tx neorpc.GetRawTransactionResult) bool {
+	if len(f.types) > 0 && !f.types[tx.Type] {
+		return false
+	}
+	if len(f.attributes) > 0 {
+		found := false
+		for _, a := range tx.Attributes {
+			if f.attributes[strings.ToLower(a.Usage)] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.assets) == 0 && len(f.addresses) == 0 && f.minValue == nil {
+		return true
+	}
+	for _, out := range tx.Vout {
+		if len(f.assets) > 0 && !f.assets[normalizeTxID(out.Asset)] {
+			continue
+		}
+		if len(f.addresses) > 0 && !f.addresses[out.Address] {
+			continue
+		}
+		if f.minValue != nil {
+			value, ok := new(big.Rat).SetString(out.Value)
+			if !ok || value.Cmp(f.minValue) < 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// retain starts evaluating a filter, or counts one more user of it
+func (f *mempoolFilter) retain() {
+	mempoolFiltersMutex.Lock()
+	defer mempoolFiltersMutex.Unlock()
+	active, ok := mempoolFilters[f.key]
+	if !ok {
+		active = f
+		mempoolFilters[f.key] = f
+	}
+	active.refs++
+}
+
+// release stops evaluating a filter once its last subscription is gone
+func (f *mempoolFilter) release() {
+	mempoolFiltersMutex.Lock()
+	defer mempoolFiltersMutex.Unlock()
+	if active, ok := mempoolFilters[f.key]; ok {
+		active.refs--
+		if active.refs <= 0 {
+			delete(mempoolFilters, f.key)
+		}
+	}
+}
+
+// publishFilteredMempoolTx publishes a transaction under the key of every active filter it matches
+func publishFilteredMempoolTx(tx neorpc.GetRawTransactionResult) {
+	mempoolFiltersMutex.Lock()
+	if len(mempoolFilters) == 0 {
+		mempoolFiltersMutex.Unlock()
+		return
+	}
+	filters := make([]*mempoolFilter, 0, len(mempoolFilters))
+	for _, f := range mempoolFilters {
+		filters = append(filters, f)
+	}
+	mempoolFiltersMutex.Unlock()
+
+	for _, f := range filters {
+		if f.match(tx) {
+			sendMessage(f.key, tx)
+		}
+	}
+}
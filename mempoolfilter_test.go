@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const gasAsset = "0x602c79718b16e442de58778e148d0b1084e3b2dffd5de6b7b16cee7969282de7"
+
+func TestParseMempoolFilter(t *testing.T) {
+	f, err := parseMempoolFilter(url.Values{
+		"type":     {"contract", "InvocationTransaction", "ContractTransaction"},
+		"asset":    {"NEO"},
+		"minValue": {"100"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "mempool/tx?asset=" + neoAsset + "&minValue=100.00000000&type=ContractTransaction&type=InvocationTransaction"
+	if f.key != expected {
+		t.Errorf("got %q, expected %q", f.key, expected)
+	}
+
+	tests := []struct {
+		params url.Values
+		err    string
+	}{
+		{url.Values{"type": {"transfer"}}, "unknown transaction type"},
+		{url.Values{"asset": {"btc"}}, "invalid asset"},
+		{url.Values{"address": {"AL9pp"}}, "invalid NEO address"},
+		{url.Values{"attribute": {""}}, "empty attribute usage"},
+		{url.Values{"minValue": {"1", "2"}}, "only be given once"},
+		{url.Values{"minValue": {"-1"}}, "invalid minValue"},
+		{url.Values{"minValue": {"ten"}}, "invalid minValue"},
+	}
+	for _, test := range tests {
+		if _, err := parseMempoolFilter(test.params); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: expected %q, got %v", test.params, test.err, err)
+		}
+	}
+}
+
+func TestMempoolFilterMatch(t *testing.T) {
+	f, err := parseMempoolFilter(url.Values{
+		"type":     {"contract"},
+		"asset":    {"neo"},
+		"address":  {"AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA"},
+		"minValue": {"10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := func(asset, value, address string) string {
+		return `{"asset":"` + asset + `","value":"` + value + `","address":"` + address + `"}`
+	}
+	tests := []struct {
+		tx      string
+		matched bool
+	}{
+		{`{"type":"ContractTransaction","vout":[` + output(neoAsset, "10", "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA") + `]}`, true},
+		{`{"type":"InvocationTransaction","vout":[` + output(neoAsset, "10", "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA") + `]}`, false},
+		{`{"type":"ContractTransaction","vout":[` + output(neoAsset, "9.9", "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA") + `]}`, false},
+		{`{"type":"ContractTransaction","vout":[` + output(gasAsset, "10", "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA") + `]}`, false},
+		// Every condition has to be satisfied by the same output
+		{`{"type":"ContractTransaction","vout":[` + output(neoAsset, "10", "AUWGapjQ1rThjZDYF3rK1HPfY4UjENhXom") + `,` + output(gasAsset, "50", "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA") + `]}`, false},
+	}
+	for _, test := range tests {
+		if matched := f.match(rawTx(t, test.tx)); matched != test.matched {
+			t.Errorf("%s: matched %v", test.tx, matched)
+		}
+	}
+
+	f, _ = parseMempoolFilter(url.Values{"attribute": {"Remark"}})
+	if !f.match(rawTx(t, `{"type":"InvocationTransaction","attributes":[{"usage":"Remark","data":"00"}]}`)) {
+		t.Error("the attribute wasn't matched")
+	}
+	if f.match(rawTx(t, `{"type":"InvocationTransaction","attributes":[{"usage":"Script","data":"00"}]}`)) {
+		t.Error("a transaction without the attribute was matched")
+	}
+}
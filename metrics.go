@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/metrics"
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+)
+
+var (
+	connectedClients = metrics.NewGaugeVec("pubsub_connected_clients",
+		"Subscriptions currently open, by channel.", "channel")
+	publishedMessages = metrics.NewCounterVec("pubsub_messages_published_total",
+		"Messages published, by channel.", "channel")
+	droppedMessages = metrics.NewCounterVec("pubsub_messages_dropped_total",
+		"Messages dropped because a subscriber queue was full, by channel.", "channel")
+	relayReconnects = metrics.NewCounter("pubsub_relay_reconnects_total",
+		"Reconnections to the websocket events provider.")
+	p2pReconnects = metrics.NewCounter("pubsub_p2p_reconnects_total",
+		"Reconnections to a NEO node after the P2P connection was lost.")
+	p2pFirstAnnouncements = metrics.NewCounterVec("pubsub_p2p_first_announcements_total",
+		"Transactions announced by a NEO node before any other connected node, by configured node (\"discovered\" for the others).", "peer")
+	p2pViolations = metrics.NewCounterVec("pubsub_p2p_protocol_violations_total",
+		"Invalid messages sent by a NEO node, by configured node (\"discovered\" for the others) and kind of violation.", "peer", "kind")
+	rpcLatency = metrics.NewHistogramVec("pubsub_neorpc_request_duration_seconds",
+		"Latency of the JSON-RPC calls made to NEO nodes, by method.", metrics.DefBuckets, "method")
+	deliveryLatency = metrics.NewHistogram("pubsub_delivery_latency_seconds",
+		"Time from a message being received from upstream to it being written to a subscriber.", metrics.DefBuckets)
+)
+
+func init() {
+	neorpc.RequestObserver = func(method string, duration time.Duration, err error) {
+		rpcLatency.With(method).Observe(duration.Seconds())
+	}
+}
+
+// channelLabel turns a channel key into a label with bounded cardinality,
+// every contract gets aggregated under "event_contract", every filter under "event_filtered"
+// and any other key that isn't a built-in channel under "other".
+func channelLabel(key string) string {
+	if strings.HasPrefix(key, "0x") {
+		return "event_contract"
+	}
+	if strings.HasPrefix(key, "event?") {
+		return "event_filtered"
+	}
+	if strings.HasPrefix(key, "nep5/transfer?") {
+		return "nep5/transfer_contract"
+	}
+	if strings.HasPrefix(key, "mempool/tx?") {
+		return "mempool/tx_filtered"
+	}
+	if strings.HasPrefix(key, "address/") {
+		return "address"
+	}
+	if strings.HasPrefix(key, txTrackingChannelPrefix) {
+		return "tx"
+	}
+	if builtinChannels[key] {
+		return key
+	}
+	return "other"
+}
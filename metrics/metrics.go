@@ -0,0 +1,281 @@
+// Package metrics implements the counters, gauges and histograms exported by the
+// server, rendered in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are latency buckets in seconds, from 1ms to 10s
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds metrics and renders them in registration order
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Default is the registry the New* functions register into
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Render writes every metric of the registry
+func (r *Registry) Render(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the registry for Prometheus to scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Render(w)
+	})
+}
+
+// vec is the set of series of a metric, one per combination of label values
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]interface{}
+	keys   []string // sorted series keys so the output is stable
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{name: name, help: help, kind: kind, labels: labels, series: map[string]interface{}{}}
+}
+
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = create()
+		v.series[key] = s
+		v.keys = append(v.keys, key)
+		sort.Strings(v.keys)
+	}
+	return s
+}
+
+// labelString formats label pairs, extra is appended (used for the histogram "le" label)
+func (v *vec) labelString(key string, extra ...string) string {
+	pairs := []string{}
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", v.labels[i], value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *vec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	v.mu.Lock()
+	keys := append([]string{}, v.keys...)
+	v.mu.Unlock()
+	for _, key := range keys {
+		v.mu.Lock()
+		s := v.series[key]
+		v.mu.Unlock()
+		switch m := s.(type) {
+		case *Counter:
+			fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(key), formatFloat(m.Value()))
+		case *Gauge:
+			fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(key), formatFloat(m.Value()))
+		case *Histogram:
+			m.write(w, v, key)
+		}
+	}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter only goes up
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(f float64) {
+	if f < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.value += f
+	c.mu.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := CounterVec{newVec(name, help, "counter", labels)}
+	Default.register(v.vec)
+	return &v
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// Gauge can go up and down
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(f float64) {
+	g.mu.Lock()
+	g.value = f
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(f float64) {
+	g.mu.Lock()
+	g.value += f
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+type GaugeVec struct {
+	*vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := GaugeVec{newVec(name, help, "gauge", labels)}
+	Default.register(v.vec)
+	return &v
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(f float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if f <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += f
+}
+
+func (h *Histogram) write(w io.Writer, v *vec, key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(key, "le", formatFloat(upper)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(key, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelString(key), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelString(key), h.count)
+}
+
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := HistogramVec{newVec(name, help, "histogram", labels), buckets}
+	Default.register(v.vec)
+	return &v
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.get(values, func() interface{} {
+		return &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+	}).(*Histogram)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).With()
+}
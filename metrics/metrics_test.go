@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	published := NewCounterVec("test_published_total", "Messages published.", "channel")
+	published.With("block").Inc()
+	published.With("event").Add(2)
+	clients := NewGauge("test_clients", "Connected clients.")
+	clients.Inc()
+	clients.Inc()
+	clients.Dec()
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "method")
+	latency.With("getblock").Observe(0.05)
+	latency.With("getblock").Observe(0.5)
+	latency.With("getblock").Observe(5)
+
+	var b bytes.Buffer
+	Default.Render(&b)
+	out := b.String()
+	expected := []string{
+		"# TYPE test_published_total counter",
+		`test_published_total{channel="block"} 1`,
+		`test_published_total{channel="event"} 2`,
+		"# TYPE test_clients gauge",
+		"test_clients 1",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{method="getblock",le="0.1"} 1`,
+		`test_latency_seconds_bucket{method="getblock",le="1"} 2`,
+		`test_latency_seconds_bucket{method="getblock",le="+Inf"} 3`,
+		`test_latency_seconds_sum{method="getblock"} 5.55`,
+		`test_latency_seconds_count{method="getblock"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestChannelLabel(t *testing.T) {
+	tests := map[string]string{
+		"block":      "block",
+		"mempool/tx": "mempool/tx",
+		"0xfb84b0950e8fd366af566b2911d6183e4b0367f7":                            "event_contract",
+		"event?contract=&filter=name:transfer":                                  "event_filtered",
+		"nep5/transfer?contract=0xfb84b0950e8fd366af566b2911d6183e4b0367f7":     "nep5/transfer_contract",
+		"mempool/tx?type=ContractTransaction":                                   "mempool/tx_filtered",
+		"address/AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA":                            "address",
+		"tx/0x0000000000000000000000000000000000000000000000000000000000000001": "tx",
+		"fb84b0950e8fd366af566b2911d6183e4b0367f7":                              "other",
+		"anything else": "other",
+	}
+	for key, expected := range tests {
+		if label := channelLabel(key); label != expected {
+			t.Errorf("%s: got %q, expected %q", key, label, expected)
+		}
+	}
+}
+
+func TestPeerLabel(t *testing.T) {
+	h := &NEOConnectionHandler{nodes: map[string]NodeAddresses{}}
+	h.addNodes([]NodeAddresses{{P2P: "seed1:10333", RPC: "http://seed1:10332"}})
+	if label := h.peerLabel("seed1:10333"); label != "seed1:10333" {
+		t.Errorf("a configured node got %q", label)
+	}
+	if label := h.peerLabel("10.0.0.1:10333"); label != "discovered" {
+		t.Errorf("a discovered node got %q", label)
+	}
+}
@@ -33,6 +33,9 @@ type NEORPCClient struct {
 //make sure all method interface is implemented
 var _ NEORPCInterface = (*NEORPCClient)(nil)
 
+//RequestObserver is called after every request when set, eg: to record latency metrics
+var RequestObserver func(method string, duration time.Duration, err error)
+
 func NewClient(endpoint string) *NEORPCClient {
 	u, err := url.Parse(endpoint)
 	if err != nil {
@@ -54,6 +57,15 @@ func NewClient(endpoint string) *NEORPCClient {
 }
 
 func (n *NEORPCClient) makeRequest(method string, params []interface{}, out interface{}) error {
+	start := time.Now()
+	err := n.doRequest(method, params, out)
+	if RequestObserver != nil {
+		RequestObserver(method, time.Since(start), err)
+	}
+	return err
+}
+
+func (n *NEORPCClient) doRequest(method string, params []interface{}, out interface{}) error {
 	request := NewRequest(method, params)
 
 	jsonValue, _ := json.Marshal(request)
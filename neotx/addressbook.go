@@ -0,0 +1,260 @@
+package neotx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+const (
+	DefaultMaxAddresses = 1000
+	maxFailureBackoff   = time.Hour
+)
+
+// AddressInfo is what is known about a node address, from addr messages and connections to it
+type AddressInfo struct {
+	Address     string        `json:"address"` // host:port
+	Services    uint64        `json:"services"`
+	LastSeen    time.Time     `json:"lastSeen"`              // Last time it was announced or connected to
+	LastAttempt time.Time     `json:"lastAttempt,omitempty"` // Last connection attempt
+	LastSuccess time.Time     `json:"lastSuccess,omitempty"` // Last completed handshake
+	Failures    int           `json:"failures"`              // Attempts that failed since the last handshake
+	Latency     time.Duration `json:"latency"`               // Of the last handshake, in nanoseconds
+}
+
+// AddressBook collects the addresses of the nodes announced by peers so connections don't
+// depend on a fixed list. It is saved as JSON to a file and loaded back on start.
+type AddressBook struct {
+	path string
+	max  int
+
+	mu      sync.Mutex
+	entries map[string]*AddressInfo
+	dirty   bool
+}
+
+// NewAddressBook loads the book from path, which doesn't need to exist yet. An empty path
+// keeps the book in memory.
+func NewAddressBook(path string, max int) (*AddressBook, error) {
+	if max <= 0 {
+		max = DefaultMaxAddresses
+	}
+	b := &AddressBook{path: path, max: max, entries: map[string]*AddressInfo{}}
+	if path == "" {
+		return b, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*AddressInfo
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if _, _, err := net.SplitHostPort(e.Address); err == nil {
+			b.entries[e.Address] = e
+		}
+	}
+	return b, nil
+}
+
+// Add records the addresses of an addr message, it returns how many weren't known
+func (b *AddressBook) Add(addresses []*network.NetWorkAddressWithTime) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	added := 0
+	for _, na := range addresses {
+		ip := na.Endpoint.IP
+		if na.Endpoint.Port == 0 || ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() {
+			continue
+		}
+		address := na.Endpoint.String()
+		seen := na.Timestamp
+		if seen.After(time.Now()) {
+			seen = time.Now()
+		}
+		if e, ok := b.entries[address]; ok {
+			if seen.After(e.LastSeen) {
+				e.LastSeen = seen
+			}
+			e.Services = uint64(na.Services)
+			continue
+		}
+		if len(b.entries) >= b.max && !b.evict() {
+			continue
+		}
+		b.entries[address] = &AddressInfo{Address: address, Services: uint64(na.Services), LastSeen: seen}
+		added++
+	}
+	if added > 0 {
+		b.dirty = true
+	}
+	return added
+}
+
+// evict makes room for a new address by removing the stalest one nobody connected to, it must
+// be called with the mutex held
+func (b *AddressBook) evict() bool {
+	var stalest *AddressInfo
+	for _, e := range b.entries {
+		if !e.LastSuccess.IsZero() {
+			continue
+		}
+		if stalest == nil || e.LastSeen.Before(stalest.LastSeen) {
+			stalest = e
+		}
+	}
+	if stalest == nil {
+		return false
+	}
+	delete(b.entries, stalest.Address)
+	return true
+}
+
+// RecordAttempt is called before connecting to an address
+func (b *AddressBook) RecordAttempt(address string) {
+	b.update(address, func(e *AddressInfo) {
+		e.LastAttempt = time.Now()
+	})
+}
+
+// RecordSuccess is called once the handshake with an address is completed
+func (b *AddressBook) RecordSuccess(address string, services network.ServiceFlag, latency time.Duration) {
+	b.update(address, func(e *AddressInfo) {
+		now := time.Now()
+		e.Services = uint64(services)
+		e.LastSeen, e.LastSuccess = now, now
+		e.Failures = 0
+		e.Latency = latency
+	})
+}
+
+// RecordFailure is called when an address couldn't be connected to
+func (b *AddressBook) RecordFailure(address string) {
+	b.update(address, func(e *AddressInfo) {
+		e.Failures++
+	})
+}
+
+// update changes the entry of an address, adding it if needed: the configured peers are tracked too
+func (b *AddressBook) update(address string, change func(*AddressInfo)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[address]
+	if !ok {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return
+		}
+		e = &AddressInfo{Address: address}
+		b.entries[address] = e
+	}
+	change(e)
+	b.dirty = true
+}
+
+// Candidates returns the addresses worth connecting to: the ones that completed a handshake,
+// fastest first, then the ones never connected to, most recently seen first. Addresses that
+// keep failing are left out for a while, twice as long after every failure.
+func (b *AddressBook) Candidates(retryDelay time.Duration) []string {
+	b.mu.Lock()
+	now := time.Now()
+	entries := make([]*AddressInfo, 0, len(b.entries))
+	for _, e := range b.entries {
+		if e.Failures > 0 && now.Before(e.LastAttempt.Add(failureBackoff(retryDelay, e.Failures))) {
+			continue
+		}
+		copied := *e
+		entries = append(entries, &copied)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if connectedA, connectedB := !a.LastSuccess.IsZero(), !b.LastSuccess.IsZero(); connectedA != connectedB {
+			return connectedA
+		}
+		if a.Failures != b.Failures {
+			return a.Failures < b.Failures
+		}
+		if !a.LastSuccess.IsZero() && a.Latency != b.Latency {
+			return a.Latency < b.Latency
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	addresses := make([]string, len(entries))
+	for i, e := range entries {
+		addresses[i] = e.Address
+	}
+	return addresses
+}
+
+func failureBackoff(retryDelay time.Duration, failures int) time.Duration {
+	backoff := retryDelay
+	for i := 1; i < failures && backoff < maxFailureBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxFailureBackoff {
+		backoff = maxFailureBackoff
+	}
+	return backoff
+}
+
+// Get returns what is known about an address
+func (b *AddressBook) Get(address string) (AddressInfo, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[address]
+	if !ok {
+		return AddressInfo{}, false
+	}
+	return *e, true
+}
+
+// Len is the number of addresses in the book
+func (b *AddressBook) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// Save writes the book to its file if it changed since it was last saved
+func (b *AddressBook) Save() error {
+	b.mu.Lock()
+	if b.path == "" || !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	entries := make([]*AddressInfo, 0, len(b.entries))
+	for _, e := range b.entries {
+		copied := *e
+		entries = append(entries, &copied)
+	}
+	b.dirty = false
+	b.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Address < entries[j].Address })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		// Written next to the book and renamed so a crash never leaves it half written
+		tmp := b.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, b.path)
+		}
+	}
+	if err != nil {
+		b.mu.Lock()
+		b.dirty = true
+		b.mu.Unlock()
+	}
+	return err
+}
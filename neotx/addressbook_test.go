@@ -0,0 +1,134 @@
+package neotx
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+func announced(ip string, port uint16, seen time.Time) *network.NetWorkAddressWithTime {
+	return &network.NetWorkAddressWithTime{Timestamp: seen, Endpoint: network.Endpoint{IP: net.ParseIP(ip), Port: port}}
+}
+
+func TestAddressBookAddFiltersAddresses(t *testing.T) {
+	book, _ := NewAddressBook("", 0)
+	now := time.Now()
+	added := book.Add([]*network.NetWorkAddressWithTime{
+		announced("203.0.113.1", 10333, now),
+		announced("2001:db8::1", 10333, now),
+		announced("203.0.113.1", 10333, now),
+		announced("203.0.113.2", 0, now),
+		announced("127.0.0.1", 10333, now),
+		announced("0.0.0.0", 10333, now),
+		announced("::", 10333, now),
+		announced("224.0.0.1", 10333, now),
+	})
+	if added != 2 || book.Len() != 2 {
+		t.Errorf("added %d addresses, the book has %d", added, book.Len())
+	}
+	if _, ok := book.Get("[2001:db8::1]:10333"); !ok {
+		t.Error("the IPv6 address wasn't added")
+	}
+	// Timestamps in the future are not trusted
+	book.Add([]*network.NetWorkAddressWithTime{announced("203.0.113.1", 10333, now.Add(time.Hour))})
+	if info, _ := book.Get("203.0.113.1:10333"); info.LastSeen.After(time.Now()) {
+		t.Errorf("unexpected last seen %v", info.LastSeen)
+	}
+}
+
+func TestAddressBookEvictsStalestAddresses(t *testing.T) {
+	book, _ := NewAddressBook("", 2)
+	now := time.Now()
+	book.Add([]*network.NetWorkAddressWithTime{announced("203.0.113.1", 10333, now.Add(-2*time.Hour))})
+	book.RecordSuccess("203.0.113.1:10333", network.DefaultServiceFlag, time.Millisecond)
+	book.Add([]*network.NetWorkAddressWithTime{
+		announced("203.0.113.2", 10333, now.Add(-time.Hour)),
+		announced("203.0.113.3", 10333, now),
+	})
+	if book.Len() != 2 {
+		t.Fatalf("the book has %d addresses", book.Len())
+	}
+	if _, ok := book.Get("203.0.113.2:10333"); ok {
+		t.Error("the stalest address should have been evicted")
+	}
+	if _, ok := book.Get("203.0.113.1:10333"); !ok {
+		t.Error("an address that was connected to shouldn't be evicted")
+	}
+}
+
+func TestAddressBookCandidates(t *testing.T) {
+	book, _ := NewAddressBook("", 0)
+	now := time.Now()
+	book.Add([]*network.NetWorkAddressWithTime{
+		announced("203.0.113.1", 10333, now.Add(-time.Hour)),
+		announced("203.0.113.2", 10333, now),
+		announced("203.0.113.3", 10333, now),
+		announced("203.0.113.4", 10333, now),
+		announced("203.0.113.5", 10333, now),
+	})
+	book.RecordSuccess("203.0.113.3:10333", network.DefaultServiceFlag, 200*time.Millisecond)
+	book.RecordSuccess("203.0.113.4:10333", network.DefaultServiceFlag, 50*time.Millisecond)
+	book.RecordAttempt("203.0.113.5:10333")
+	book.RecordFailure("203.0.113.5:10333")
+
+	expected := []string{"203.0.113.4:10333", "203.0.113.3:10333", "203.0.113.2:10333", "203.0.113.1:10333"}
+	if candidates := book.Candidates(time.Hour); !reflect.DeepEqual(candidates, expected) {
+		t.Errorf("got %v, expected %v", candidates, expected)
+	}
+	// Once its backoff is over, the failing address is tried after the others
+	time.Sleep(20 * time.Millisecond)
+	expected = append(expected, "203.0.113.5:10333")
+	if candidates := book.Candidates(10 * time.Millisecond); !reflect.DeepEqual(candidates, expected) {
+		t.Errorf("got %v, expected %v", candidates, expected)
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 100: maxFailureBackoff} {
+		if backoff := failureBackoff(time.Second, failures); backoff != expected {
+			t.Errorf("%d failures: backoff %v, expected %v", failures, backoff, expected)
+		}
+	}
+}
+
+func TestAddressBookSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addressbook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+
+	book, err := NewAddressBook(path, 0)
+	if err != nil || book.Len() != 0 {
+		t.Fatalf("a missing file should give an empty book: %v", err)
+	}
+	book.Add([]*network.NetWorkAddressWithTime{announced("203.0.113.1", 10333, time.Now())})
+	book.RecordSuccess("seed1.neo.org:10333", network.DefaultServiceFlag, 30*time.Millisecond)
+	if err := book.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewAddressBook(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != 2 {
+		t.Fatalf("loaded %d addresses", loaded.Len())
+	}
+	info, _ := loaded.Get("seed1.neo.org:10333")
+	if info.Latency != 30*time.Millisecond || info.Services != uint64(network.DefaultServiceFlag) || info.LastSuccess.IsZero() {
+		t.Errorf("unexpected entry %+v", info)
+	}
+
+	ioutil.WriteFile(path, []byte("not json"), 0644)
+	if _, err := NewAddressBook(path, 0); err == nil {
+		t.Error("an invalid file should be reported")
+	}
+}
@@ -2,11 +2,13 @@ package neotx
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/corollari/neo-ws-pub-sub/neotx/network"
@@ -23,43 +25,151 @@ type Config struct {
 	Network   network.NEONetworkMagic
 	IPAddress string
 	Port      uint16
+
+	Framing       FramingPolicy // What is done with a message whose header or checksum is invalid
+	MaxViolations int           // Framing violations resynced on a connection before giving up on it, DefaultMaxViolations when 0
+
+	HandshakeTimeout time.Duration // To connect and exchange versions, DefaultHandshakeTimeout when 0
+	IdleTimeout      time.Duration // Without any message once connected, DefaultIdleTimeout when 0. Pings are sent 3 times per period.
+
+	// Reconnect makes Start connect again when the connection is lost or can't be opened, waiting
+	// ReconnectDelay (DefaultReconnectDelay when 0) the first time and twice as long after every
+	// attempt that doesn't complete the handshake, up to MaxReconnectDelay.
+	Reconnect      bool
+	ReconnectDelay time.Duration
 }
 
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+	DefaultIdleTimeout      = 90 * time.Second
+	DefaultReconnectDelay   = time.Second
+	MaxReconnectDelay       = time.Minute
+)
+
+// ConnectionState is the step of the handshake a connection is at
+type ConnectionState int32
+
+const (
+	StateDialing         ConnectionState = iota
+	StateVersionSent                     // Waiting for the version of the node
+	StateVersionReceived                 // The version of the node was acknowledged, waiting for its verack
+	StateEstablished                     // Both versions were acknowledged, every message is accepted
+	StateClosing
+)
+
+var connectionStateString = map[ConnectionState]string{
+	StateDialing:         "dialing",
+	StateVersionSent:     "version sent",
+	StateVersionReceived: "version received",
+	StateEstablished:     "established",
+	StateClosing:         "closing",
+}
+
+func (s ConnectionState) String() string {
+	if str, ok := connectionStateString[s]; ok {
+		return str
+	}
+	return fmt.Sprintf("Unknown ConnectionState: %d", int32(s))
+}
+
+// ErrSelfConnection is returned when the node answers with our own nonce, we connected to ourselves
+var ErrSelfConnection = errors.New("connected to ourselves")
+
+// FramingPolicy decides whether a connection survives a message with an invalid header or checksum
+type FramingPolicy int
+
+const (
+	// DisconnectOnViolation closes the connection at the first invalid message
+	DisconnectOnViolation FramingPolicy = iota
+	// ResyncOnViolation skips invalid messages up to the next header of the network, until
+	// MaxViolations of them are found
+	ResyncOnViolation
+)
+
+const DefaultMaxViolations = 10
+
 type Client struct {
 	Config     Config
 	delegate   MessageDelegate
 	connection net.Conn
+
+	mu          sync.Mutex
+	closed      bool
+	closing     chan struct{} // Closed by Close, interrupts the wait before reconnecting
+	done        chan struct{} // Closed when the current connection is over, stops its goroutines
+	established bool          // The current connection completed the handshake
+	writeErr    error         // First write that failed on the current connection
+	state       ConnectionState
+	remote      network.Version // Sent by the node during the handshake
+	latency     time.Duration   // Between sending our version and receiving the node's
+	violations  int             // Framing violations of the current connection
+	writeMu     sync.Mutex      // Messages are written by the read loop, the ping loop and GetData
 }
 
 func NewClient(config Config) *Client {
-	return &Client{Config: config}
+	return &Client{Config: config, closing: make(chan struct{})}
 }
 
 type TX struct {
 	Type network.InventoryType
 	ID   string
+	Hash network.Hash
+	Peer string // Set by PeerManager to the peer that announced it first
 }
 
 type MessageDelegate interface {
 	OnReceive(TX)
+	// OnConnected is called once the handshake is completed with the version of the node
 	OnConnected(network.Version)
+	// OnError receives the error that ended a connection before the client moves on, it mustn't block
 	OnError(error)
 }
 
+// DataDelegate is implemented by delegates that request inventories with GetData
+type DataDelegate interface {
+	OnTransaction(*network.Transaction)
+	// OnBlock receives blocks whose transactions match their merkle root
+	OnBlock(*network.Block)
+	OnConsensus(*network.ConsensusPayload)
+	// OnNotFound receives the requested inventories the node doesn't have
+	OnNotFound(network.Inv)
+}
+
+// ViolationDelegate is implemented by delegates that keep track of the invalid messages sent by
+// the node, malformed payloads are reported too but never cause a disconnection
+type ViolationDelegate interface {
+	OnViolation(*network.MessageError)
+}
+
+// AddrDelegate is implemented by delegates that collect node addresses, getaddr is sent to the
+// node once connected when the delegate implements it
+type AddrDelegate interface {
+	OnAddr(network.Addr)
+}
+
 type Interface interface {
 	handleConnection()
-	Start() error
+	Start(context.Context) error
+	Close() error
 	SetDelegate(MessageDelegate)
 }
 
-func startPingLoop(c *Client) {
-	conn := c.connection
+// startPingLoop keeps the connection alive until done is closed or a ping can't be written
+func startPingLoop(c *Client, conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(c.idleTimeout() / 3)
+	defer ticker.Stop()
 	for {
-		time.Sleep(1000 * time.Millisecond)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
 		nonce, _ := network.RandomUint32()
 		payload := network.NewPingPayload(nonce)
 		pingCommand := network.NewMessage(c.Config.Network, network.CommandPing, payload)
-		conn.Write(pingCommand)
+		if c.write(conn, pingCommand) != nil {
+			return
+		}
 	}
 }
 
@@ -69,86 +179,399 @@ func (c *Client) handleConnection() {
 	conn := c.connection
 	log.Printf("remote address = %v", conn.RemoteAddr().String())
 	log.Printf("local address = %v", conn.LocalAddr().String())
+	defer func() {
+		conn.Close()
+		c.mu.Lock()
+		c.state = StateClosing
+		close(c.done)
+		c.mu.Unlock()
+	}()
 	nonce, _ := network.RandomUint32()
 	payload := network.NewVersionPayload(c.Config.Port, nonce)
 	versionCommand := network.NewMessage(c.Config.Network, network.CommandVersion, payload)
-	conn.Write(versionCommand)
+	versionSent := time.Now()
+	conn.SetReadDeadline(versionSent.Add(c.handshakeTimeout()))
+	c.write(conn, versionCommand)
+	c.setState(StateVersionSent)
 
+	reader := network.NewFrameReader(conn, c.Config.Network)
 	for {
-		_, msg, err := network.ReadMessage(conn, nil)
-		if err != nil {
-			log.Printf("mesage from server when error %+v", err)
-			if c.delegate != nil {
-				c.connection.Close()
-				go c.delegate.OnError(err)
+		msg, err := reader.ReadMessage()
+		if merr, ok := err.(*network.MessageError); ok && !c.isClosed() && c.handleViolation(reader, merr) {
+			continue
+		}
+		if err == nil && c.State() != StateEstablished {
+			if err = c.handshake(conn, msg, nonce, versionSent); err == nil {
+				continue
 			}
-			return
 		}
-
-		payloadByte := make([]byte, msg.Length)
-		_, err = io.ReadFull(conn, payloadByte)
 		if err != nil {
+			if c.isClosed() {
+				return
+			}
+			if writeErr := c.lastWriteError(); writeErr != nil {
+				// Reading failed because the connection was closed after the write
+				err = writeErr
+			} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if c.State() == StateEstablished {
+					err = fmt.Errorf("no message received in %v", c.idleTimeout())
+				} else {
+					err = fmt.Errorf("handshake not completed in %v", c.handshakeTimeout())
+				}
+			}
+			log.Printf("mesage from server when error %+v", err)
 			if c.delegate != nil {
-				go c.delegate.OnError(err)
+				c.delegate.OnError(err)
 			}
-			continue
+			return
 		}
+		conn.SetReadDeadline(time.Now().Add(c.idleTimeout()))
 
-		//receive version from remote node
-		if msg.Command == string(network.CommandVersion) {
-			out := &network.Version{}
-			pr := bytes.NewBuffer(payloadByte)
-			out.Decode(pr, 0)
-			//reply with verack
-			verack := network.NewMessage(c.Config.Network, network.CommandVerack, nil)
-			conn.Write(verack)
+		payloadByte := msg.Payload
 
-			if c.delegate != nil {
-				go c.delegate.OnConnected(*out)
-			}
-		} else if msg.Command == string(network.CommandVerack) {
-			go startPingLoop(c)
+		if msg.Command == string(network.CommandVersion) || msg.Command == string(network.CommandVerack) {
+			log.Printf("%s received again from %s, ignored", msg.Command, conn.RemoteAddr())
 		} else if msg.Command == string(network.CommandPong) {
-			log.Println("Pong!")
+			// Only refreshes the read deadline
 		} else if msg.Command == string(network.CommandAddr) {
 			out := &network.Addr{}
 			pr := bytes.NewBuffer(payloadByte)
-			out.Decode(pr, 0)
+			if err := out.Decode(pr, 0); err != nil {
+				c.malformed(msg.Command, err)
+				continue
+			}
+			if d, ok := c.delegate.(AddrDelegate); ok {
+				go d.OnAddr(*out)
+			}
 		} else if msg.Command == string(network.CommandInv) {
 			out := &network.Inv{}
-			log.Printf("msg = %+v\n", msg)
 			pr := bytes.NewBuffer(payloadByte)
-			out.Decode(pr, 0)
+			if err := out.Decode(pr, 0); err != nil {
+				c.malformed(msg.Command, err)
+				continue
+			}
 			for _, v := range out.Hashes {
 				b := v.ToBytes()
 				txID := hex.EncodeToString(b)
 				tx := TX{
 					Type: out.Type,
 					ID:   txID,
+					Hash: v,
 				}
 
 				if c.delegate != nil {
 					go c.delegate.OnReceive(tx)
 				}
 			}
+		} else if msg.Command == string(network.CommandTx) {
+			out := &network.Transaction{}
+			if err := out.Decode(bytes.NewBuffer(payloadByte), 0); err != nil {
+				c.malformed(msg.Command, err)
+				continue
+			}
+			if d, ok := c.delegate.(DataDelegate); ok {
+				go d.OnTransaction(out)
+			}
+		} else if msg.Command == string(network.CommandBlock) {
+			out := &network.Block{}
+			if err := out.Decode(bytes.NewBuffer(payloadByte), 0); err != nil {
+				c.malformed(msg.Command, err)
+				continue
+			}
+			if !out.ValidMerkleRoot() {
+				c.malformed(msg.Command, fmt.Errorf("block %d doesn't match its merkle root", out.Index))
+				continue
+			}
+			if d, ok := c.delegate.(DataDelegate); ok {
+				go d.OnBlock(out)
+			}
+		} else if msg.Command == string(network.CommandConsensus) {
+			out := &network.ConsensusPayload{}
+			if err := out.Decode(bytes.NewBuffer(payloadByte), 0); err != nil {
+				c.malformed(msg.Command, err)
+				continue
+			}
+			if d, ok := c.delegate.(DataDelegate); ok {
+				go d.OnConsensus(out)
+			}
+		} else if msg.Command == string(network.CommandNotfound) {
+			out := &network.Inv{}
+			if err := out.Decode(bytes.NewBuffer(payloadByte), 0); err != nil {
+				continue
+			}
+			if d, ok := c.delegate.(DataDelegate); ok {
+				go d.OnNotFound(*out)
+			}
 		} else {
 			log.Printf("Unhandled message: %s\n", msg.Command)
 		}
 	}
 }
+
+// handshake handles the messages received before the connection is established: the version of
+// the node, answered with verack, and then its verack. Any other message fails the handshake.
+func (c *Client) handshake(conn net.Conn, msg *network.MessageHeader, nonce uint32, versionSent time.Time) error {
+	state := c.State()
+	if state == StateVersionSent && msg.Command == string(network.CommandVersion) {
+		v := &network.Version{}
+		if err := v.Decode(bytes.NewBuffer(msg.Payload), 0); err != nil {
+			return err
+		}
+		if v.Nonce == nonce {
+			return ErrSelfConnection
+		}
+		c.mu.Lock()
+		c.remote = *v
+		c.latency = time.Since(versionSent)
+		c.mu.Unlock()
+		c.setState(StateVersionReceived)
+		return c.write(conn, network.NewMessage(c.Config.Network, network.CommandVerack, nil))
+	}
+	if state == StateVersionReceived && msg.Command == string(network.CommandVerack) {
+		c.mu.Lock()
+		c.state = StateEstablished
+		c.established = true
+		done := c.done
+		c.mu.Unlock()
+		conn.SetReadDeadline(time.Now().Add(c.idleTimeout()))
+		go startPingLoop(c, conn, done)
+		if _, ok := c.delegate.(AddrDelegate); ok {
+			c.write(conn, network.NewMessage(c.Config.Network, network.CommandGetAddr, nil))
+		}
+		if c.delegate != nil {
+			go c.delegate.OnConnected(c.RemoteVersion())
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected %s during the handshake (%v)", msg.Command, state)
+}
+
+func (c *Client) handshakeTimeout() time.Duration {
+	if c.Config.HandshakeTimeout > 0 {
+		return c.Config.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.Config.IdleTimeout > 0 {
+		return c.Config.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// State is the step of the handshake the connection is at
+func (c *Client) State() ConnectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *Client) setState(s ConnectionState) {
+	c.mu.Lock()
+	c.state = s
+	c.mu.Unlock()
+}
+
+// RemoteVersion is the version the node sent during the handshake, with its user agent, start
+// height and relay flag. It is empty until then.
+func (c *Client) RemoteVersion() network.Version {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// handleViolation applies the framing policy to an invalid message, it returns whether the connection can go on
+func (c *Client) handleViolation(reader *network.FrameReader, err *network.MessageError) bool {
+	c.mu.Lock()
+	c.violations++
+	violations := c.violations
+	c.mu.Unlock()
+	log.Printf("invalid message from %s: %v", c.connection.RemoteAddr(), err)
+	if d, ok := c.delegate.(ViolationDelegate); ok {
+		d.OnViolation(err)
+	}
+	max := c.Config.MaxViolations
+	if max <= 0 {
+		max = DefaultMaxViolations
+	}
+	if c.Config.Framing != ResyncOnViolation || violations >= max {
+		return false
+	}
+	if err.Kind == network.BadChecksum {
+		// The whole message was read, the next one starts right after it
+		return true
+	}
+	skipped, resyncErr := reader.Resync()
+	if resyncErr != nil {
+		return false
+	}
+	log.Printf("skipped %d bytes to resync with %s", skipped, c.connection.RemoteAddr())
+	return true
+}
+
+// malformed reports a payload that can't be decoded, the message is skipped
+func (c *Client) malformed(command string, err error) {
+	log.Printf("can't decode %s: %v", command, err)
+	merr, ok := err.(*network.MessageError)
+	if !ok {
+		merr = &network.MessageError{Func: command, Description: err.Error()}
+	}
+	if d, ok := c.delegate.(ViolationDelegate); ok {
+		d.OnViolation(merr)
+	}
+}
+
+// Violations is the number of invalid headers and checksums received on the current connection
+func (c *Client) Violations() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.violations
+}
+
+// write sends a message, the connection is closed when it fails so the read loop ends and reports the error
+func (c *Client) write(conn net.Conn, message []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := conn.Write(message)
+	if err != nil {
+		c.mu.Lock()
+		if c.writeErr == nil {
+			c.writeErr = fmt.Errorf("can't write to %s: %v", conn.RemoteAddr(), err)
+		}
+		c.mu.Unlock()
+		conn.Close()
+	}
+	return err
+}
+
+func (c *Client) lastWriteError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeErr
+}
+
+// GetData asks the node for inventories it announced, transactions, blocks and consensus payloads are handed to the delegate if it implements DataDelegate
+func (c *Client) GetData(t network.InventoryType, hashes ...network.Hash) error {
+	c.mu.Lock()
+	conn := c.connection
+	closed := c.closed
+	c.mu.Unlock()
+	if conn == nil || closed {
+		return fmt.Errorf("not connected")
+	}
+	return c.write(conn, network.NewMessage(c.Config.Network, network.CommandGetData, network.NewInvPayload(t, hashes)))
+}
+
+// Latency is the time the node took to answer our version, 0 until it does
+func (c *Client) Latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latency
+}
+
 func (c *Client) SetDelegate(d MessageDelegate) {
 	c.delegate = d
 }
 
-func (c *Client) Start() error {
+// Start connects to the node and handles the connection until it is lost, Close is called or ctx
+// is done, which closes the client too. Without Config.Reconnect it returns once the connection is
+// over, the error that ended it is given to OnError and only the errors of dialing are returned.
+// With it the client connects again after a backoff, reporting every failure to OnError, and
+// Start only returns once the client is closed: nil after Close, the error of ctx otherwise.
+// PeerManager doesn't use it, it moves on to another peer with its own backoff instead.
+func (c *Client) Start(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
 
-	address := fmt.Sprintf("%v:%v", c.Config.IPAddress, c.Config.Port)
-	conn, err := net.Dial("tcp", address)
+	delay := c.reconnectDelay()
+	for {
+		err := c.connect(ctx)
+		if c.isClosed() {
+			return ctx.Err()
+		}
+		if !c.Config.Reconnect {
+			return err
+		}
+		if err != nil {
+			log.Printf("can't connect to %s:%d: %v", c.Config.IPAddress, c.Config.Port, err)
+			if c.delegate != nil {
+				c.delegate.OnError(err)
+			}
+		}
+		c.mu.Lock()
+		if c.established {
+			delay = c.reconnectDelay()
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.closing:
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > MaxReconnectDelay {
+			delay = MaxReconnectDelay
+		}
+	}
+}
+
+// connect opens a connection and handles it until it is over
+func (c *Client) connect(ctx context.Context) error {
+	c.setState(StateDialing)
+	address := net.JoinHostPort(c.Config.IPAddress, fmt.Sprint(c.Config.Port))
+	dialer := net.Dialer{Timeout: c.handshakeTimeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
+		c.setState(StateClosing)
 		return err
 	}
 
+	c.mu.Lock()
+	if c.closed {
+		c.state = StateClosing
+		c.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("client is closed")
+	}
 	c.connection = conn
+	c.done = make(chan struct{})
+	c.established, c.writeErr, c.violations = false, nil, 0
+	c.mu.Unlock()
 	c.handleConnection()
 	return nil
 }
+
+func (c *Client) reconnectDelay() time.Duration {
+	if c.Config.ReconnectDelay > 0 {
+		return c.Config.ReconnectDelay
+	}
+	return DefaultReconnectDelay
+}
+
+// Close disconnects from the node and stops reconnecting, the delegate isn't notified of the resulting error
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		close(c.closing)
+	}
+	c.closed = true
+	c.state = StateClosing
+	if c.connection == nil {
+		return nil
+	}
+	return c.connection.Close()
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
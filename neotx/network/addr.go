@@ -5,13 +5,23 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"time"
 )
 
+// Upper bound of the addresses of an addr message, anything larger is rejected while decoding
+const MaxAddresses = 200
+
 type Endpoint struct {
 	IP   net.IP //16 bytes
 	Port uint16 //2 bytes
 }
+
+// String returns the endpoint as host:port, IPv4 addresses in their dotted form
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.IP.String(), strconv.Itoa(int(e.Port)))
+}
+
 type NetWorkAddressWithTime struct {
 	Services  ServiceFlag //8 bytes
 	Timestamp time.Time   //4 bytes
@@ -46,6 +56,16 @@ func readNetworkAddress(r io.Reader, na *NetWorkAddressWithTime) error {
 	return nil
 }
 
+func writeNetworkAddress(w io.Writer, na *NetWorkAddressWithTime) error {
+	var ip [16]byte
+	copy(ip[:], na.Endpoint.IP.To16())
+	err := writeElements(w, uint32(na.Timestamp.Unix()), na.Services, ip)
+	if err != nil {
+		return err
+	}
+	return binarySerializer.PutUint16(w, bigEndian, na.Endpoint.Port)
+}
+
 type Addr struct {
 	Addresses []*NetWorkAddressWithTime
 }
@@ -61,6 +81,9 @@ func (a *Addr) Decode(r io.Reader, protocolVersion uint32) error {
 	if err != nil {
 		return err
 	}
+	if count > MaxAddresses {
+		return messageError("Addr.Decode", fmt.Sprintf("too many addresses [count %d, max %d]", count, MaxAddresses))
+	}
 	addrList := make([]NetWorkAddressWithTime, count)
 	a.Addresses = make([]*NetWorkAddressWithTime, 0, count)
 	for i := uint64(0); i < count; i++ {
@@ -75,5 +98,17 @@ func (a *Addr) Decode(r io.Reader, protocolVersion uint32) error {
 }
 
 func (a *Addr) Encode(w io.Writer, protocolVersion uint32) error {
+	if len(a.Addresses) > MaxAddresses {
+		return messageError("Addr.Encode", fmt.Sprintf("too many addresses [count %d, max %d]", len(a.Addresses), MaxAddresses))
+	}
+	err := WriteVarInt(w, protocolVersion, uint64(len(a.Addresses)))
+	if err != nil {
+		return err
+	}
+	for _, na := range a.Addresses {
+		if err := writeNetworkAddress(w, na); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,55 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddrEncode(t *testing.T) {
+	a := &Addr{Addresses: []*NetWorkAddressWithTime{{
+		Services:  DefaultServiceFlag,
+		Timestamp: time.Unix(1584568869, 0),
+		Endpoint:  Endpoint{IP: net.ParseIP("127.0.0.1"), Port: 10333},
+	}}}
+	var encoded bytes.Buffer
+	if err := a.Encode(&encoded, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The timestamp and services are little endian, the port big endian
+	if h := hex.EncodeToString(encoded.Bytes()); h != "01259a725e010000000000000000000000000000000000ffff7f000001285d" {
+		t.Errorf("encoded as %s", h)
+	}
+}
+
+func TestAddrRoundTrip(t *testing.T) {
+	a := &Addr{Addresses: []*NetWorkAddressWithTime{
+		{Services: DefaultServiceFlag, Timestamp: time.Unix(1584568869, 0), Endpoint: Endpoint{IP: net.IPv4(10, 0, 0, 1), Port: 20333}},
+		{Timestamp: time.Unix(1584568870, 0), Endpoint: Endpoint{IP: net.ParseIP("2001:db8::1"), Port: 10333}},
+	}}
+	var encoded bytes.Buffer
+	if err := a.Encode(&encoded, 0); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Addr{}
+	if err := decoded.Decode(&encoded, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Addresses) != 2 {
+		t.Fatalf("decoded %d addresses", len(decoded.Addresses))
+	}
+	for i, na := range decoded.Addresses {
+		want := a.Addresses[i]
+		if na.Endpoint.String() != want.Endpoint.String() || !na.Timestamp.Equal(want.Timestamp) || na.Services != want.Services {
+			t.Errorf("decoded %+v, expected %+v", na, want)
+		}
+	}
+	if s := decoded.Addresses[0].Endpoint.String(); s != "10.0.0.1:20333" {
+		t.Errorf("unexpected endpoint %s", s)
+	}
+	if s := decoded.Addresses[1].Endpoint.String(); s != "[2001:db8::1]:10333" {
+		t.Errorf("unexpected endpoint %s", s)
+	}
+}
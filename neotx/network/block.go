@@ -0,0 +1,145 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// http://docs.neo.org/en-us/network/network-protocol.html#block
+
+// Upper bound of the transactions of a block, anything larger is rejected while decoding
+const MaxBlockTransactions = 65536
+
+// BlockHeader is the part of a block the consensus nodes sign, Witness is their multi-signature
+type BlockHeader struct {
+	Version       uint32
+	PrevHash      Hash
+	MerkleRoot    Hash
+	Timestamp     uint32
+	Index         uint32
+	ConsensusData uint64 // Nonce picked by the speaker
+	NextConsensus UInt160
+	Witness       Witness
+}
+
+// Hash is the double SHA-256 of the header without its witness
+func (h *BlockHeader) Hash() Hash {
+	buf := &bytes.Buffer{}
+	h.encodeUnsigned(buf)
+	first := sha256.Sum256(buf.Bytes())
+	return Hash(sha256.Sum256(first[:]))
+}
+
+func (h *BlockHeader) encodeUnsigned(w io.Writer) error {
+	return writeElements(w, h.Version, h.PrevHash, h.MerkleRoot, h.Timestamp, h.Index, h.ConsensusData, h.NextConsensus)
+}
+
+func (h *BlockHeader) decode(r io.Reader, pver uint32) error {
+	if err := ReadElements(r, &h.Version, &h.PrevHash, &h.MerkleRoot, &h.Timestamp, &h.Index, &h.ConsensusData, &h.NextConsensus); err != nil {
+		return err
+	}
+	// Blocks carry a list of witnesses that always has a single one
+	var witnesses uint8
+	if err := readElement(r, &witnesses); err != nil {
+		return err
+	}
+	if witnesses != 1 {
+		return messageError("Block.Decode", fmt.Sprintf("expected 1 witness, got %d", witnesses))
+	}
+	var err error
+	if h.Witness.InvocationScript, err = ReadVarBytes(r, pver, MaxTransactionSize, "invocation script"); err != nil {
+		return err
+	}
+	h.Witness.VerificationScript, err = ReadVarBytes(r, pver, MaxTransactionSize, "verification script")
+	return err
+}
+
+func (h *BlockHeader) encode(w io.Writer, pver uint32) error {
+	if err := h.encodeUnsigned(w); err != nil {
+		return err
+	}
+	if err := WriteElement(w, uint8(1)); err != nil {
+		return err
+	}
+	if err := WriteVarBytes(w, pver, h.Witness.InvocationScript); err != nil {
+		return err
+	}
+	return WriteVarBytes(w, pver, h.Witness.VerificationScript)
+}
+
+type Block struct {
+	BlockHeader
+	Transactions []*Transaction
+}
+
+// Size is the number of bytes of the serialized block
+func (b *Block) Size() int {
+	buf := &bytes.Buffer{}
+	b.Encode(buf, 0)
+	return buf.Len()
+}
+
+// ValidMerkleRoot tells whether the transactions are the ones the header commits to
+func (b *Block) ValidMerkleRoot() bool {
+	hashes := make([]Hash, len(b.Transactions))
+	for i, t := range b.Transactions {
+		hashes[i] = t.Hash()
+	}
+	return len(hashes) > 0 && MerkleRoot(hashes) == b.MerkleRoot
+}
+
+func (b *Block) Decode(r io.Reader, protocolVersion uint32) error {
+	if err := b.BlockHeader.decode(r, protocolVersion); err != nil {
+		return err
+	}
+	count, err := readCount(r, protocolVersion, MaxBlockTransactions, "transactions")
+	if err != nil {
+		return err
+	}
+	b.Transactions = make([]*Transaction, count)
+	for i := range b.Transactions {
+		b.Transactions[i] = &Transaction{}
+		if err := b.Transactions[i].Decode(r, protocolVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Block) Encode(w io.Writer, protocolVersion uint32) error {
+	if err := b.BlockHeader.encode(w, protocolVersion); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, protocolVersion, uint64(len(b.Transactions))); err != nil {
+		return err
+	}
+	for _, t := range b.Transactions {
+		if err := t.Encode(w, protocolVersion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MerkleRoot is the root of the tree whose leaves are the given hashes, a level with an odd
+// number of nodes pairs its last one with itself.
+func MerkleRoot(hashes []Hash) Hash {
+	if len(hashes) == 0 {
+		return Hash{}
+	}
+	level := append([]Hash{}, hashes...)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]Hash, len(level)/2)
+		for i := range next {
+			first := sha256.Sum256(append(level[2*i][:], level[2*i+1][:]...))
+			next[i] = Hash(sha256.Sum256(first[:]))
+		}
+		level = next
+	}
+	return level[0]
+}
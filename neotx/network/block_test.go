@@ -0,0 +1,75 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Block 5249790 of mainnet, the example of the readme
+const rawBlock = "00000000424fe99344c1a35cbafab6792b57e48e4596b3d8cadf99162dc2b34976c480f5ceb801ec0e1d252b9c9a9ed7360130b4ab073d5219dce62da87ad7f4727fb863259a725efe1a5000aa28e59cb267ee8f4e4e04879cfe60ba3b296b1ff08f112f6071756f01fd450140e3d5b93963011fce63ce0529dd105a87395babea4f5d5840110113a677584c99f51ce57196204bcbd73393a72998278bfdc30540b10d7a9e5e342b4265aea9d340bc2b3992246e0049645685d85b29b757ec3b5b0e249c038cd18ad682f8e18d438c9ff2b89cf63bd94cf26a6d16f23c9b377ad03c8fd07d076a73b9e801ab9c07406e254f902d5f648b68a7c0652bcf9b57b5dadb7c6d2d159514bde83b90e30433246efdc81e612c6ad1d8fab2f73c3382dccdc5d09536b1342f70a2d6493df5da40c0d3cfd4d3453e8e4c78cf53978e6adaf0f6bdf071bec8b912a9c8e5ff51f5fcf046096d8b2a88558cb5fe32371c709136a9b99624e8ff6029c8655f638a87bf40772752c328486cd0ed89a931c2613c81fee06e3a717c0f5b00f228d6f1b0192befada0d522fd943da8136f8992b0580aa61173c1867ca623dee558063c965a37f15521024c7b7fb6c310fccf1ba33b082519d82964ea93868d676662d4a59ad548df0e7d21025bdf3f181f53e9696227843950deb72dcd374ded17c057159513c3d0abe20b6421035e819642a8915a2572f972ddbdbe3042ae6437349295edce9bdc3b8884bbf9a32103b209fd4f53a7170ea4444e0cb0a6bb6a53c2bd016926989cf85f9b0fba17a70c2103b8d9d5771d8f513aa0869b9cc8d50986403b78c6da36890638c3d46a5adce04a2102ca0e27697b9c248f6f16e085fd0061e26f44da85b58ee835c110caa5ec3ba5542102df48f60e8f3e01c48ff40b9b7f1310d7a8b2a193188befe1c2e3df740e89509357ae060000aa28e59c00000000d1015a0500bea7d01414b197bb42bb224fe63c20bbc93dd1e183ae1cb120144649f940788c16c01e70d39e3613252ef7a58dbc53c1087472616e7366657267a9fe67930cdd180863395620af7a3f0109d2c0b7f166f470c61e6df75140000000000000000001204649f940788c16c01e70d39e3613252ef7a58dbc0000014140eab6fbbf8839314cd21118329f8bfc8048c99f1d77851e32a2fb6ffcf56c4cffb021d4b0fc0168af13b2a246566fedee0fa387fffcbc0eda2c5abe9b16f7f52b232102eb9704f6676a4e332b0a91057ddfe9bba4126b453e7104f9616f1a081e702694acd10159203236613166663031323834313564376166323737396438383038623534306238149a9763d8cd9d160af3162f44f50123afe58bca5652c10b7061794f7264657247617367a87c7976662f9b2012c2a5ace6a0dbd6f532d259000000000000000000019eb97a0b300f2c58e8d91bca9634734917dbd0ea0a46304c61c5f0c158508923010002e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60e803000000000000a87c7976662f9b2012c2a5ace6a0dbd6f532d259e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c6010de1a01000000009a9763d8cd9d160af3162f44f50123afe58bca560141403a16ac944a11ba2bc470257b8f7ad651e72ace4d8755c8b0a4947b288b4fe0e017215ffd97bf000c225fe8432204d196a16ec85daae5c7523d58e8ef2b97ed56232103fc8d713440a5febf9dbd6d61b96234453b5c7a75ba5841c5cf04ec4351a9e3d4acd10159203134366538636239363763346365623361623361366534353132336336303739143a36d8cd56c4dfbdf636a892ed786af4e4c695f352c10b7061794f7264657247617367a87c7976662f9b2012c2a5ace6a0dbd6f532d2590000000000000000000134bbdf6e63e3ca2a55faa73461f5cb7608140c3207a68292135004d5b52375ae010002e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60e803000000000000a87c7976662f9b2012c2a5ace6a0dbd6f532d259e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60d03b1b01000000003a36d8cd56c4dfbdf636a892ed786af4e4c695f3014140c870c95a84c5cc846c1ca5b09621d94d4d7343a44a6b3df3eaa2c8ec9a539232532f0f0668efa28669f531680d0419c346805c74e76fd7d7939fc55e9238c8242321028032387622db11004d901ac1bea972e0ca417e84c590cf031e7eaffed6e8498dac8000000134256eac1d7a9f5086cceea24a8c17ea5989063d10475fc730260a0d878f34a90000019b7cffdaa674beae0f930ebe6085af9093e5fe56b34a5c220ccdcf6efc336fc500b4f13501000000774aba48c85edda93ea3c2ae9d6830b5f25b78630141408e55b007686bf29cc8cdc2f65e7b5b448e2efe5a68e71c6f35f617edce8603fe376fa9d3edb6ed1295866fcc50db9f0ac7c5f14bf4b12fbd308cea47753896302321026c69fc74aaf06273d34fdc2d24382140155714f65901b83b34d3c99a7e4eaf85acd1015a050056218300144649f940788c16c01e70d39e3613252ef7a58dbc1459a6e5472a2d026c76e3cb76fc5d01aba86728a653c1087472616e73666572679bc8c394217f198608b06106d101dd1cac5a4b31f1666f3e3341286df7020000000000000000012059a6e5472a2d026c76e3cb76fc5d01aba86728a60000014140ba5421c8bb68385fc7d7a813acf61180fa04a984275a36586024d907f208af1e05af99e0f040c00ddfe26b02d16485ec724064bb03c3af00112f5f13f4bc8b5c23210366186cebdb804cfd4af553ab5ffceb6acc99326b312f8cb08e949f29134d8afcac"
+
+func TestBlockRoundTrip(t *testing.T) {
+	raw, _ := hex.DecodeString(rawBlock)
+	b := &Block{}
+	if err := b.Decode(bytes.NewBuffer(raw), 0); err != nil {
+		t.Fatal(err)
+	}
+	hash := b.Hash()
+	if h := hex.EncodeToString(hash.ToBytes()); h != "715c921fa65352b657afd8db82a1e65d7ea0cf6686fc30f3bf80a607cc6fff4d" {
+		t.Errorf("unexpected hash %s", h)
+	}
+	if b.Index != 5249790 || b.Timestamp != 1584568869 || b.ConsensusData != 0x8fee67b29ce528aa || len(b.Transactions) != 6 {
+		t.Errorf("unexpected header %+v", b.BlockHeader)
+	}
+	if tx := b.Transactions[5]; tx.Type != InvocationTransaction {
+		t.Errorf("unexpected last transaction %+v", tx)
+	}
+	if !b.ValidMerkleRoot() {
+		t.Error("the merkle root doesn't match the transactions")
+	}
+	if b.Size() != len(raw) {
+		t.Errorf("size %d, expected %d", b.Size(), len(raw))
+	}
+	var encoded bytes.Buffer
+	if err := b.Encode(&encoded, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded.Bytes(), raw) {
+		t.Errorf("encoded as %x", encoded.Bytes())
+	}
+
+	b.Transactions = b.Transactions[1:]
+	if b.ValidMerkleRoot() {
+		t.Error("a missing transaction should change the merkle root")
+	}
+}
+
+// The genesis block has four transactions, the merkle root is computed from their txids
+func TestGenesisBlockHash(t *testing.T) {
+	var hashes []Hash
+	for _, txid := range []string{
+		"fb5bd72b2d6792d75dc2f1084ffa9e9f70ca85543c717a6b13d9959b452a57d6",
+		"c56f33fc6ecfcd0c225c4ab356fee59390af8560be0e930faebe74a6daff7c9b",
+		"602c79718b16e442de58778e148d0b1084e3b2dffd5de6b7b16cee7969282de7",
+		"3631f66024ca6f5b033d7e0809eb993443374830025af904fb51b0334f127cda",
+	} {
+		b, _ := hex.DecodeString(txid)
+		var h Hash
+		for i := range h {
+			h[i] = b[len(b)-1-i]
+		}
+		hashes = append(hashes, h)
+	}
+	nextConsensus, _ := hex.DecodeString("59e75d652b5d3827bf04c165bbe9ef95cca4bf55")
+	header := BlockHeader{
+		MerkleRoot:    MerkleRoot(hashes),
+		Timestamp:     1468595301,
+		ConsensusData: 2083236893,
+	}
+	copy(header.NextConsensus[:], nextConsensus)
+	hash := header.Hash()
+	if h := hex.EncodeToString(hash.ToBytes()); h != "d42561e3d30e15be6400b6df2f328e02d2bf6354c41dce433bc57687c82144bf" {
+		t.Errorf("unexpected hash %s", h)
+	}
+}
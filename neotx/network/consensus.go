@@ -0,0 +1,193 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// http://docs.neo.org/en-us/basic/consensus/consensus_protocol.html
+
+// ConsensusPayload is the envelope of the dBFT messages the validators exchange
+type ConsensusPayload struct {
+	Version        uint32
+	PrevHash       Hash // Last block of the chain the validators agree on
+	BlockIndex     uint32
+	ValidatorIndex uint16
+	Timestamp      uint32
+	Data           []byte // Serialized ConsensusMessage
+	Witness        Witness
+}
+
+// Hash is the double SHA-256 of the payload without its witness
+func (p *ConsensusPayload) Hash() Hash {
+	buf := &bytes.Buffer{}
+	p.encodeUnsigned(buf, 0)
+	first := sha256.Sum256(buf.Bytes())
+	return Hash(sha256.Sum256(first[:]))
+}
+
+func (p *ConsensusPayload) encodeUnsigned(w io.Writer, pver uint32) error {
+	if err := writeElements(w, p.Version, p.PrevHash, p.BlockIndex, p.ValidatorIndex, p.Timestamp); err != nil {
+		return err
+	}
+	return WriteVarBytes(w, pver, p.Data)
+}
+
+func (p *ConsensusPayload) Decode(r io.Reader, protocolVersion uint32) error {
+	if err := ReadElements(r, &p.Version, &p.PrevHash, &p.BlockIndex, &p.ValidatorIndex, &p.Timestamp); err != nil {
+		return err
+	}
+	var err error
+	if p.Data, err = ReadVarBytes(r, protocolVersion, MaxTransactionSize, "consensus data"); err != nil {
+		return err
+	}
+	// Like blocks, payloads carry a list of witnesses that always has a single one
+	var witnesses uint8
+	if err := readElement(r, &witnesses); err != nil {
+		return err
+	}
+	if witnesses != 1 {
+		return messageError("ConsensusPayload.Decode", fmt.Sprintf("expected 1 witness, got %d", witnesses))
+	}
+	if p.Witness.InvocationScript, err = ReadVarBytes(r, protocolVersion, MaxTransactionSize, "invocation script"); err != nil {
+		return err
+	}
+	p.Witness.VerificationScript, err = ReadVarBytes(r, protocolVersion, MaxTransactionSize, "verification script")
+	return err
+}
+
+func (p *ConsensusPayload) Encode(w io.Writer, protocolVersion uint32) error {
+	if err := p.encodeUnsigned(w, protocolVersion); err != nil {
+		return err
+	}
+	if err := WriteElement(w, uint8(1)); err != nil {
+		return err
+	}
+	if err := WriteVarBytes(w, protocolVersion, p.Witness.InvocationScript); err != nil {
+		return err
+	}
+	return WriteVarBytes(w, protocolVersion, p.Witness.VerificationScript)
+}
+
+// Message decodes the data of the payload
+func (p *ConsensusPayload) Message() (*ConsensusMessage, error) {
+	m := &ConsensusMessage{}
+	if err := m.Decode(bytes.NewBuffer(p.Data), 0); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type ConsensusMessageType uint8
+
+// Message types of dBFT 1.0
+const (
+	ChangeViewMessage      ConsensusMessageType = 0x00
+	PrepareRequestMessage  ConsensusMessageType = 0x20
+	PrepareResponseMessage ConsensusMessageType = 0x21
+)
+
+var ConsensusMessageTypeString = map[ConsensusMessageType]string{
+	ChangeViewMessage:      "ChangeView",
+	PrepareRequestMessage:  "PrepareRequest",
+	PrepareResponseMessage: "PrepareResponse",
+}
+
+func (t ConsensusMessageType) String() string {
+	if s, ok := ConsensusMessageTypeString[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ConsensusMessageType: %d", uint32(t))
+}
+
+// ConsensusMessage is a dBFT 1.0 message, the fields of its type are filled and the others are left empty
+type ConsensusMessage struct {
+	Type       ConsensusMessageType
+	ViewNumber uint8
+
+	NewViewNumber uint8 // ChangeView
+
+	Nonce             uint64       // PrepareRequest
+	NextConsensus     UInt160      // PrepareRequest
+	TransactionHashes []Hash       // PrepareRequest, the first one is the miner transaction
+	MinerTransaction  *Transaction // PrepareRequest
+
+	Signature []byte // PrepareRequest and PrepareResponse, signature of the proposed block
+}
+
+const signatureSize = 64
+
+func (m *ConsensusMessage) Decode(r io.Reader, protocolVersion uint32) error {
+	if err := ReadElements(r, &m.Type, &m.ViewNumber); err != nil {
+		return err
+	}
+	switch m.Type {
+	case ChangeViewMessage:
+		return readElement(r, &m.NewViewNumber)
+	case PrepareRequestMessage:
+		if err := ReadElements(r, &m.Nonce, &m.NextConsensus); err != nil {
+			return err
+		}
+		count, err := readCount(r, protocolVersion, MaxBlockTransactions, "transaction hashes")
+		if err != nil {
+			return err
+		}
+		m.TransactionHashes = make([]Hash, count)
+		for i := range m.TransactionHashes {
+			if err := readElement(r, &m.TransactionHashes[i]); err != nil {
+				return err
+			}
+		}
+		m.MinerTransaction = &Transaction{}
+		if err := m.MinerTransaction.Decode(r, protocolVersion); err != nil {
+			return err
+		}
+		if m.MinerTransaction.Type != MinerTransaction {
+			return messageError("ConsensusMessage.Decode", "the proposal doesn't start with a MinerTransaction")
+		}
+		fallthrough
+	case PrepareResponseMessage:
+		m.Signature = make([]byte, signatureSize)
+		_, err := io.ReadFull(r, m.Signature)
+		return err
+	}
+	return messageError("ConsensusMessage.Decode", m.Type.String())
+}
+
+func (m *ConsensusMessage) Encode(w io.Writer, protocolVersion uint32) error {
+	if err := writeElements(w, m.Type, m.ViewNumber); err != nil {
+		return err
+	}
+	switch m.Type {
+	case ChangeViewMessage:
+		return WriteElement(w, m.NewViewNumber)
+	case PrepareRequestMessage:
+		if m.MinerTransaction == nil {
+			return messageError("ConsensusMessage.Encode", "PrepareRequest without a MinerTransaction")
+		}
+		if err := writeElements(w, m.Nonce, m.NextConsensus); err != nil {
+			return err
+		}
+		if err := WriteVarInt(w, protocolVersion, uint64(len(m.TransactionHashes))); err != nil {
+			return err
+		}
+		for _, h := range m.TransactionHashes {
+			if err := WriteElement(w, h); err != nil {
+				return err
+			}
+		}
+		if err := m.MinerTransaction.Encode(w, protocolVersion); err != nil {
+			return err
+		}
+		fallthrough
+	case PrepareResponseMessage:
+		if len(m.Signature) != signatureSize {
+			return messageError("ConsensusMessage.Encode", fmt.Sprintf("signature of %d bytes", len(m.Signature)))
+		}
+		_, err := w.Write(m.Signature)
+		return err
+	}
+	return messageError("ConsensusMessage.Encode", m.Type.String())
+}
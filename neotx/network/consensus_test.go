@@ -0,0 +1,59 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestConsensusRoundTrip(t *testing.T) {
+	raw, _ := hex.DecodeString(knownTransactions[4].raw)
+	miner := &Transaction{}
+	if err := miner.Decode(bytes.NewBuffer(raw), 0); err != nil {
+		t.Fatal(err)
+	}
+	signature := bytes.Repeat([]byte{0x5a}, 64)
+	messages := []*ConsensusMessage{
+		{Type: ChangeViewMessage, ViewNumber: 1, NewViewNumber: 2},
+		{Type: PrepareRequestMessage, Nonce: 0x8fee67b29ce528aa, NextConsensus: UInt160{0x59}, TransactionHashes: []Hash{miner.Hash(), {1}}, MinerTransaction: miner, Signature: signature},
+		{Type: PrepareResponseMessage, ViewNumber: 3, Signature: signature},
+	}
+	for _, m := range messages {
+		var data bytes.Buffer
+		if err := m.Encode(&data, 0); err != nil {
+			t.Fatalf("%v: %v", m.Type, err)
+		}
+		p := &ConsensusPayload{PrevHash: Hash{2}, BlockIndex: 5249790, ValidatorIndex: 4, Timestamp: 1584568869, Data: data.Bytes(),
+			Witness: Witness{InvocationScript: append([]byte{0x40}, signature...), VerificationScript: []byte{0x51}}}
+		var encoded bytes.Buffer
+		if err := p.Encode(&encoded, 0); err != nil {
+			t.Fatal(err)
+		}
+		decoded := &ConsensusPayload{}
+		if err := decoded.Decode(bytes.NewBuffer(encoded.Bytes()), 0); err != nil {
+			t.Fatalf("%v: %v", m.Type, err)
+		}
+		if !reflect.DeepEqual(p, decoded) || p.Hash() != decoded.Hash() {
+			t.Errorf("%v: decoded as %+v", m.Type, decoded)
+		}
+		message, err := decoded.Message()
+		if err != nil {
+			t.Fatalf("%v: %v", m.Type, err)
+		}
+		if message.Type != m.Type || message.ViewNumber != m.ViewNumber || message.NewViewNumber != m.NewViewNumber ||
+			!bytes.Equal(message.Signature, m.Signature) || !reflect.DeepEqual(message.TransactionHashes, m.TransactionHashes) {
+			t.Errorf("%v: decoded as %+v", m.Type, message)
+		}
+	}
+}
+
+func TestConsensusMessageRejectsUnknownTypes(t *testing.T) {
+	m := &ConsensusMessage{}
+	if err := m.Decode(bytes.NewBuffer([]byte{0x30, 0x00}), 0); err == nil {
+		t.Error("a message of an unknown type shouldn't be decoded")
+	}
+	if err := (&ConsensusMessage{Type: PrepareResponseMessage}).Encode(&bytes.Buffer{}, 0); err == nil {
+		t.Error("a response without a signature shouldn't be encoded")
+	}
+}
@@ -11,8 +11,38 @@ import "fmt"
 // differentiate between general io errors such as io.EOF and issues that
 // resulted from malformed messages.
 type MessageError struct {
-	Func        string // Function name
-	Description string // Human readable description of the issue
+	Func        string           // Function name
+	Description string           // Human readable description of the issue
+	Kind        MessageErrorKind // What is wrong with the message
+}
+
+// MessageErrorKind tells which part of a message is invalid, and so whether the stream it
+// comes from can be read further.
+type MessageErrorKind uint8
+
+const (
+	// The payload can't be decoded, the next message starts right after it
+	MalformedPayload MessageErrorKind = iota
+	// The header isn't of the expected network, the stream is probably out of sync
+	WrongMagic
+	// The header announces a payload larger than MaxMessagePayload, which is left unread
+	OversizedPayload
+	// The payload doesn't match the checksum of the header, the next message starts right after it
+	BadChecksum
+)
+
+var messageErrorKindString = map[MessageErrorKind]string{
+	MalformedPayload: "malformed payload",
+	WrongMagic:       "wrong magic",
+	OversizedPayload: "oversized payload",
+	BadChecksum:      "bad checksum",
+}
+
+func (k MessageErrorKind) String() string {
+	if s, ok := messageErrorKindString[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown MessageErrorKind: %d", uint8(k))
 }
 
 // Error satisfies the error interface and prints human-readable errors.
@@ -27,3 +57,8 @@ func (e *MessageError) Error() string {
 func messageError(f string, desc string) *MessageError {
 	return &MessageError{Func: f, Description: desc}
 }
+
+// framingError creates an error about the header or the checksum of a message.
+func framingError(f string, kind MessageErrorKind, desc string) *MessageError {
+	return &MessageError{Func: f, Description: desc, Kind: kind}
+}
@@ -63,3 +63,23 @@ func (v *Inv) Decode(r io.Reader, protocolVersion uint32) error {
 	}
 	return nil
 }
+
+// NewInvPayload announces inventories, the same payload asks for them in a getdata message
+func NewInvPayload(t InventoryType, hashes []Hash) *Inv {
+	return &Inv{Type: t, Hashes: hashes}
+}
+
+func (v *Inv) Encode(w io.Writer, protocolVersion uint32) error {
+	if err := WriteElement(w, v.Type); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, protocolVersion, uint64(len(v.Hashes))); err != nil {
+		return err
+	}
+	for _, h := range v.Hashes {
+		if err := binary.Write(w, binary.LittleEndian, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package network
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -13,6 +15,9 @@ import (
 // Production mode = 7630401
 type NEONetworkMagic uint32
 
+// NEOMagic is the magic of the main network
+const NEOMagic NEONetworkMagic = 7630401
+
 const (
 	// NEO message header is Magic(4) + Command(12) + Payload Legth(4) + Checksum(4)
 	MessageHeaderSize = 24
@@ -87,7 +92,36 @@ type MessageHeader struct {
 	Payload  []byte          // Length bytes
 }
 
-func ReadMessage(r io.Reader, payloadOutput PayloadInterface) (int, *MessageHeader, error) {
+// parseHeader decodes the fixed size part of a message
+func parseHeader(headerBytes []byte) *MessageHeader {
+	reader := bytes.NewReader(headerBytes)
+
+	message := MessageHeader{}
+	var command [CommandSize]byte
+	ReadElements(reader, &message.Magic, &command, &message.Length, &message.Checksum)
+	//Remove trailing zero
+	message.Command = string(bytes.TrimRight(command[:], "\x00"))
+	return &message
+}
+
+func (m *MessageHeader) checkLength(f string) error {
+	if m.Length > MaxMessagePayload {
+		return framingError(f, OversizedPayload, fmt.Sprintf("%s payload of %d bytes, max %d", m.Command, m.Length, MaxMessagePayload))
+	}
+	return nil
+}
+
+func (m *MessageHeader) checkPayload(f string, payload []byte) error {
+	if checksum := getChecksum(payload); checksum != binary.LittleEndian.Uint32(m.Checksum[:]) {
+		return framingError(f, BadChecksum, fmt.Sprintf("%s payload checksum %08x, header has %x", m.Command, checksum, m.Checksum))
+	}
+	return nil
+}
+
+// ReadMessage reads the header of a message of the network of magic, and its payload into
+// payloadOutput when it isn't nil. A header of another network, a payload that doesn't match
+// its checksum or can't be decoded are reported with a *MessageError.
+func ReadMessage(r io.Reader, magic NEONetworkMagic, payloadOutput PayloadInterface) (int, *MessageHeader, error) {
 
 	var headerBytes [MessageHeaderSize]byte
 
@@ -99,29 +133,95 @@ func ReadMessage(r io.Reader, payloadOutput PayloadInterface) (int, *MessageHead
 		return n, nil, err
 	}
 
-	reader := bytes.NewReader(headerBytes[:])
-
-	message := MessageHeader{}
-	var command [CommandSize]byte
-	ReadElements(reader, &message.Magic, &command, &message.Length, &message.Checksum)
-	//Remove trailing zero
-	message.Command = string(bytes.TrimRight(command[:], string(0)))
+	message := parseHeader(headerBytes[:])
+	if message.Magic != magic {
+		return n, nil, framingError("ReadMessage", WrongMagic, fmt.Sprintf("magic %d, expected %d", message.Magic, magic))
+	}
+	if err := message.checkLength("ReadMessage"); err != nil {
+		return n, nil, err
+	}
 
 	totalBytes := 0
 	totalBytes += n
 
-	//TODO validation, check size
 	if payloadOutput != nil {
 		payloadByte := make([]byte, message.Length)
 		n, err = io.ReadFull(r, payloadByte)
+		totalBytes += n
 		if err != nil {
-			return n, nil, err
+			return totalBytes, nil, err
+		}
+		if err := message.checkPayload("ReadMessage", payloadByte); err != nil {
+			return totalBytes, nil, err
 		}
-		totalBytes += n
 		pr := bytes.NewBuffer(payloadByte)
-		payloadOutput.Decode(pr, 0)
-		return totalBytes, &message, nil
+		if err := payloadOutput.Decode(pr, 0); err != nil {
+			return totalBytes, nil, framingError("ReadMessage", MalformedPayload, fmt.Sprintf("can't decode %s payload: %v", message.Command, err))
+		}
+		return totalBytes, message, nil
 	}
 
-	return n, &message, nil
+	return n, message, nil
+}
+
+// FrameReader reads the messages of a network from a stream, checking their magic, size and checksum
+type FrameReader struct {
+	r     *bufio.Reader
+	magic NEONetworkMagic
+}
+
+func NewFrameReader(r io.Reader, magic NEONetworkMagic) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), magic: magic}
+}
+
+// ReadMessage returns the next message with its payload. A header of another network is left
+// unread and the payload of an oversized message isn't read, Resync skips them.
+func (f *FrameReader) ReadMessage() (*MessageHeader, error) {
+	headerBytes, err := f.r.Peek(MessageHeaderSize)
+	if err != nil {
+		if err == io.EOF && len(headerBytes) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	message := parseHeader(headerBytes)
+	if message.Magic != f.magic {
+		return nil, framingError("FrameReader.ReadMessage", WrongMagic, fmt.Sprintf("magic %d, expected %d", message.Magic, f.magic))
+	}
+	f.r.Discard(MessageHeaderSize)
+	if err := message.checkLength("FrameReader.ReadMessage"); err != nil {
+		return nil, err
+	}
+	message.Payload = make([]byte, message.Length)
+	if _, err := io.ReadFull(f.r, message.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err := message.checkPayload("FrameReader.ReadMessage", message.Payload); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Resync skips bytes until the magic of the network comes next, it returns how many were skipped.
+// It gives up once more than a whole message of the maximum size is skipped.
+func (f *FrameReader) Resync() (int, error) {
+	var magic [MagicSize]byte
+	binary.LittleEndian.PutUint32(magic[:], uint32(f.magic))
+	skipped, err := f.r.Discard(1)
+	for err == nil && skipped <= MessageHeaderSize+MaxMessagePayload {
+		var next []byte
+		if next, err = f.r.Peek(MagicSize); err == nil && bytes.Equal(next, magic[:]) {
+			return skipped, nil
+		}
+		var n int
+		n, err = f.r.Discard(1)
+		skipped += n
+	}
+	if err != nil {
+		return skipped, err
+	}
+	return skipped, framingError("FrameReader.Resync", WrongMagic, fmt.Sprintf("no magic in %d bytes", skipped))
 }
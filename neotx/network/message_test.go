@@ -3,7 +3,9 @@ package network
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 )
@@ -19,7 +21,7 @@ func TestReadMessage(t *testing.T) {
 	b := NewMessage(NEOMagic, CommandGetAddr, nil)
 	reader := bytes.NewReader(b)
 
-	n, msg, err := ReadMessage(reader, nil)
+	n, msg, err := ReadMessage(reader, NEOMagic, nil)
 	fmt.Printf("n = %v\n msg =%v\n err=%v\n", n, msg, err)
 }
 
@@ -31,7 +33,7 @@ func TestNewMessageWithVersionpayload(t *testing.T) {
 
 	reader := bytes.NewReader(b)
 	out := &Version{}
-	n, msg, err := ReadMessage(reader, out)
+	n, msg, err := ReadMessage(reader, NEOMagic, out)
 	fmt.Printf("n = %v\n msg =%v\n out= %v\n err=%v\n", n, msg, out, err)
 }
 
@@ -53,7 +55,7 @@ func TestReadVersionFromNetwork(t *testing.T) {
 	//read version from peer
 	reader := bufio.NewReader(conn)
 	out := &Version{}
-	n, msg, err := ReadMessage(reader, out)
+	n, msg, err := ReadMessage(reader, NEOMagic, out)
 	fmt.Printf("n = %v\n msg =%v\n out= %v\n err=%v\n", n, msg, out, err)
 
 	//acknowledge the version
@@ -61,7 +63,7 @@ func TestReadVersionFromNetwork(t *testing.T) {
 	conn.Write(verack)
 
 	reader2 := bufio.NewReader(conn)
-	n2, msg2, err2 := ReadMessage(reader2, nil)
+	n2, msg2, err2 := ReadMessage(reader2, NEOMagic, nil)
 	fmt.Printf("\nn = %v\n msg =%v\n err=%v\n", n2, msg2, err2)
 
 	//getaddress
@@ -70,10 +72,104 @@ func TestReadVersionFromNetwork(t *testing.T) {
 
 	reader3 := bufio.NewReader(conn)
 	addr := &Addr{}
-	n3, msg3, err3 := ReadMessage(reader3, addr)
+	n3, msg3, err3 := ReadMessage(reader3, NEOMagic, addr)
 
 	fmt.Printf("\nn = %v\n msg =%v\n addr=%v\n err=%v\n", n3, msg3.Command, addr, err3)
 	for _, v := range addr.Addresses {
 		fmt.Printf("%v\n", v.Endpoint)
 	}
 }
+
+func messageErrorKind(t *testing.T, err error) MessageErrorKind {
+	merr, ok := err.(*MessageError)
+	if !ok {
+		t.Fatalf("expected a *MessageError, got %v", err)
+	}
+	return merr.Kind
+}
+
+func TestFrameReader(t *testing.T) {
+	ping := NewMessage(NEOMagic, CommandPing, NewPingPayload(7))
+	badChecksum := NewMessage(NEOMagic, CommandPing, NewPingPayload(8))
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	testnet := NewMessage(NEOMagic+1, CommandVerack, nil)
+
+	var stream bytes.Buffer
+	stream.Write(ping)
+	stream.Write(badChecksum)
+	stream.Write([]byte{0x01, 0x02, 0x03})
+	stream.Write(testnet)
+	stream.Write(ping)
+	f := NewFrameReader(&stream, NEOMagic)
+
+	msg, err := f.ReadMessage()
+	if err != nil || msg.Command != string(CommandPing) || len(msg.Payload) != int(msg.Length) {
+		t.Fatalf("unexpected message %+v: %v", msg, err)
+	}
+	_, err = f.ReadMessage()
+	if kind := messageErrorKind(t, err); kind != BadChecksum {
+		t.Fatalf("expected a bad checksum, got %v", kind)
+	}
+	// The payload was read, the stream is still in sync
+	_, err = f.ReadMessage()
+	if kind := messageErrorKind(t, err); kind != WrongMagic {
+		t.Fatalf("expected a wrong magic, got %v", kind)
+	}
+	skipped, err := f.Resync()
+	if err != nil || skipped != 3+len(testnet) {
+		t.Fatalf("skipped %d bytes: %v", skipped, err)
+	}
+	if msg, err := f.ReadMessage(); err != nil || msg.Command != string(CommandPing) {
+		t.Fatalf("unexpected message %+v after resyncing: %v", msg, err)
+	}
+	if _, err := f.ReadMessage(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestFrameReaderRejectsOversizedPayloads(t *testing.T) {
+	oversized := NewMessage(NEOMagic, CommandBlock, nil)
+	binary.LittleEndian.PutUint32(oversized[16:], MaxMessagePayload+1)
+	_, err := NewFrameReader(bytes.NewReader(oversized), NEOMagic).ReadMessage()
+	if kind := messageErrorKind(t, err); kind != OversizedPayload {
+		t.Errorf("expected an oversized payload, got %v", kind)
+	}
+	_, _, err = ReadMessage(bytes.NewReader(oversized), NEOMagic, nil)
+	if kind := messageErrorKind(t, err); kind != OversizedPayload {
+		t.Errorf("expected an oversized payload, got %v", kind)
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	ping := NewMessage(NEOMagic, CommandPing, NewPingPayload(7))
+	if _, _, err := ReadMessage(bytes.NewReader(ping), NEOMagic+1, nil); messageErrorKind(t, err) != WrongMagic {
+		t.Errorf("expected a wrong magic, got %v", err)
+	}
+	// A ping payload is too short for a version
+	n, _, err := ReadMessage(bytes.NewReader(ping), NEOMagic, &Version{})
+	if messageErrorKind(t, err) != MalformedPayload {
+		t.Errorf("expected a malformed payload, got %v", err)
+	}
+	if n != len(ping) {
+		t.Errorf("%d bytes read, expected %d", n, len(ping))
+	}
+	if _, msg, err := ReadMessage(bytes.NewReader(ping), NEOMagic, &Ping{}); err != nil || msg.Command != string(CommandPing) {
+		t.Errorf("unexpected message %+v, %v", msg, err)
+	}
+}
+
+func TestFrameReaderTruncatedMessage(t *testing.T) {
+	ping := NewMessage(NEOMagic, CommandPing, NewPingPayload(7))
+	for _, size := range []int{10, len(ping) - 1} {
+		if _, err := NewFrameReader(bytes.NewReader(ping[:size]), NEOMagic).ReadMessage(); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d bytes: expected an unexpected EOF, got %v", size, err)
+		}
+	}
+}
+
+func TestFrameReaderResyncAtEOF(t *testing.T) {
+	f := NewFrameReader(bytes.NewReader(make([]byte, 100)), NEOMagic)
+	if _, err := f.Resync(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
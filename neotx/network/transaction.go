@@ -0,0 +1,620 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// http://docs.neo.org/en-us/network/network-protocol.html#transaction
+
+type TransactionType uint8
+
+const (
+	MinerTransaction      TransactionType = 0x00
+	IssueTransaction      TransactionType = 0x01
+	ClaimTransaction      TransactionType = 0x02
+	EnrollmentTransaction TransactionType = 0x20
+	RegisterTransaction   TransactionType = 0x40
+	ContractTransaction   TransactionType = 0x80
+	StateTransaction      TransactionType = 0x90
+	PublishTransaction    TransactionType = 0xd0
+	InvocationTransaction TransactionType = 0xd1
+)
+
+var TransactionTypeString = map[TransactionType]string{
+	MinerTransaction:      "MinerTransaction",
+	IssueTransaction:      "IssueTransaction",
+	ClaimTransaction:      "ClaimTransaction",
+	EnrollmentTransaction: "EnrollmentTransaction",
+	RegisterTransaction:   "RegisterTransaction",
+	ContractTransaction:   "ContractTransaction",
+	StateTransaction:      "StateTransaction",
+	PublishTransaction:    "PublishTransaction",
+	InvocationTransaction: "InvocationTransaction",
+}
+
+func (t TransactionType) String() string {
+	if s, ok := TransactionTypeString[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown TransactionType: %d", uint32(t))
+}
+
+// Limits of the legacy protocol, anything larger is rejected while decoding
+const (
+	MaxTransactionAttributes = 16
+	MaxTransactionSize       = 102400
+	maxTransactionItems      = 65536 // inputs, outputs, claims and witnesses are indexed by a uint16
+)
+
+type AttributeUsage uint8
+
+const (
+	AttributeContractHash   AttributeUsage = 0x00
+	AttributeECDH02         AttributeUsage = 0x02
+	AttributeECDH03         AttributeUsage = 0x03
+	AttributeScript         AttributeUsage = 0x20
+	AttributeVote           AttributeUsage = 0x30
+	AttributeDescriptionURL AttributeUsage = 0x81
+	AttributeDescription    AttributeUsage = 0x90
+	AttributeHash1          AttributeUsage = 0xa1
+	AttributeHash15         AttributeUsage = 0xaf
+	AttributeRemark         AttributeUsage = 0xf0
+	AttributeRemark15       AttributeUsage = 0xff
+)
+
+// String returns the name NEO nodes use for the usage in their JSON-RPC responses
+func (u AttributeUsage) String() string {
+	switch {
+	case u == AttributeContractHash:
+		return "ContractHash"
+	case u == AttributeECDH02:
+		return "ECDH02"
+	case u == AttributeECDH03:
+		return "ECDH03"
+	case u == AttributeScript:
+		return "Script"
+	case u == AttributeVote:
+		return "Vote"
+	case u == AttributeDescriptionURL:
+		return "DescriptionUrl"
+	case u == AttributeDescription:
+		return "Description"
+	case u >= AttributeHash1 && u <= AttributeHash15:
+		return fmt.Sprintf("Hash%d", u-AttributeHash1+1)
+	case u == AttributeRemark:
+		return "Remark"
+	case u > AttributeRemark:
+		return fmt.Sprintf("Remark%d", u-AttributeRemark)
+	}
+	return fmt.Sprintf("Unknown AttributeUsage: %d", uint32(u))
+}
+
+// UInt160 is a script hash in the little endian order it is serialized in
+type UInt160 [20]byte
+
+// ToBytes returns the big endian bytes, the order script hashes are displayed in
+func (h *UInt160) ToBytes() []byte {
+	b := make([]byte, len(h))
+	for i := range h {
+		b[i] = h[len(h)-1-i]
+	}
+	return b
+}
+
+type TransactionAttribute struct {
+	Usage AttributeUsage
+	Data  []byte
+}
+
+// CoinReference points to an output of a previous transaction
+type CoinReference struct {
+	PrevHash  Hash
+	PrevIndex uint16
+}
+
+type TransactionOutput struct {
+	AssetID    Hash
+	Value      int64 // Fixed8, 1 unit is 10^-8
+	ScriptHash UInt160
+}
+
+type Witness struct {
+	InvocationScript   []byte
+	VerificationScript []byte
+}
+
+// AssetRegistration is the exclusive data of a RegisterTransaction
+type AssetRegistration struct {
+	AssetType uint8
+	Name      string
+	Amount    int64 // Fixed8
+	Precision uint8
+	Owner     []byte // Encoded ECPoint
+	Admin     UInt160
+}
+
+// StateDescriptor is an entry of a StateTransaction
+type StateDescriptor struct {
+	Type  uint8
+	Key   []byte
+	Field string
+	Value []byte
+}
+
+// ContractPublication is the exclusive data of a PublishTransaction
+type ContractPublication struct {
+	Script        []byte
+	ParameterList []byte
+	ReturnType    uint8
+	NeedStorage   bool // Only serialized from version 1
+	Name          string
+	CodeVersion   string
+	Author        string
+	Email         string
+	Description   string
+}
+
+// Transaction is a legacy (NEO 2.x) transaction, the field set depending on Type is filled
+// and the others are left empty.
+type Transaction struct {
+	Type    TransactionType
+	Version uint8
+
+	Nonce       uint32               // MinerTransaction
+	Claims      []CoinReference      // ClaimTransaction
+	PublicKey   []byte               // EnrollmentTransaction, encoded ECPoint
+	Asset       *AssetRegistration   // RegisterTransaction
+	Descriptors []StateDescriptor    // StateTransaction
+	Contract    *ContractPublication // PublishTransaction
+	Script      []byte               // InvocationTransaction
+	Gas         int64                // InvocationTransaction, Fixed8, only serialized from version 1
+
+	Attributes []TransactionAttribute
+	Inputs     []CoinReference
+	Outputs    []TransactionOutput
+	Witnesses  []Witness
+}
+
+// Hash is the double SHA-256 of the transaction without its witnesses, ToBytes gives the txid.
+// A transaction that can't be encoded hashes the part that could.
+func (t *Transaction) Hash() Hash {
+	buf := &bytes.Buffer{}
+	t.encodeUnsigned(buf, 0)
+	first := sha256.Sum256(buf.Bytes())
+	return Hash(sha256.Sum256(first[:]))
+}
+
+// Size is the number of bytes of the serialized transaction
+func (t *Transaction) Size() int {
+	buf := &bytes.Buffer{}
+	t.Encode(buf, 0)
+	return buf.Len()
+}
+
+func (t *Transaction) Decode(buf io.Reader, protocolVersion uint32) error {
+	if err := ReadElements(buf, &t.Type, &t.Version); err != nil {
+		return err
+	}
+	if err := t.decodeExclusiveData(buf, protocolVersion); err != nil {
+		return err
+	}
+
+	count, err := readCount(buf, protocolVersion, MaxTransactionAttributes, "attributes")
+	if err != nil {
+		return err
+	}
+	t.Attributes = make([]TransactionAttribute, count)
+	for i := range t.Attributes {
+		if err := decodeAttribute(buf, protocolVersion, &t.Attributes[i]); err != nil {
+			return err
+		}
+	}
+	if t.Inputs, err = decodeCoinReferences(buf, protocolVersion, "inputs"); err != nil {
+		return err
+	}
+	count, err = readCount(buf, protocolVersion, maxTransactionItems, "outputs")
+	if err != nil {
+		return err
+	}
+	t.Outputs = make([]TransactionOutput, count)
+	for i := range t.Outputs {
+		o := &t.Outputs[i]
+		if err := ReadElements(buf, &o.AssetID, &o.Value, &o.ScriptHash); err != nil {
+			return err
+		}
+	}
+
+	count, err = readCount(buf, protocolVersion, maxTransactionItems, "witnesses")
+	if err != nil {
+		return err
+	}
+	t.Witnesses = make([]Witness, count)
+	for i := range t.Witnesses {
+		w := &t.Witnesses[i]
+		if w.InvocationScript, err = ReadVarBytes(buf, protocolVersion, MaxTransactionSize, "invocation script"); err != nil {
+			return err
+		}
+		if w.VerificationScript, err = ReadVarBytes(buf, protocolVersion, MaxTransactionSize, "verification script"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Transaction) Encode(w io.Writer, protocolVersion uint32) error {
+	if err := t.encodeUnsigned(w, protocolVersion); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, protocolVersion, uint64(len(t.Witnesses))); err != nil {
+		return err
+	}
+	for _, witness := range t.Witnesses {
+		if err := WriteVarBytes(w, protocolVersion, witness.InvocationScript); err != nil {
+			return err
+		}
+		if err := WriteVarBytes(w, protocolVersion, witness.VerificationScript); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeUnsigned writes everything but the witnesses, the data signed and hashed
+func (t *Transaction) encodeUnsigned(w io.Writer, pver uint32) error {
+	if err := writeElements(w, t.Type, t.Version); err != nil {
+		return err
+	}
+	if err := t.encodeExclusiveData(w, pver); err != nil {
+		return err
+	}
+	if len(t.Attributes) > MaxTransactionAttributes {
+		return messageError("Transaction.Encode", fmt.Sprintf("too many attributes [count %d, max %d]", len(t.Attributes), MaxTransactionAttributes))
+	}
+	if err := WriteVarInt(w, pver, uint64(len(t.Attributes))); err != nil {
+		return err
+	}
+	for _, a := range t.Attributes {
+		if err := encodeAttribute(w, pver, a); err != nil {
+			return err
+		}
+	}
+	if err := encodeCoinReferences(w, pver, t.Inputs); err != nil {
+		return err
+	}
+	if err := WriteVarInt(w, pver, uint64(len(t.Outputs))); err != nil {
+		return err
+	}
+	for _, o := range t.Outputs {
+		if err := writeElements(w, o.AssetID, o.Value, o.ScriptHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Transaction) decodeExclusiveData(buf io.Reader, pver uint32) error {
+	var err error
+	switch t.Type {
+	case MinerTransaction:
+		return readElement(buf, &t.Nonce)
+	case IssueTransaction, ContractTransaction:
+		return nil
+	case ClaimTransaction:
+		t.Claims, err = decodeCoinReferences(buf, pver, "claims")
+		return err
+	case EnrollmentTransaction:
+		t.PublicKey, err = readECPoint(buf)
+		return err
+	case RegisterTransaction:
+		a := &AssetRegistration{}
+		if err = readElement(buf, &a.AssetType); err != nil {
+			return err
+		}
+		if a.Name, err = ReadVarString(buf, pver); err != nil {
+			return err
+		}
+		if err = ReadElements(buf, &a.Amount, &a.Precision); err != nil {
+			return err
+		}
+		if a.Owner, err = readECPoint(buf); err != nil {
+			return err
+		}
+		if err = readElement(buf, &a.Admin); err != nil {
+			return err
+		}
+		t.Asset = a
+		return nil
+	case StateTransaction:
+		count, err := readCount(buf, pver, maxTransactionItems, "descriptors")
+		if err != nil {
+			return err
+		}
+		t.Descriptors = make([]StateDescriptor, count)
+		for i := range t.Descriptors {
+			d := &t.Descriptors[i]
+			if err = readElement(buf, &d.Type); err != nil {
+				return err
+			}
+			if d.Key, err = ReadVarBytes(buf, pver, 100, "descriptor key"); err != nil {
+				return err
+			}
+			if d.Field, err = ReadVarString(buf, pver); err != nil {
+				return err
+			}
+			if d.Value, err = ReadVarBytes(buf, pver, 65535, "descriptor value"); err != nil {
+				return err
+			}
+		}
+		return nil
+	case PublishTransaction:
+		c := &ContractPublication{}
+		if c.Script, err = ReadVarBytes(buf, pver, MaxTransactionSize, "script"); err != nil {
+			return err
+		}
+		if c.ParameterList, err = ReadVarBytes(buf, pver, 252, "parameter list"); err != nil {
+			return err
+		}
+		if err = readElement(buf, &c.ReturnType); err != nil {
+			return err
+		}
+		if t.Version >= 1 {
+			if err = readElement(buf, &c.NeedStorage); err != nil {
+				return err
+			}
+		}
+		for _, s := range []*string{&c.Name, &c.CodeVersion, &c.Author, &c.Email, &c.Description} {
+			if *s, err = ReadVarString(buf, pver); err != nil {
+				return err
+			}
+		}
+		t.Contract = c
+		return nil
+	case InvocationTransaction:
+		if t.Script, err = ReadVarBytes(buf, pver, MaxTransactionSize, "script"); err != nil {
+			return err
+		}
+		if t.Version >= 1 {
+			if err = readElement(buf, &t.Gas); err != nil {
+				return err
+			}
+			if t.Gas < 0 {
+				return messageError("Transaction.Decode", "negative gas")
+			}
+		}
+		return nil
+	}
+	return messageError("Transaction.Decode", t.Type.String())
+}
+
+func (t *Transaction) encodeExclusiveData(w io.Writer, pver uint32) error {
+	switch t.Type {
+	case MinerTransaction:
+		return WriteElement(w, t.Nonce)
+	case IssueTransaction, ContractTransaction:
+		return nil
+	case ClaimTransaction:
+		return encodeCoinReferences(w, pver, t.Claims)
+	case EnrollmentTransaction:
+		return writeECPoint(w, t.PublicKey)
+	case RegisterTransaction:
+		a := t.Asset
+		if a == nil {
+			return messageError("Transaction.Encode", "RegisterTransaction without an asset")
+		}
+		if err := WriteElement(w, a.AssetType); err != nil {
+			return err
+		}
+		if err := WriteVarString(w, pver, a.Name); err != nil {
+			return err
+		}
+		if err := writeElements(w, a.Amount, a.Precision); err != nil {
+			return err
+		}
+		if err := writeECPoint(w, a.Owner); err != nil {
+			return err
+		}
+		return WriteElement(w, a.Admin)
+	case StateTransaction:
+		if err := WriteVarInt(w, pver, uint64(len(t.Descriptors))); err != nil {
+			return err
+		}
+		for _, d := range t.Descriptors {
+			if err := WriteElement(w, d.Type); err != nil {
+				return err
+			}
+			if err := WriteVarBytes(w, pver, d.Key); err != nil {
+				return err
+			}
+			if err := WriteVarString(w, pver, d.Field); err != nil {
+				return err
+			}
+			if err := WriteVarBytes(w, pver, d.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case PublishTransaction:
+		c := t.Contract
+		if c == nil {
+			return messageError("Transaction.Encode", "PublishTransaction without a contract")
+		}
+		if err := WriteVarBytes(w, pver, c.Script); err != nil {
+			return err
+		}
+		if err := WriteVarBytes(w, pver, c.ParameterList); err != nil {
+			return err
+		}
+		if err := WriteElement(w, c.ReturnType); err != nil {
+			return err
+		}
+		if t.Version >= 1 {
+			if err := WriteElement(w, c.NeedStorage); err != nil {
+				return err
+			}
+		}
+		for _, s := range []string{c.Name, c.CodeVersion, c.Author, c.Email, c.Description} {
+			if err := WriteVarString(w, pver, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case InvocationTransaction:
+		if err := WriteVarBytes(w, pver, t.Script); err != nil {
+			return err
+		}
+		if t.Version >= 1 {
+			return WriteElement(w, t.Gas)
+		}
+		return nil
+	}
+	return messageError("Transaction.Encode", t.Type.String())
+}
+
+func readCount(r io.Reader, pver uint32, max uint64, field string) (uint64, error) {
+	count, err := ReadVarInt(r, pver)
+	if err != nil {
+		return 0, err
+	}
+	if count > max {
+		return 0, messageError("Transaction.Decode", fmt.Sprintf("too many %s [count %d, max %d]", field, count, max))
+	}
+	return count, nil
+}
+
+func decodeCoinReferences(r io.Reader, pver uint32, field string) ([]CoinReference, error) {
+	count, err := readCount(r, pver, maxTransactionItems, field)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]CoinReference, count)
+	for i := range refs {
+		if err := ReadElements(r, &refs[i].PrevHash, &refs[i].PrevIndex); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+func encodeCoinReferences(w io.Writer, pver uint32, refs []CoinReference) error {
+	if err := WriteVarInt(w, pver, uint64(len(refs))); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := writeElements(w, ref.PrevHash, ref.PrevIndex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeAttribute(r io.Reader, pver uint32, a *TransactionAttribute) error {
+	if err := readElement(r, &a.Usage); err != nil {
+		return err
+	}
+	var err error
+	switch u := a.Usage; {
+	case attributeSize(u) > 0:
+		a.Data = make([]byte, attributeSize(u))
+		_, err = io.ReadFull(r, a.Data)
+	case u == AttributeDescriptionURL:
+		var length uint8
+		if err = readElement(r, &length); err != nil {
+			return err
+		}
+		a.Data = make([]byte, length)
+		_, err = io.ReadFull(r, a.Data)
+	case u == AttributeDescription || u >= AttributeRemark:
+		a.Data, err = ReadVarBytes(r, pver, 65535, "attribute")
+	default:
+		return messageError("Transaction.Decode", a.Usage.String())
+	}
+	return err
+}
+
+// attributeSize is the length of the data of the usages that have a fixed one, 0 for the others
+func attributeSize(u AttributeUsage) int {
+	switch {
+	case u == AttributeContractHash || u == AttributeVote || (u >= AttributeHash1 && u <= AttributeHash15):
+		return 32
+	case u == AttributeECDH02 || u == AttributeECDH03:
+		// The usage is the prefix of the compressed public key, only its X coordinate follows
+		return 32
+	case u == AttributeScript:
+		return 20
+	}
+	return 0
+}
+
+func encodeAttribute(w io.Writer, pver uint32, a TransactionAttribute) error {
+	if err := WriteElement(w, a.Usage); err != nil {
+		return err
+	}
+	switch u := a.Usage; {
+	case attributeSize(u) > 0:
+		if len(a.Data) != attributeSize(u) {
+			return messageError("Transaction.Encode", fmt.Sprintf("%v attribute of %d bytes, expected %d", u, len(a.Data), attributeSize(u)))
+		}
+	case u == AttributeDescriptionURL:
+		if len(a.Data) > 255 {
+			return messageError("Transaction.Encode", "DescriptionUrl attribute longer than 255 bytes")
+		}
+		if err := WriteElement(w, uint8(len(a.Data))); err != nil {
+			return err
+		}
+	case u == AttributeDescription || u >= AttributeRemark:
+		return WriteVarBytes(w, pver, a.Data)
+	default:
+		return messageError("Transaction.Encode", u.String())
+	}
+	_, err := w.Write(a.Data)
+	return err
+}
+
+// readECPoint reads a public key in its encoded form: 0x00 for the point at infinity,
+// 0x02 or 0x03 followed by X, or 0x04 followed by X and Y.
+func readECPoint(r io.Reader) ([]byte, error) {
+	var prefix uint8
+	if err := readElement(r, &prefix); err != nil {
+		return nil, err
+	}
+	var size int
+	switch prefix {
+	case 0x00:
+		return []byte{0x00}, nil
+	case 0x02, 0x03:
+		size = 32
+	case 0x04:
+		size = 64
+	default:
+		return nil, messageError("readECPoint", fmt.Sprintf("invalid point encoding %#x", prefix))
+	}
+	point := make([]byte, 1+size)
+	point[0] = prefix
+	_, err := io.ReadFull(r, point[1:])
+	return point, err
+}
+
+func writeECPoint(w io.Writer, point []byte) error {
+	if len(point) == 0 {
+		return messageError("writeECPoint", "empty point")
+	}
+	var size int
+	switch point[0] {
+	case 0x00:
+		size = 0
+	case 0x02, 0x03:
+		size = 32
+	case 0x04:
+		size = 64
+	default:
+		return messageError("writeECPoint", fmt.Sprintf("invalid point encoding %#x", point[0]))
+	}
+	if len(point) != 1+size {
+		return messageError("writeECPoint", fmt.Sprintf("point of %d bytes, expected %d", len(point), 1+size))
+	}
+	_, err := w.Write(point)
+	return err
+}
@@ -0,0 +1,184 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Transactions of the genesis block, of block 5249790 (the example of the readme), the one the
+// neorpc tests send (without the 20 bytes that follow it there) and signed claim and state
+// transactions whose witnesses verify against their txid.
+var knownTransactions = []struct {
+	name string
+	txid string
+	raw  string
+}{
+	{
+		"genesis MinerTransaction",
+		"fb5bd72b2d6792d75dc2f1084ffa9e9f70ca85543c717a6b13d9959b452a57d6",
+		"00001dac2b7c00000000",
+	},
+	{
+		"genesis RegisterTransaction of NEO",
+		"c56f33fc6ecfcd0c225c4ab356fee59390af8560be0e930faebe74a6daff7c9b",
+		"400000455b7b226c616e67223a227a682d434e222c226e616d65223a22e5b08fe89a81e882a1227d2c7b226c616e67223a22656e222c226e616d65223a22416e745368617265227d5d0000c16ff28623000000da1745e9b549bd0bfa1a569971c77eba30cd5a4b00000000",
+	},
+	{
+		"genesis IssueTransaction",
+		"3631f66024ca6f5b033d7e0809eb993443374830025af904fb51b0334f127cda",
+		"01000000019b7cffdaa674beae0f930ebe6085af9093e5fe56b34a5c220ccdcf6efc336fc50000c16ff28623005fa99d93303775fe50ca119c327759313eccfa1c01000151",
+	},
+	{
+		"InvocationTransaction of the neorpc tests",
+		"9078ef003438cf478f3eb1ca82c2f2ce0cf546e20e1222011980c4a20c5e0a7e",
+		"d1004208e8030000000000001423ba2703c53263e8d6e522dc32203339dcd8eee952c10c6d696e74546f6b656e73546f671b245557dc34b4ac60c5200d335361bbe15a57ce01f11e74686973697361756e69717565746f6b656e5f66726f6d5f73747269706501e216181b1f9a773f93064af30be44679f34ec878788afa1727aa60057eb39a96000001e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60010000000000000023ba2703c53263e8d6e522dc32203339dcd8eee9014140f55e2b2914c409396904b8c5a1e8ec0ffc0b62f8b1b996beae7c65ceca7e11a3dbab011038b948ec380c5b22ba474f013ca6de61051dda487a5bec17196115412321031a6c6fbbdf02ca351745fa86b9ba5a9452d785ac4f7fc2b7548ca2a46c4fcf4aac",
+	},
+	{
+		"MinerTransaction of block 5249790",
+		"47e026ec2366be9ab834eb262f21311d28bd6cdfc90b3876e4f5c49d510f3c31",
+		"0000aa28e59c00000000",
+	},
+	{
+		"InvocationTransaction version 1 with a script attribute",
+		"086b9af57f2c621894327f95c581f4050d3f96ce818d2b13a473e4ea98aae4f7",
+		"d1015a0500bea7d01414b197bb42bb224fe63c20bbc93dd1e183ae1cb120144649f940788c16c01e70d39e3613252ef7a58dbc53c1087472616e7366657267a9fe67930cdd180863395620af7a3f0109d2c0b7f166f470c61e6df75140000000000000000001204649f940788c16c01e70d39e3613252ef7a58dbc0000014140eab6fbbf8839314cd21118329f8bfc8048c99f1d77851e32a2fb6ffcf56c4cffb021d4b0fc0168af13b2a246566fedee0fa387fffcbc0eda2c5abe9b16f7f52b232102eb9704f6676a4e332b0a91057ddfe9bba4126b453e7104f9616f1a081e702694ac",
+	},
+	{
+		"InvocationTransaction version 1 with inputs and outputs",
+		"56028d91ec5630151a9725422ce2dd5a42da04a20e4359402cefd868bef681c9",
+		"d10159203236613166663031323834313564376166323737396438383038623534306238149a9763d8cd9d160af3162f44f50123afe58bca5652c10b7061794f7264657247617367a87c7976662f9b2012c2a5ace6a0dbd6f532d259000000000000000000019eb97a0b300f2c58e8d91bca9634734917dbd0ea0a46304c61c5f0c158508923010002e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60e803000000000000a87c7976662f9b2012c2a5ace6a0dbd6f532d259e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c6010de1a01000000009a9763d8cd9d160af3162f44f50123afe58bca560141403a16ac944a11ba2bc470257b8f7ad651e72ace4d8755c8b0a4947b288b4fe0e017215ffd97bf000c225fe8432204d196a16ec85daae5c7523d58e8ef2b97ed56232103fc8d713440a5febf9dbd6d61b96234453b5c7a75ba5841c5cf04ec4351a9e3d4ac",
+	},
+	{
+		"ClaimTransaction",
+		"2c6a45547b3898318e400e541628990a07acb00f3b9a15a8e966ae49525304da",
+		"020004bc67ba325d6412ff4c55b10f7e9afb54bbb2228d201b37363c3d697ac7c198f70300591cd454d7318d2087c0196abfbbd1573230380672f0f0cd004dcb4857e58cbd010031bcfbed573f5318437e95edd603922a4455ff3326a979fdd1c149a84c4cb0290000b51eb6159c58cac4fe23d90e292ad2bcb7002b0da2c474e81e1889c0649d2c490000000001e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c603b555f00000000005d9de59d99c0d1f6ed1496444473f4a0b538302f014140456349cec43053009accdb7781b0799c6b591c812768804ab0a0b56b5eae7a97694227fcd33e70899c075848b2cee8fae733faac6865b484d3f7df8949e2aadb232103945fae1ed3c31d778f149192b76734fcc951b400ba3598faa81ff92ebe477eacac",
+	},
+	{
+		"StateTransaction registering a validator",
+		"8abf5ebdb9a8223b12109513647f45bd3c0a6cf1a6346d56684cff71ba308724",
+		"900001482103c089d7122b840a4935234e82e26ae5efd0c2acb627239dc9f207311337b6f2c10a5265676973746572656401010001cb4184f0a96e72656c1fbdd4f75cca567519e909fd43cefcec13d6c6abcb92a1000001e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c6000b8fb050109000071f9cf7f0ec74ec0b0f28a92b12e1081574c0af00141408780d7b3c0aadc5398153df5e2f1cf159db21b8b0f34d3994d865433f79fafac41683783c48aef510b67660e3157b701b9ca4dd9946a385d578fba7dd26f4849232103c089d7122b840a4935234e82e26ae5efd0c2acb627239dc9f207311337b6f2c1ac",
+	},
+	{
+		"ContractTransaction",
+		"c72ba18597b99a76fb15701d7667926846ede86f0125e4b7222b81857d09c6e5",
+		"8000000134256eac1d7a9f5086cceea24a8c17ea5989063d10475fc730260a0d878f34a90000019b7cffdaa674beae0f930ebe6085af9093e5fe56b34a5c220ccdcf6efc336fc500b4f13501000000774aba48c85edda93ea3c2ae9d6830b5f25b78630141408e55b007686bf29cc8cdc2f65e7b5b448e2efe5a68e71c6f35f617edce8603fe376fa9d3edb6ed1295866fcc50db9f0ac7c5f14bf4b12fbd308cea47753896302321026c69fc74aaf06273d34fdc2d24382140155714f65901b83b34d3c99a7e4eaf85ac",
+	},
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	for _, v := range knownTransactions {
+		raw, _ := hex.DecodeString(v.raw)
+		tx := &Transaction{}
+		if err := tx.Decode(bytes.NewBuffer(raw), 0); err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		hash := tx.Hash()
+		if txid := hex.EncodeToString(hash.ToBytes()); txid != v.txid {
+			t.Errorf("%s: txid %s, expected %s", v.name, txid, v.txid)
+		}
+		if tx.Size() != len(raw) {
+			t.Errorf("%s: size %d, expected %d", v.name, tx.Size(), len(raw))
+		}
+		var encoded bytes.Buffer
+		if err := tx.Encode(&encoded, 0); err != nil {
+			t.Errorf("%s: %v", v.name, err)
+		} else if !bytes.Equal(encoded.Bytes(), raw) {
+			t.Errorf("%s: encoded as %x", v.name, encoded.Bytes())
+		}
+	}
+}
+
+func TestTransactionDecodeFields(t *testing.T) {
+	raw, _ := hex.DecodeString(knownTransactions[2].raw)
+	tx := &Transaction{}
+	if err := tx.Decode(bytes.NewBuffer(raw), 0); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Type != IssueTransaction || len(tx.Outputs) != 1 || len(tx.Witnesses) != 1 {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+	out := tx.Outputs[0]
+	asset := hex.EncodeToString(out.AssetID.ToBytes())
+	if asset != knownTransactions[1].txid || out.Value != 100000000*100000000 {
+		t.Errorf("unexpected output %+v", out)
+	}
+	if !bytes.Equal(tx.Witnesses[0].VerificationScript, []byte{0x51}) {
+		t.Errorf("unexpected witness %+v", tx.Witnesses[0])
+	}
+}
+
+// The types missing from the known transactions are encoded and decoded back
+func TestTransactionTypesRoundTrip(t *testing.T) {
+	key := append([]byte{0x02}, bytes.Repeat([]byte{0xab}, 32)...)
+	witnesses := []Witness{{InvocationScript: bytes.Repeat([]byte{0x01}, 65), VerificationScript: append(append([]byte{0x21}, key...), 0xac)}}
+	outputs := []TransactionOutput{{AssetID: Hash{0xe7, 0x2d}, Value: 150000000, ScriptHash: UInt160{0x23, 0xba}}}
+	txs := []*Transaction{
+		{Type: ClaimTransaction, Claims: []CoinReference{{Hash{1}, 0}, {Hash{2}, 3}}, Outputs: outputs, Witnesses: witnesses},
+		{Type: EnrollmentTransaction, PublicKey: key, Inputs: []CoinReference{{Hash{3}, 1}}, Witnesses: witnesses},
+		{Type: StateTransaction, Descriptors: []StateDescriptor{{Type: 0x48, Key: key, Field: "Registered", Value: []byte{0x01}}}, Witnesses: witnesses},
+		{Type: PublishTransaction, Contract: &ContractPublication{Script: []byte{0x51, 0x66}, ParameterList: []byte{0x07, 0x10}, ReturnType: 0x05, Name: "name", CodeVersion: "1.0", Author: "author", Email: "email", Description: "description"}},
+		{Type: PublishTransaction, Version: 1, Contract: &ContractPublication{Script: []byte{0x51, 0x66}, ParameterList: []byte{}, NeedStorage: true}},
+		{Type: InvocationTransaction, Version: 1, Script: []byte{0x51}, Gas: 100000000, Attributes: []TransactionAttribute{
+			{Usage: AttributeScript, Data: bytes.Repeat([]byte{0x23}, 20)},
+			{Usage: AttributeHash1 + 2, Data: bytes.Repeat([]byte{0x01}, 32)},
+			{Usage: AttributeECDH03, Data: bytes.Repeat([]byte{0x02}, 32)},
+			{Usage: AttributeDescriptionURL, Data: []byte("https://neo.org")},
+			{Usage: AttributeDescription, Data: []byte("description")},
+			{Usage: AttributeRemark15, Data: []byte{}},
+		}},
+	}
+	for _, tx := range txs {
+		var encoded bytes.Buffer
+		if err := tx.Encode(&encoded, 0); err != nil {
+			t.Errorf("%v: %v", tx.Type, err)
+			continue
+		}
+		raw := encoded.Bytes()
+		decoded := &Transaction{}
+		if err := decoded.Decode(bytes.NewBuffer(raw), 0); err != nil {
+			t.Errorf("%v: %v", tx.Type, err)
+			continue
+		}
+		normalize(tx)
+		normalize(decoded)
+		if !reflect.DeepEqual(tx, decoded) {
+			t.Errorf("%v: decoded as %+v", tx.Type, decoded)
+		}
+		if tx.Hash() != decoded.Hash() || tx.Size() != len(raw) {
+			t.Errorf("%v: the hash or the size changed", tx.Type)
+		}
+	}
+}
+
+// normalize replaces the nil lists of a transaction by empty ones, like decoding does
+func normalize(tx *Transaction) {
+	if tx.Attributes == nil {
+		tx.Attributes = []TransactionAttribute{}
+	}
+	if tx.Inputs == nil {
+		tx.Inputs = []CoinReference{}
+	}
+	if tx.Outputs == nil {
+		tx.Outputs = []TransactionOutput{}
+	}
+	if tx.Witnesses == nil {
+		tx.Witnesses = []Witness{}
+	}
+}
+
+func TestTransactionEncodeRejectsInvalidData(t *testing.T) {
+	invalid := []*Transaction{
+		{Type: InvocationTransaction, Attributes: []TransactionAttribute{{Usage: AttributeScript, Data: []byte{1}}}},
+		{Type: RegisterTransaction},
+		{Type: EnrollmentTransaction, PublicKey: []byte{0x05}},
+		{Type: TransactionType(0x03)},
+	}
+	for _, tx := range invalid {
+		if err := tx.Encode(&bytes.Buffer{}, 0); err == nil {
+			t.Errorf("%+v shouldn't be encoded", tx)
+		}
+	}
+}
@@ -56,6 +56,12 @@ func (v *Version) Decode(r io.Reader, protocolVersion uint32) error {
 	}
 
 	userAgent, err := ReadVarString(buf, 0)
+	if err != nil {
+		return err
+	}
+	if len(userAgent) > MaxUserAgentLength {
+		return messageError("Version.Decode", fmt.Sprintf("user agent too long [len %d, max %d]", len(userAgent), MaxUserAgentLength))
+	}
 	v.UserAgent = userAgent
 
 	err = readElement(buf, &v.StartHeight)
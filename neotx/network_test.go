@@ -0,0 +1,310 @@
+package neotx
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+// scriptedNode runs script on every connection once the version of the client is read
+func scriptedNode(t *testing.T, script func(conn net.Conn, v *network.Version)) (net.Listener, Config) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				v := &network.Version{}
+				if _, msg, err := network.ReadMessage(conn, testMagic, v); err != nil || msg.Command != string(network.CommandVersion) {
+					return
+				}
+				script(conn, v)
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portInt, _ := strconv.Atoi(port)
+	return l, Config{Network: testMagic, IPAddress: host, Port: uint16(portInt)}
+}
+
+// handshake answers the version of the client like a node does
+func handshake(conn net.Conn, v *network.Version) {
+	conn.Write(network.NewMessage(testMagic, network.CommandVersion, v))
+	conn.Write(network.NewMessage(testMagic, network.CommandVerack, nil))
+}
+
+type clientRecorder struct {
+	connected chan network.Version
+	errors    chan error
+}
+
+func newClientRecorder() *clientRecorder {
+	return &clientRecorder{connected: make(chan network.Version, 4), errors: make(chan error, 4)}
+}
+
+func (r *clientRecorder) OnReceive(TX) {}
+
+func (r *clientRecorder) OnConnected(v network.Version) {
+	r.connected <- v
+}
+
+func (r *clientRecorder) OnError(err error) {
+	r.errors <- err
+}
+
+func (r *clientRecorder) err(t *testing.T) error {
+	select {
+	case err := <-r.errors:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection didn't fail")
+		return nil
+	}
+}
+
+func startClient(config Config, r *clientRecorder) *Client {
+	c := NewClient(config)
+	c.SetDelegate(r)
+	go c.Start(context.Background())
+	return c
+}
+
+func TestClientHandshake(t *testing.T) {
+	verack := make(chan bool, 1)
+	l, config := scriptedNode(t, func(conn net.Conn, v *network.Version) {
+		node := network.NewVersionPayload(10333, v.Nonce+1)
+		node.UserAgent, node.StartHeight, node.Relay = "/Neo:2.10.3/", 5249790, false
+		handshake(conn, node)
+		_, msg, err := network.ReadMessage(conn, testMagic, nil)
+		verack <- err == nil && msg.Command == string(network.CommandVerack)
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer l.Close()
+	r := newClientRecorder()
+	c := startClient(config, r)
+	defer c.Close()
+
+	select {
+	case v := <-r.connected:
+		if v.UserAgent != "/Neo:2.10.3/" || v.StartHeight != 5249790 || v.Relay {
+			t.Errorf("unexpected version %+v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake wasn't completed")
+	}
+	if !<-verack {
+		t.Error("the version of the node wasn't acknowledged")
+	}
+	if c.State() != StateEstablished || c.RemoteVersion().StartHeight != 5249790 {
+		t.Errorf("state %v, remote version %+v", c.State(), c.RemoteVersion())
+	}
+	c.Close()
+	if c.State() != StateClosing {
+		t.Errorf("state %v after Close", c.State())
+	}
+}
+
+func TestClientDetectsSelfConnections(t *testing.T) {
+	l, config := scriptedNode(t, func(conn net.Conn, v *network.Version) {
+		handshake(conn, v)
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer l.Close()
+	r := newClientRecorder()
+	defer startClient(config, r).Close()
+	if err := r.err(t); err != ErrSelfConnection {
+		t.Errorf("expected a self connection, got %v", err)
+	}
+}
+
+func TestClientRejectsMessagesBeforeTheHandshake(t *testing.T) {
+	l, config := scriptedNode(t, func(conn net.Conn, v *network.Version) {
+		conn.Write(network.NewMessage(testMagic, network.CommandInv, network.NewInvPayload(network.InventotyTypeTX, []network.Hash{{1}})))
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer l.Close()
+	r := newClientRecorder()
+	defer startClient(config, r).Close()
+	if err := r.err(t); err == nil || !strings.Contains(err.Error(), "unexpected inv") {
+		t.Errorf("expected the inv to be rejected, got %v", err)
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	silent := func(conn net.Conn, v *network.Version) {
+		io.Copy(ioutil.Discard, conn)
+	}
+	handshakeOnly := func(conn net.Conn, v *network.Version) {
+		handshake(conn, network.NewVersionPayload(10333, v.Nonce+1))
+		io.Copy(ioutil.Discard, conn)
+	}
+	for name, script := range map[string]func(net.Conn, *network.Version){"handshake not completed": silent, "no message received": handshakeOnly} {
+		l, config := scriptedNode(t, script)
+		config.HandshakeTimeout, config.IdleTimeout = 100*time.Millisecond, 200*time.Millisecond
+		r := newClientRecorder()
+		c := startClient(config, r)
+		if err := r.err(t); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expected %q, got %v", name, err)
+		}
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestClientIgnoresDuplicatedVeracks(t *testing.T) {
+	pings := make(chan int, 1)
+	l, config := scriptedNode(t, func(conn net.Conn, v *network.Version) {
+		handshake(conn, network.NewVersionPayload(10333, v.Nonce+1))
+		for i := 0; i < 3; i++ {
+			conn.Write(network.NewMessage(testMagic, network.CommandVerack, nil))
+		}
+		count, deadline := 0, time.Now().Add(550*time.Millisecond)
+		for {
+			_, msg, err := network.ReadMessage(conn, testMagic, nil)
+			if err != nil {
+				return
+			}
+			io.CopyN(ioutil.Discard, conn, int64(msg.Length))
+			if msg.Command != string(network.CommandPing) {
+				continue
+			}
+			conn.Write(network.NewMessage(testMagic, network.CommandPong, network.NewPingPayload(0)))
+			if count++; time.Now().After(deadline) {
+				pings <- count
+				deadline = time.Now().Add(time.Hour)
+			}
+		}
+	})
+	defer l.Close()
+	config.IdleTimeout = 300 * time.Millisecond
+	r := newClientRecorder()
+	defer startClient(config, r).Close()
+
+	// A ping every 100ms, 4 times as many if every verack started a ping loop
+	if count := <-pings; count > 8 {
+		t.Errorf("%d pings sent", count)
+	}
+	select {
+	case err := <-r.errors:
+		t.Errorf("the connection failed: %v", err)
+	default:
+	}
+}
+
+// waitForGoroutines fails the test unless the goroutines started since the baseline are over
+func waitForGoroutines(t *testing.T, baseline int) {
+	waitFor(t, "the goroutines to exit", func() bool { return runtime.NumGoroutine() <= baseline })
+}
+
+func TestClientStopsWithItsContext(t *testing.T) {
+	l, config := scriptedNode(t, func(conn net.Conn, v *network.Version) {
+		handshake(conn, network.NewVersionPayload(10333, v.Nonce+1))
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer l.Close()
+	baseline := runtime.NumGoroutine()
+	config.IdleTimeout = 300 * time.Millisecond
+	r := newClientRecorder()
+	c := NewClient(config)
+	c.SetDelegate(r)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.Start(ctx) }()
+
+	select {
+	case <-r.connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake wasn't completed")
+	}
+	// Let the ping loop run a few times
+	time.Sleep(150 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Errorf("Start returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return")
+	}
+	if c.State() != StateClosing {
+		t.Errorf("state %v after cancelling", c.State())
+	}
+	select {
+	case err := <-r.errors:
+		t.Errorf("the cancellation was reported: %v", err)
+	default:
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestClientReconnects(t *testing.T) {
+	// The node drops the first connection right after the handshake and keeps the second one
+	var connections int32
+	l, config := scriptedNode(t, func(conn net.Conn, v *network.Version) {
+		handshake(conn, network.NewVersionPayload(10333, v.Nonce+1))
+		if atomic.AddInt32(&connections, 1) == 1 {
+			network.ReadMessage(conn, testMagic, nil)
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer l.Close()
+	baseline := runtime.NumGoroutine()
+	config.Reconnect, config.ReconnectDelay = true, 10*time.Millisecond
+	r := newClientRecorder()
+	c := NewClient(config)
+	c.SetDelegate(r)
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.Start(context.Background()) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-r.connected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d wasn't established", i+1)
+		}
+	}
+	if err := r.err(t); err == nil {
+		t.Error("the lost connection wasn't reported")
+	}
+	c.Close()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Start returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return")
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestClientReportsWriteErrors(t *testing.T) {
+	client, node := net.Pipe()
+	c := NewClient(Config{Network: testMagic})
+	r := newClientRecorder()
+	c.SetDelegate(r)
+	c.connection, c.done = client, make(chan struct{})
+	go c.handleConnection()
+	// The version is written but the node closes the connection before reading it
+	node.Close()
+	if err := r.err(t); err == nil || !strings.Contains(err.Error(), "can't write") {
+		t.Errorf("expected the write error, got %v", err)
+	}
+}
@@ -0,0 +1,595 @@
+package neotx
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+const (
+	DefaultMaxPeers     = 3
+	DefaultSeenTTL      = 10 * time.Minute
+	DefaultRetryDelay   = 5 * time.Second
+	MaxRetryDelay       = time.Minute
+	DefaultFetchTimeout = 10 * time.Second
+	addressBookSaving   = time.Minute
+)
+
+type PeerManagerConfig struct {
+	Network    network.NEONetworkMagic
+	Peers      []string      // Candidate nodes as host:port
+	MaxPeers   int           // Simultaneous connections, at most one per candidate
+	SeenTTL    time.Duration // How long an announced inventory is remembered
+	RetryDelay time.Duration // Wait before a connection slot picks another candidate, doubled after every failed attempt up to MaxRetryDelay
+
+	// Request announced transactions, blocks and consensus payloads with getdata from the peer that announced them
+	// first, then from the other peers that announced them if it doesn't deliver
+	FetchTransactions bool
+	FetchBlocks       bool
+	FetchConsensus    bool
+	FetchTimeout      time.Duration // Wait for a requested inventory before giving up on it
+
+	Framing       FramingPolicy // What the connections do with messages whose header or checksum is invalid
+	MaxViolations int           // Framing violations resynced on a connection, DefaultMaxViolations when 0
+
+	HandshakeTimeout time.Duration // To connect to a peer and exchange versions, DefaultHandshakeTimeout when 0
+	IdleTimeout      time.Duration // Without any message from a connected peer, DefaultIdleTimeout when 0
+
+	// Nodes announced by the peers, they are connected to once the configured ones are taken or
+	// unreachable. Nil disables discovery.
+	AddressBook *AddressBook
+}
+
+// PeerDelegate receives what the peers of a PeerManager announce, each inventory only once
+type PeerDelegate interface {
+	// OnReceive is called for the first announcement of an inventory, tx.Peer is the peer that sent it
+	OnReceive(tx TX)
+	OnConnected(peer string, v network.Version)
+	// OnDisconnected is called when a connection that reached OnConnected is lost
+	OnDisconnected(peer string, err error)
+	// OnTransaction receives the transactions fetched when FetchTransactions is set
+	OnTransaction(peer string, tx *network.Transaction)
+	// OnBlock receives the blocks fetched when FetchBlocks is set
+	OnBlock(peer string, b *network.Block)
+	// OnConsensus receives the consensus payloads fetched when FetchConsensus is set
+	OnConsensus(peer string, p *network.ConsensusPayload)
+	// OnFetchFailed is called when an announced inventory couldn't be fetched from any of the peers that announced it
+	OnFetchFailed(tx TX)
+	// OnViolation is called for every invalid message a peer sends
+	OnViolation(peer string, err *network.MessageError)
+}
+
+// PeerManager keeps connections to several nodes at once so the mempool seen is the union
+// of their views. Every lost connection is replaced by one to the next candidate.
+type PeerManager struct {
+	config   PeerManagerConfig
+	delegate PeerDelegate
+	seen     *seenSet
+
+	fetchMutex sync.Mutex
+	fetching   map[network.Hash]*fetch // Requested inventories, by hash
+
+	mu         sync.Mutex
+	peers      []string
+	next       int                // Next candidate to try
+	active     map[string]*Client // Connected or connecting, by peer
+	violations map[string]int     // Invalid messages sent over every connection, by peer
+	closed     bool
+	ctx        context.Context // Cancelled by Close, aborts the connections being opened
+	cancel     context.CancelFunc
+	workers    sync.WaitGroup // Connection slots and the saving of the address book
+	done       chan struct{}
+}
+
+func NewPeerManager(config PeerManagerConfig, delegate PeerDelegate) (*PeerManager, error) {
+	for _, peer := range config.Peers {
+		if _, err := peerConfig(config.Network, peer); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxPeers <= 0 {
+		config.MaxPeers = DefaultMaxPeers
+	}
+	if config.SeenTTL <= 0 {
+		config.SeenTTL = DefaultSeenTTL
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = DefaultRetryDelay
+	}
+	if config.FetchTimeout <= 0 {
+		config.FetchTimeout = DefaultFetchTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PeerManager{
+		ctx:        ctx,
+		cancel:     cancel,
+		config:     config,
+		delegate:   delegate,
+		seen:       newSeenSet(config.SeenTTL),
+		fetching:   map[network.Hash]*fetch{},
+		peers:      append([]string{}, config.Peers...),
+		active:     map[string]*Client{},
+		violations: map[string]int{},
+		done:       make(chan struct{}),
+	}, nil
+}
+
+func peerConfig(magic network.NEONetworkMagic, peer string) (Config, error) {
+	host, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		return Config{}, err
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid port in %q", peer)
+	}
+	return Config{Network: magic, IPAddress: host, Port: uint16(portInt)}, nil
+}
+
+// Start opens the connections, it returns right away
+func (m *PeerManager) Start() {
+	for i := 0; i < m.config.MaxPeers; i++ {
+		m.workers.Add(1)
+		go m.keepConnected()
+	}
+	if m.config.AddressBook != nil {
+		m.workers.Add(1)
+		go m.saveAddressBookLoop()
+	}
+}
+
+// saveAddressBookLoop writes the discovered addresses to disk regularly, Close saves them a last time
+func (m *PeerManager) saveAddressBookLoop() {
+	defer m.workers.Done()
+	ticker := time.NewTicker(addressBookSaving)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.saveAddressBook()
+		}
+	}
+}
+
+func (m *PeerManager) saveAddressBook() {
+	if m.config.AddressBook == nil {
+		return
+	}
+	if err := m.config.AddressBook.Save(); err != nil {
+		log.Printf("can't save the address book: %v", err)
+	}
+}
+
+// SetPeers replaces the candidates, the open connections are kept until they are lost
+func (m *PeerManager) SetPeers(peers []string) error {
+	for _, peer := range peers {
+		if _, err := peerConfig(m.config.Network, peer); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	m.peers = append([]string{}, peers...)
+	m.next = 0
+	m.mu.Unlock()
+	return nil
+}
+
+// Peers returns the peers currently connected or being connected to
+func (m *PeerManager) Peers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	peers := []string{}
+	for peer := range m.active {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Versions returns the version each connected peer sent during the handshake
+func (m *PeerManager) Versions() map[string]network.Version {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions := map[string]network.Version{}
+	for peer, c := range m.active {
+		if c.State() == StateEstablished {
+			versions[peer] = c.RemoteVersion()
+		}
+	}
+	return versions
+}
+
+// Violations returns how many invalid messages each peer sent since the manager was started
+func (m *PeerManager) Violations() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	violations := make(map[string]int, len(m.violations))
+	for peer, count := range m.violations {
+		violations[peer] = count
+	}
+	return violations
+}
+
+// Close disconnects from every peer and returns once every goroutine of the manager is over, so
+// it can't be called from the delegate. The delegate isn't notified of the lost connections.
+func (m *PeerManager) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	m.cancel()
+	close(m.done)
+	for _, c := range m.active {
+		c.Close()
+	}
+	m.mu.Unlock()
+
+	m.fetchMutex.Lock()
+	for hash, f := range m.fetching {
+		f.timer.Stop()
+		delete(m.fetching, hash)
+	}
+	m.fetchMutex.Unlock()
+	m.workers.Wait()
+	m.saveAddressBook()
+}
+
+// keepConnected is a connection slot, it goes through the candidates until one accepts the
+// connection and moves on to the next one when it is lost. The wait between attempts grows while
+// they fail, so unreachable candidates aren't dialed in a tight loop.
+func (m *PeerManager) keepConnected() {
+	defer m.workers.Done()
+	delay := m.config.RetryDelay
+	for {
+		peer, client, ok := m.acquire()
+		if !ok {
+			return
+		}
+		connected := false
+		if client != nil {
+			conn := &peerConnection{manager: m, peer: peer, client: client}
+			book := m.config.AddressBook
+			if book != nil {
+				book.RecordAttempt(peer)
+				client.SetDelegate(&discoveringConnection{conn})
+			} else {
+				client.SetDelegate(conn)
+			}
+			err := client.Start(m.ctx)
+			m.release(peer)
+			connected = conn.finish()
+			if !connected && book != nil && !m.isClosed() {
+				book.RecordFailure(peer)
+			}
+			if connected {
+				if err == nil {
+					err = conn.lastError()
+				}
+				if err == nil {
+					err = fmt.Errorf("connection to %s lost", peer)
+				}
+				if !m.isClosed() {
+					m.delegate.OnDisconnected(peer, err)
+				}
+			} else if err != nil && !m.isClosed() {
+				log.Printf("can't connect to %s: %v", peer, err)
+			}
+		}
+		if connected {
+			delay = m.config.RetryDelay
+		}
+		select {
+		case <-m.done:
+			return
+		case <-time.After(delay):
+		}
+		if !connected && delay < MaxRetryDelay {
+			if delay *= 2; delay > MaxRetryDelay {
+				delay = MaxRetryDelay
+			}
+		}
+	}
+}
+
+// acquire picks the next candidate nobody is connected to, client is nil when there is none
+func (m *PeerManager) acquire() (string, *Client, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return "", nil, false
+	}
+	candidates := m.candidates()
+	for i := 0; i < len(candidates); i++ {
+		peer := candidates[(m.next+i)%len(candidates)]
+		if _, busy := m.active[peer]; busy {
+			continue
+		}
+		config, err := peerConfig(m.config.Network, peer)
+		if err != nil {
+			continue
+		}
+		config.Framing, config.MaxViolations = m.config.Framing, m.config.MaxViolations
+		config.HandshakeTimeout, config.IdleTimeout = m.config.HandshakeTimeout, m.config.IdleTimeout
+		m.next = (m.next + i + 1) % len(candidates)
+		client := NewClient(config)
+		m.active[peer] = client
+		return peer, client, true
+	}
+	return "", nil, true
+}
+
+// candidates are the configured peers followed by the ones of the address book, it must be called with the mutex held
+func (m *PeerManager) candidates() []string {
+	if m.config.AddressBook == nil {
+		return m.peers
+	}
+	candidates := append([]string{}, m.peers...)
+	configured := map[string]bool{}
+	for _, peer := range m.peers {
+		configured[peer] = true
+	}
+	for _, address := range m.config.AddressBook.Candidates(m.config.RetryDelay) {
+		if !configured[address] {
+			candidates = append(candidates, address)
+		}
+	}
+	return candidates
+}
+
+func (m *PeerManager) release(peer string) {
+	m.mu.Lock()
+	delete(m.active, peer)
+	m.mu.Unlock()
+}
+
+func (m *PeerManager) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// fetch is an inventory requested from one of the peers that announced it
+type fetch struct {
+	tx     TX
+	timer  *time.Timer
+	from   *peerConnection   // Asked for the inventory
+	others []*peerConnection // Announced it too, asked in turn when the request fails
+}
+
+// fetches tells whether announced inventories of a type are requested
+func (m *PeerManager) fetches(t network.InventoryType) bool {
+	switch t {
+	case network.InventotyTypeTX:
+		return m.config.FetchTransactions
+	case network.InventotyTypeBlock:
+		return m.config.FetchBlocks
+	case network.InventotyTypeConsensus:
+		return m.config.FetchConsensus
+	}
+	return false
+}
+
+// startFetch requests an announced inventory from the peer that announced it
+func (m *PeerManager) startFetch(c *peerConnection, tx TX) {
+	f := &fetch{tx: tx, from: c}
+	m.fetchMutex.Lock()
+	f.timer = time.AfterFunc(m.config.FetchTimeout, func() { m.fetchFailed(tx.Hash, c) })
+	m.fetching[tx.Hash] = f
+	m.fetchMutex.Unlock()
+	if err := c.client.GetData(tx.Type, tx.Hash); err != nil {
+		m.fetchFailed(tx.Hash, c)
+	}
+}
+
+// addAnnouncer records another peer that announced an inventory being fetched
+func (m *PeerManager) addAnnouncer(hash network.Hash, c *peerConnection) {
+	m.fetchMutex.Lock()
+	defer m.fetchMutex.Unlock()
+	f, ok := m.fetching[hash]
+	if !ok || f.from == c {
+		return
+	}
+	for _, other := range f.others {
+		if other == c {
+			return
+		}
+	}
+	f.others = append(f.others, c)
+}
+
+// endFetch returns the pending request of a transaction, nil if it was already answered or given up on
+func (m *PeerManager) endFetch(hash network.Hash) *fetch {
+	m.fetchMutex.Lock()
+	defer m.fetchMutex.Unlock()
+	f, ok := m.fetching[hash]
+	if !ok {
+		return nil
+	}
+	delete(m.fetching, hash)
+	f.timer.Stop()
+	return f
+}
+
+// fetchFailed is called when peer didn't deliver an inventory it was asked for, the next peer that
+// announced it is asked instead. OnFetchFailed is called once none is left.
+func (m *PeerManager) fetchFailed(hash network.Hash, peer *peerConnection) {
+	closed := m.isClosed()
+	m.fetchMutex.Lock()
+	f, ok := m.fetching[hash]
+	if !ok || f.from != peer {
+		// Already delivered, or asked from another peer
+		m.fetchMutex.Unlock()
+		return
+	}
+	f.timer.Stop()
+	if closed || len(f.others) == 0 {
+		delete(m.fetching, hash)
+		m.fetchMutex.Unlock()
+		if !closed {
+			m.delegate.OnFetchFailed(f.tx)
+		}
+		return
+	}
+	next := f.others[0]
+	f.from, f.others = next, f.others[1:]
+	f.timer = time.AfterFunc(m.config.FetchTimeout, func() { m.fetchFailed(hash, next) })
+	m.fetchMutex.Unlock()
+	if err := next.client.GetData(f.tx.Type, hash); err != nil {
+		m.fetchFailed(hash, next)
+	}
+}
+
+// peerConnection is the delegate of the client connected to a peer
+type peerConnection struct {
+	manager *PeerManager
+	peer    string
+	client  *Client
+
+	mu        sync.Mutex
+	connected bool
+	finished  bool
+	err       error
+}
+
+func (c *peerConnection) OnReceive(tx TX) {
+	fetches := c.manager.fetches(tx.Type)
+	if !c.manager.seen.add(fmt.Sprintf("%d:%s", tx.Type, tx.ID), time.Now()) {
+		if fetches {
+			c.manager.addAnnouncer(tx.Hash, c)
+		}
+		return
+	}
+	tx.Peer = c.peer
+	c.manager.delegate.OnReceive(tx)
+	if fetches {
+		c.manager.startFetch(c, tx)
+	}
+}
+
+func (c *peerConnection) OnTransaction(t *network.Transaction) {
+	// Transactions nobody asked for, or that arrive after their request timed out, are ignored
+	if c.manager.endFetch(t.Hash()) != nil {
+		c.manager.delegate.OnTransaction(c.peer, t)
+	}
+}
+
+func (c *peerConnection) OnBlock(b *network.Block) {
+	if c.manager.endFetch(b.Hash()) != nil {
+		c.manager.delegate.OnBlock(c.peer, b)
+	}
+}
+
+func (c *peerConnection) OnNotFound(inv network.Inv) {
+	for _, hash := range inv.Hashes {
+		c.manager.fetchFailed(hash, c)
+	}
+}
+
+func (c *peerConnection) OnConsensus(p *network.ConsensusPayload) {
+	if c.manager.endFetch(p.Hash()) != nil {
+		c.manager.delegate.OnConsensus(c.peer, p)
+	}
+}
+
+func (c *peerConnection) OnConnected(v network.Version) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		// The connection was lost before the delegate could be told about it
+		return
+	}
+	c.connected = true
+	if book := c.manager.config.AddressBook; book != nil {
+		book.RecordSuccess(c.peer, v.Services, c.client.Latency())
+	}
+	c.manager.delegate.OnConnected(c.peer, v)
+}
+
+func (c *peerConnection) OnError(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+func (c *peerConnection) OnViolation(err *network.MessageError) {
+	c.manager.mu.Lock()
+	c.manager.violations[c.peer]++
+	c.manager.mu.Unlock()
+	if !c.manager.isClosed() {
+		c.manager.delegate.OnViolation(c.peer, err)
+	}
+}
+
+// finish is called once the connection is over, it returns whether the delegate was told it was connected
+func (c *peerConnection) finish() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finished = true
+	return c.connected
+}
+
+func (c *peerConnection) lastError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// discoveringConnection also asks its peer for the addresses of other nodes
+type discoveringConnection struct {
+	*peerConnection
+}
+
+func (c *discoveringConnection) OnAddr(addr network.Addr) {
+	if added := c.manager.config.AddressBook.Add(addr.Addresses); added > 0 {
+		log.Printf("%s announced %d new nodes", c.peer, added)
+	}
+}
+
+// seenSet remembers keys for at least ttl and at most twice as long. Keys go into the current
+// generation, which replaces the previous one every ttl.
+type seenSet struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	current  map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+}
+
+func newSeenSet(ttl time.Duration) *seenSet {
+	return &seenSet{
+		ttl:      ttl,
+		current:  map[string]struct{}{},
+		previous: map[string]struct{}{},
+		rotated:  time.Now(),
+	}
+}
+
+// add records a key, it returns false if it had already been seen
+func (s *seenSet) add(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elapsed := now.Sub(s.rotated); elapsed >= 2*s.ttl {
+		s.previous, s.current = map[string]struct{}{}, map[string]struct{}{}
+		s.rotated = now
+	} else if elapsed >= s.ttl {
+		s.previous, s.current = s.current, map[string]struct{}{}
+		s.rotated = now
+	}
+	if _, ok := s.current[key]; ok {
+		return false
+	}
+	if _, ok := s.previous[key]; ok {
+		return false
+	}
+	s.current[key] = struct{}{}
+	return true
+}
@@ -0,0 +1,686 @@
+package neotx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+const testMagic network.NEONetworkMagic = 56753
+
+// fakePeer is a node that completes the handshake, sends the messages it is given and
+// answers getdata with the inventories it holds.
+type fakePeer struct {
+	listener  net.Listener
+	conns     chan net.Conn
+	txs       map[network.Hash][]byte
+	blocks    map[network.Hash][]byte
+	consensus map[network.Hash][]byte
+	addrs     []*network.NetWorkAddressWithTime // Sent in answer to getaddr
+	silent    bool                              // getdata is left unanswered
+}
+
+func newFakePeer(t *testing.T) *fakePeer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePeer{listener: l, conns: make(chan net.Conn, 4), txs: map[network.Hash][]byte{}, blocks: map[network.Hash][]byte{}, consensus: map[network.Hash][]byte{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakePeer) serve(conn net.Conn) {
+	_, msg, err := network.ReadMessage(conn, testMagic, nil)
+	if err != nil || msg.Command != string(network.CommandVersion) {
+		conn.Close()
+		return
+	}
+	io.CopyN(ioutil.Discard, conn, int64(msg.Length))
+	conn.Write(network.NewMessage(testMagic, network.CommandVersion, network.NewVersionPayload(20333, 1)))
+	conn.Write(network.NewMessage(testMagic, network.CommandVerack, nil))
+	p.conns <- conn
+	for {
+		_, msg, err := network.ReadMessage(conn, testMagic, nil)
+		if err != nil {
+			return
+		}
+		payload := make([]byte, msg.Length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		if msg.Command == string(network.CommandGetAddr) {
+			conn.Write(network.NewMessage(testMagic, network.CommandAddr, &network.Addr{Addresses: p.addrs}))
+			continue
+		}
+		if msg.Command != string(network.CommandGetData) || p.silent {
+			continue
+		}
+		inv := &network.Inv{}
+		inv.Decode(bytes.NewBuffer(payload), 0)
+		held, command := p.txs, network.CommandTx
+		switch inv.Type {
+		case network.InventotyTypeBlock:
+			held, command = p.blocks, network.CommandBlock
+		case network.InventotyTypeConsensus:
+			held, command = p.consensus, network.CommandConsensus
+		}
+		for _, hash := range inv.Hashes {
+			if raw, ok := held[hash]; ok {
+				conn.Write(network.NewMessage(testMagic, command, rawPayload(raw)))
+			} else {
+				conn.Write(network.NewMessage(testMagic, network.CommandNotfound, network.NewInvPayload(inv.Type, []network.Hash{hash})))
+			}
+		}
+	}
+}
+
+// rawPayload sends bytes that are already serialized
+type rawPayload []byte
+
+func (p rawPayload) Encode(w io.Writer, protocolVersion uint32) error {
+	_, err := w.Write(p)
+	return err
+}
+
+func (p rawPayload) Decode(r io.Reader, protocolVersion uint32) error {
+	return nil
+}
+
+func (p *fakePeer) address() string {
+	return p.listener.Addr().String()
+}
+
+// connection waits for the client to complete the handshake
+func (p *fakePeer) connection(t *testing.T) net.Conn {
+	select {
+	case conn := <-p.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client didn't connect")
+		return nil
+	}
+}
+
+func (p *fakePeer) announce(conn net.Conn, t network.InventoryType, hashes ...network.Hash) {
+	conn.Write(network.NewMessage(testMagic, network.CommandInv, network.NewInvPayload(t, hashes)))
+}
+
+type recorder struct {
+	mu           sync.Mutex
+	received     []TX
+	connected    map[string]bool
+	disconnected chan string
+	lostErr      error // Error of the last disconnection
+	fetched      chan *network.Transaction
+	blocks       chan *network.Block
+	consensus    chan *network.ConsensusPayload
+	failed       chan TX
+	violations   []network.MessageErrorKind
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		connected:    map[string]bool{},
+		disconnected: make(chan string, 4),
+		fetched:      make(chan *network.Transaction, 4),
+		blocks:       make(chan *network.Block, 4),
+		consensus:    make(chan *network.ConsensusPayload, 4),
+		failed:       make(chan TX, 4),
+	}
+}
+
+func (r *recorder) OnTransaction(peer string, tx *network.Transaction) {
+	r.fetched <- tx
+}
+
+func (r *recorder) OnBlock(peer string, b *network.Block) {
+	r.blocks <- b
+}
+
+func (r *recorder) OnConsensus(peer string, p *network.ConsensusPayload) {
+	r.consensus <- p
+}
+
+func (r *recorder) OnFetchFailed(tx TX) {
+	r.failed <- tx
+}
+
+func (r *recorder) OnViolation(peer string, err *network.MessageError) {
+	r.mu.Lock()
+	r.violations = append(r.violations, err.Kind)
+	r.mu.Unlock()
+}
+
+func (r *recorder) violationKinds() []network.MessageErrorKind {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]network.MessageErrorKind{}, r.violations...)
+}
+
+func (r *recorder) OnReceive(tx TX) {
+	r.mu.Lock()
+	r.received = append(r.received, tx)
+	r.mu.Unlock()
+}
+
+func (r *recorder) OnConnected(peer string, v network.Version) {
+	r.mu.Lock()
+	r.connected[peer] = true
+	r.mu.Unlock()
+}
+
+func (r *recorder) OnDisconnected(peer string, err error) {
+	r.mu.Lock()
+	r.lostErr = err
+	r.mu.Unlock()
+	r.disconnected <- peer
+}
+
+func (r *recorder) isConnected(peer string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.connected[peer]
+}
+
+func (r *recorder) txs() []TX {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]TX{}, r.received...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestPeerManagerDeduplicates(t *testing.T) {
+	a, b := newFakePeer(t), newFakePeer(t)
+	defer a.listener.Close()
+	defer b.listener.Close()
+	r := newRecorder()
+	m, err := NewPeerManager(PeerManagerConfig{Network: testMagic, Peers: []string{a.address(), b.address()}, MaxPeers: 2}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	defer m.Close()
+	connA, connB := a.connection(t), b.connection(t)
+
+	shared, onlyB := network.Hash{1}, network.Hash{2}
+	a.announce(connA, network.InventotyTypeTX, shared)
+	waitFor(t, "the first announcement", func() bool { return len(r.txs()) == 1 })
+	b.announce(connB, network.InventotyTypeTX, shared, onlyB)
+	waitFor(t, "the second announcement", func() bool { return len(r.txs()) == 2 })
+	a.announce(connA, network.InventotyTypeTX, onlyB)
+	time.Sleep(100 * time.Millisecond)
+
+	txs := r.txs()
+	if len(txs) != 2 {
+		t.Fatalf("expected 2 inventories, got %+v", txs)
+	}
+	if txs[0].ID != strings.Repeat("00", 31)+"01" || txs[0].Peer != a.address() {
+		t.Errorf("unexpected first inventory %+v", txs[0])
+	}
+	if txs[1].Peer != b.address() {
+		t.Errorf("the second inventory should be attributed to %s, got %+v", b.address(), txs[1])
+	}
+}
+
+func TestPeerManagerReplacesLostPeers(t *testing.T) {
+	a, b := newFakePeer(t), newFakePeer(t)
+	defer a.listener.Close()
+	defer b.listener.Close()
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{
+		Network:    testMagic,
+		Peers:      []string{a.address(), b.address()},
+		MaxPeers:   1,
+		RetryDelay: 10 * time.Millisecond,
+	}, r)
+	m.Start()
+	defer m.Close()
+
+	conn := a.connection(t)
+	waitFor(t, "the connection", func() bool { return r.isConnected(a.address()) })
+	conn.Close()
+	select {
+	case peer := <-r.disconnected:
+		if peer != a.address() {
+			t.Errorf("expected %s to be reported, got %s", a.address(), peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lost connection wasn't reported")
+	}
+	// The error that ended the connection reaches the delegate, not a generic one
+	r.mu.Lock()
+	lostErr := r.lostErr
+	r.mu.Unlock()
+	if lostErr != io.EOF {
+		t.Errorf("the connection was reported lost with %v", lostErr)
+	}
+	b.connection(t)
+	if peers := m.Peers(); len(peers) != 1 || peers[0] != b.address() {
+		t.Errorf("expected to be connected to %s, got %v", b.address(), peers)
+	}
+}
+
+// Invocation transaction sent by the neorpc tests
+const rawInvocation = "d1004208e8030000000000001423ba2703c53263e8d6e522dc32203339dcd8eee952c10c6d696e74546f6b656e73546f671b245557dc34b4ac60c5200d335361bbe15a57ce01f11e74686973697361756e69717565746f6b656e5f66726f6d5f73747269706501e216181b1f9a773f93064af30be44679f34ec878788afa1727aa60057eb39a96000001e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60010000000000000023ba2703c53263e8d6e522dc32203339dcd8eee9014140f55e2b2914c409396904b8c5a1e8ec0ffc0b62f8b1b996beae7c65ceca7e11a3dbab011038b948ec380c5b22ba474f013ca6de61051dda487a5bec17196115412321031a6c6fbbdf02ca351745fa86b9ba5a9452d785ac4f7fc2b7548ca2a46c4fcf4aacce575ae1bb6153330d20c560acb434dc5755241b"
+
+func TestPeerManagerFetchesTransactions(t *testing.T) {
+	raw, _ := hex.DecodeString(rawInvocation)
+	tx := &network.Transaction{}
+	if err := tx.Decode(bytes.NewBuffer(raw), 0); err != nil {
+		t.Fatal(err)
+	}
+	hash, missing := tx.Hash(), network.Hash{9}
+
+	a := newFakePeer(t)
+	defer a.listener.Close()
+	a.txs[hash] = raw
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{Network: testMagic, Peers: []string{a.address()}, FetchTransactions: true}, r)
+	m.Start()
+	defer m.Close()
+	conn := a.connection(t)
+
+	a.announce(conn, network.InventotyTypeTX, hash, missing)
+	select {
+	case fetched := <-r.fetched:
+		if fetched.Hash() != hash || fetched.Type != network.InvocationTransaction {
+			t.Errorf("unexpected transaction %+v", fetched)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transaction wasn't fetched")
+	}
+	select {
+	case failed := <-r.failed:
+		if failed.Hash != missing {
+			t.Errorf("unexpected failed fetch %+v", failed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the missing transaction wasn't reported")
+	}
+}
+
+func TestPeerManagerFetchesFromTheOtherAnnouncers(t *testing.T) {
+	raw, _ := hex.DecodeString(rawInvocation)
+	tx := &network.Transaction{}
+	tx.Decode(bytes.NewBuffer(raw), 0)
+	hash, missing := tx.Hash(), network.Hash{9}
+
+	a, b := newFakePeer(t), newFakePeer(t)
+	defer a.listener.Close()
+	defer b.listener.Close()
+	a.silent = true
+	b.txs[hash] = raw
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{
+		Network:           testMagic,
+		Peers:             []string{a.address(), b.address()},
+		MaxPeers:          2,
+		FetchTransactions: true,
+		FetchTimeout:      300 * time.Millisecond,
+	}, r)
+	m.Start()
+	defer m.Close()
+	connA, connB := a.connection(t), b.connection(t)
+
+	a.announce(connA, network.InventotyTypeTX, hash, missing)
+	waitFor(t, "the announcements", func() bool { return len(r.txs()) == 2 })
+	b.announce(connB, network.InventotyTypeTX, hash, missing)
+
+	// a doesn't answer, both are asked from b once the request times out
+	select {
+	case fetched := <-r.fetched:
+		if fetched.Hash() != hash {
+			t.Errorf("unexpected transaction %+v", fetched)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the transaction wasn't fetched from the second peer")
+	}
+	select {
+	case failed := <-r.failed:
+		if failed.Hash != missing || failed.Peer != a.address() {
+			t.Errorf("unexpected failed fetch %+v", failed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the missing transaction wasn't reported")
+	}
+	select {
+	case failed := <-r.failed:
+		t.Errorf("the fetch of %+v failed twice", failed)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPeerManagerFetchesBlocks(t *testing.T) {
+	raw, _ := hex.DecodeString(rawInvocation)
+	tx := &network.Transaction{}
+	tx.Decode(bytes.NewBuffer(raw), 0)
+	block := &network.Block{Transactions: []*network.Transaction{tx}}
+	block.Index = 10
+	block.MerkleRoot = network.MerkleRoot([]network.Hash{tx.Hash()})
+	var encoded bytes.Buffer
+	if err := block.Encode(&encoded, 0); err != nil {
+		t.Fatal(err)
+	}
+	invalid := *block
+	invalid.Index = 11
+	invalid.MerkleRoot = network.Hash{1}
+	var encodedInvalid bytes.Buffer
+	invalid.Encode(&encodedInvalid, 0)
+
+	a := newFakePeer(t)
+	defer a.listener.Close()
+	a.blocks[block.Hash()] = encoded.Bytes()
+	a.blocks[invalid.Hash()] = encodedInvalid.Bytes()
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{Network: testMagic, Peers: []string{a.address()}, FetchBlocks: true, FetchTimeout: 500 * time.Millisecond}, r)
+	m.Start()
+	defer m.Close()
+	conn := a.connection(t)
+
+	a.announce(conn, network.InventotyTypeBlock, block.Hash(), invalid.Hash())
+	select {
+	case fetched := <-r.blocks:
+		if fetched.Hash() != block.Hash() || len(fetched.Transactions) != 1 {
+			t.Errorf("unexpected block %+v", fetched)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the block wasn't fetched")
+	}
+	select {
+	case failed := <-r.failed:
+		if failed.Hash != invalid.Hash() || failed.Type != network.InventotyTypeBlock {
+			t.Errorf("unexpected failed fetch %+v", failed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the block that doesn't match its merkle root wasn't given up on")
+	}
+	if len(r.blocks) != 0 {
+		t.Error("the block that doesn't match its merkle root was delivered")
+	}
+}
+
+func TestPeerManagerFetchesConsensusPayloads(t *testing.T) {
+	var data bytes.Buffer
+	(&network.ConsensusMessage{Type: network.ChangeViewMessage, NewViewNumber: 1}).Encode(&data, 0)
+	payload := &network.ConsensusPayload{BlockIndex: 10, ValidatorIndex: 2, Data: data.Bytes(), Witness: network.Witness{VerificationScript: []byte{0x51}}}
+	var encoded bytes.Buffer
+	payload.Encode(&encoded, 0)
+
+	a := newFakePeer(t)
+	defer a.listener.Close()
+	a.consensus[payload.Hash()] = encoded.Bytes()
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{Network: testMagic, Peers: []string{a.address()}, FetchConsensus: true}, r)
+	m.Start()
+	defer m.Close()
+	conn := a.connection(t)
+
+	a.announce(conn, network.InventotyTypeConsensus, payload.Hash())
+	select {
+	case fetched := <-r.consensus:
+		if fetched.Hash() != payload.Hash() || fetched.ValidatorIndex != 2 {
+			t.Errorf("unexpected payload %+v", fetched)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the consensus payload wasn't fetched")
+	}
+}
+
+func TestSeenSetExpires(t *testing.T) {
+	start := time.Now()
+	s := newSeenSet(time.Minute)
+	if !s.add("a", start) || s.add("a", start.Add(30*time.Second)) {
+		t.Fatal("a key should only be added once")
+	}
+	if s.add("a", start.Add(90*time.Second)) {
+		t.Error("a key should be remembered for at least the ttl")
+	}
+	if !s.add("a", start.Add(5*time.Minute)) {
+		t.Error("a key should be forgotten after twice the ttl")
+	}
+}
+
+func TestPeerManagerDiscoversPeers(t *testing.T) {
+	// a is only known from a previous run, the configured peer doesn't accept connections
+	a, dead := newFakePeer(t), newFakePeer(t)
+	defer a.listener.Close()
+	dead.listener.Close()
+	a.addrs = []*network.NetWorkAddressWithTime{
+		{Timestamp: time.Now(), Endpoint: network.Endpoint{IP: net.IPv4(203, 0, 113, 7), Port: 10333}},
+		{Timestamp: time.Now(), Endpoint: network.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 10333}},
+	}
+	dir, _ := ioutil.TempDir("", "peers")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+	ioutil.WriteFile(path, []byte(`[{"address":"`+a.address()+`"}]`), 0644)
+	book, err := NewAddressBook(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{
+		Network:     testMagic,
+		Peers:       []string{dead.address()},
+		MaxPeers:    1,
+		RetryDelay:  10 * time.Millisecond,
+		AddressBook: book,
+	}, r)
+	m.Start()
+	a.connection(t)
+	waitFor(t, "the connection", func() bool { return r.isConnected(a.address()) })
+	waitFor(t, "the announced address", func() bool { return book.Len() == 3 })
+	m.Close()
+
+	if _, ok := book.Get("203.0.113.7:10333"); !ok {
+		t.Error("the announced address wasn't added")
+	}
+	if info, _ := book.Get(a.address()); info.LastSuccess.IsZero() || info.Failures != 0 {
+		t.Errorf("the connection to %s wasn't recorded: %+v", a.address(), info)
+	}
+	if info, _ := book.Get(dead.address()); info.Failures == 0 {
+		t.Errorf("the failure of %s wasn't recorded: %+v", dead.address(), info)
+	}
+	saved, err := NewAddressBook(path, 0)
+	if err != nil || saved.Len() != book.Len() {
+		t.Errorf("the book wasn't saved on Close: %v", err)
+	}
+}
+
+// corrupt changes the last byte of a message so it no longer matches its checksum
+func corrupt(message []byte) []byte {
+	message[len(message)-1] ^= 0xff
+	return message
+}
+
+func TestPeerManagerDisconnectsOnInvalidMessages(t *testing.T) {
+	a := newFakePeer(t)
+	defer a.listener.Close()
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{Network: testMagic, Peers: []string{a.address()}, RetryDelay: time.Hour}, r)
+	m.Start()
+	defer m.Close()
+	conn := a.connection(t)
+	waitFor(t, "the connection", func() bool { return r.isConnected(a.address()) })
+
+	conn.Write(corrupt(network.NewMessage(testMagic, network.CommandInv, network.NewInvPayload(network.InventotyTypeTX, []network.Hash{{1}}))))
+	select {
+	case <-r.disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't closed")
+	}
+	if kinds := r.violationKinds(); len(kinds) != 1 || kinds[0] != network.BadChecksum {
+		t.Errorf("unexpected violations %v", kinds)
+	}
+	if violations := m.Violations(); violations[a.address()] != 1 {
+		t.Errorf("unexpected violation counts %v", violations)
+	}
+	if len(r.txs()) != 0 {
+		t.Error("the corrupted announcement was handled")
+	}
+}
+
+// truncated drops the last bytes of a payload, the message is framed correctly but can't be decoded
+type truncated struct {
+	network.PayloadInterface
+	cut int
+}
+
+func (p truncated) Encode(w io.Writer, protocolVersion uint32) error {
+	var b bytes.Buffer
+	p.PayloadInterface.Encode(&b, protocolVersion)
+	_, err := w.Write(b.Bytes()[:b.Len()-p.cut])
+	return err
+}
+
+func TestPeerManagerReportsMalformedInventories(t *testing.T) {
+	a := newFakePeer(t)
+	defer a.listener.Close()
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{Network: testMagic, Peers: []string{a.address()}, RetryDelay: time.Hour}, r)
+	m.Start()
+	defer m.Close()
+	conn := a.connection(t)
+	waitFor(t, "the connection", func() bool { return r.isConnected(a.address()) })
+
+	inv := network.NewInvPayload(network.InventotyTypeTX, []network.Hash{{1}, {2}})
+	conn.Write(network.NewMessage(testMagic, network.CommandInv, truncated{inv, 1}))
+	// The message is skipped, the next one is handled
+	a.announce(conn, network.InventotyTypeTX, network.Hash{3})
+	waitFor(t, "the valid announcement", func() bool { return len(r.txs()) == 1 })
+	if txs := r.txs(); txs[0].Hash != (network.Hash{3}) {
+		t.Errorf("unexpected inventory %+v", txs[0])
+	}
+	if kinds := r.violationKinds(); len(kinds) != 1 || kinds[0] != network.MalformedPayload {
+		t.Errorf("unexpected violations %v", kinds)
+	}
+}
+
+func TestPeerManagerResyncsAfterInvalidMessages(t *testing.T) {
+	a := newFakePeer(t)
+	defer a.listener.Close()
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{
+		Network:       testMagic,
+		Peers:         []string{a.address()},
+		RetryDelay:    time.Hour,
+		Framing:       ResyncOnViolation,
+		MaxViolations: 3,
+	}, r)
+	m.Start()
+	defer m.Close()
+	conn := a.connection(t)
+	waitFor(t, "the connection", func() bool { return r.isConnected(a.address()) })
+
+	inv := func(h byte) []byte {
+		return network.NewMessage(testMagic, network.CommandInv, network.NewInvPayload(network.InventotyTypeTX, []network.Hash{{h}}))
+	}
+	var stream bytes.Buffer
+	stream.Write(corrupt(inv(1)))
+	stream.Write([]byte{0xde, 0xad})
+	stream.Write(network.NewMessage(network.NEOMagic, network.CommandVerack, nil))
+	stream.Write(inv(2))
+	conn.Write(stream.Bytes())
+	waitFor(t, "the valid announcement", func() bool { return len(r.txs()) == 1 })
+	if txs := r.txs(); txs[0].Hash != (network.Hash{2}) {
+		t.Errorf("unexpected inventory %+v", txs[0])
+	}
+	expected := []network.MessageErrorKind{network.BadChecksum, network.WrongMagic}
+	if kinds := r.violationKinds(); !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("got violations %v, expected %v", kinds, expected)
+	}
+
+	// The third one reaches the limit
+	conn.Write(corrupt(inv(3)))
+	select {
+	case <-r.disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't closed")
+	}
+	if violations := m.Violations(); violations[a.address()] != 3 {
+		t.Errorf("unexpected violation counts %v", violations)
+	}
+}
+
+func TestPeerManagerBacksOffFailingAttempts(t *testing.T) {
+	// The node closes every connection before the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var attempts int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&attempts, 1)
+			conn.Close()
+		}
+	}()
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{Network: testMagic, Peers: []string{l.Addr().String()}, RetryDelay: 10 * time.Millisecond}, r)
+	m.Start()
+	time.Sleep(350 * time.Millisecond)
+	m.Close()
+
+	// Waiting 10, 20, 40, 80 and 160ms, a fixed delay would give about 30 attempts
+	if n := atomic.LoadInt32(&attempts); n < 2 || n > 7 {
+		t.Errorf("%d attempts", n)
+	}
+}
+
+func TestPeerManagerCloseStopsGoroutines(t *testing.T) {
+	a, dead := newFakePeer(t), newFakePeer(t)
+	defer a.listener.Close()
+	dead.listener.Close()
+	baseline := runtime.NumGoroutine()
+	book, _ := NewAddressBook("", 0)
+	r := newRecorder()
+	m, _ := NewPeerManager(PeerManagerConfig{
+		Network:           testMagic,
+		Peers:             []string{a.address(), dead.address()},
+		MaxPeers:          2,
+		RetryDelay:        10 * time.Millisecond,
+		FetchTransactions: true,
+		AddressBook:       book,
+	}, r)
+	m.Start()
+	conn := a.connection(t)
+	// Fetched while the manager runs
+	a.announce(conn, network.InventotyTypeTX, network.Hash{1})
+	waitFor(t, "the announcement", func() bool { return len(r.txs()) == 1 })
+	m.Close()
+	waitForGoroutines(t, baseline)
+}
@@ -0,0 +1,116 @@
+package neoutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// AddressVersion is the version byte of NEO 2.x addresses
+const AddressVersion = 0x17
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var bigRadix = big.NewInt(58)
+
+// Base58Encode encodes bytes with the bitcoin alphabet, leading zeros become leading 1s
+func Base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	mod := new(big.Int)
+	out := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, bigRadix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func Base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		n.Mul(n, bigRadix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	leading := 0
+	for leading < len(s) && s[leading] == base58Alphabet[0] {
+		leading++
+	}
+	return append(make([]byte, leading), n.Bytes()...), nil
+}
+
+func checksum(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// ScriptHashToAddress returns the address of a script hash given as its 20 raw bytes,
+// the little endian order used inside scripts and notifications.
+func ScriptHashToAddress(scriptHash []byte) (string, error) {
+	if len(scriptHash) != 20 {
+		return "", fmt.Errorf("script hash must be 20 bytes, got %d", len(scriptHash))
+	}
+	payload := append([]byte{AddressVersion}, scriptHash...)
+	return Base58Encode(append(payload, checksum(payload)...)), nil
+}
+
+// AddressToScriptHash returns the raw script hash of an address, checking its version and checksum
+func AddressToScriptHash(address string) ([]byte, error) {
+	b, err := Base58Decode(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 25 {
+		return nil, fmt.Errorf("invalid address length")
+	}
+	if b[0] != AddressVersion {
+		return nil, fmt.Errorf("invalid address version %#x", b[0])
+	}
+	if !bytes.Equal(checksum(b[:21]), b[21:]) {
+		return nil, fmt.Errorf("invalid address checksum")
+	}
+	return b[1:21], nil
+}
+
+// ReverseBytes returns a reversed copy, script hashes are displayed big endian as 0x...
+// but stored little endian.
+func ReverseBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+// ScriptHashToHex formats raw script hash bytes the way NEO displays them, eg: 0x314b5aac...
+func ScriptHashToHex(scriptHash []byte) string {
+	return "0x" + hex.EncodeToString(ReverseBytes(scriptHash))
+}
+
+// HexToScriptHash parses a 0x prefixed big endian script hash into its raw bytes
+func HexToScriptHash(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 20 {
+		return nil, fmt.Errorf("script hash must be 20 bytes, got %d", len(b))
+	}
+	return ReverseBytes(b), nil
+}
@@ -0,0 +1,67 @@
+package neoutils
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+var addressVectors = []struct {
+	scriptHash string // raw, as found in notifications
+	address    string
+}{
+	{"30074a2d88bab26f74142c188231e92ad401dbf6", "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA"},
+	{"8ba6205856117b0f3909cd88209aa919ec9c14b8", "AUWGapjQ1rThjZDYF3rK1HPfY4UjENhXom"},
+	{"0000000000000000000000000000000000000000", "AFmseVrdL9f9oyCzZefL9tG6UbvhPbdYzM"},
+}
+
+func TestScriptHashToAddress(t *testing.T) {
+	for _, v := range addressVectors {
+		b, _ := hex.DecodeString(v.scriptHash)
+		address, err := ScriptHashToAddress(b)
+		if err != nil || address != v.address {
+			t.Errorf("%s: got %s %v, expected %s", v.scriptHash, address, err, v.address)
+		}
+	}
+	if _, err := ScriptHashToAddress([]byte{1, 2, 3}); err == nil {
+		t.Error("a short script hash should be rejected")
+	}
+}
+
+func TestAddressToScriptHash(t *testing.T) {
+	for _, v := range addressVectors {
+		b, err := AddressToScriptHash(v.address)
+		if err != nil || hex.EncodeToString(b) != v.scriptHash {
+			t.Errorf("%s: got %x %v, expected %s", v.address, b, err, v.scriptHash)
+		}
+	}
+	for _, invalid := range []string{
+		"AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrB", // checksum
+		"AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQr",  // length
+		"AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQr0", // alphabet
+		"1BoatSLRHtKNngkdXEeobR76b53LETtpyT", // bitcoin version
+	} {
+		if _, err := AddressToScriptHash(invalid); err == nil {
+			t.Errorf("%s should be rejected", invalid)
+		}
+	}
+}
+
+func TestBase58LeadingZeros(t *testing.T) {
+	if s := Base58Encode([]byte{0, 0, 1, 2}); s != "115T" {
+		t.Errorf("got %s", s)
+	}
+	b, err := Base58Decode("115T")
+	if err != nil || hex.EncodeToString(b) != "00000102" {
+		t.Errorf("got %x %v", b, err)
+	}
+}
+
+func TestScriptHashHex(t *testing.T) {
+	b, err := HexToScriptHash("0x314b5aac1cdd01d10661b00886197f2194c3c89b")
+	if err != nil || hex.EncodeToString(b) != "9bc8c394217f198608b06106d101dd1cac5a4b31" {
+		t.Errorf("got %x %v", b, err)
+	}
+	if s := ScriptHashToHex(b); s != "0x314b5aac1cdd01d10661b00886197f2194c3c89b" {
+		t.Errorf("got %s", s)
+	}
+}
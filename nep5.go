@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+	"github.com/corollari/neo-ws-pub-sub/neoutils"
+)
+
+const (
+	// Transfers waiting to be decoded, the token lookups must not hold up the relay
+	nep5QueueSize = 1024
+
+	// How long a token whose decimals couldn't be fetched waits before being asked again
+	tokenRetryPeriod = 5 * time.Minute
+)
+
+// NEP5Account is a transfer party, nil for the sender of a mint or the receiver of a burn
+type NEP5Account struct {
+	ScriptHash string `json:"scriptHash"`
+	Address    string `json:"address"`
+}
+
+// NEP5Transfer is the decoded form of a transfer notification
+type NEP5Transfer struct {
+	Contract  string       `json:"contract"`
+	TxId      string       `json:"txid"`
+	From      *NEP5Account `json:"from"`
+	To        *NEP5Account `json:"to"`
+	RawAmount string       `json:"rawAmount"`          // Integer amount as it appears in the notification
+	Amount    string       `json:"amount,omitempty"`   // RawAmount scaled by the decimals of the token
+	Decimals  *int         `json:"decimals,omitempty"` // Missing when the token couldn't be queried
+	Symbol    string       `json:"symbol,omitempty"`
+}
+
+// NEP5Diagnostic reports a transfer notification that couldn't be decoded
+type NEP5Diagnostic struct {
+	Contract string      `json:"contract"`
+	TxId     string      `json:"txid"`
+	Error    string      `json:"error"`
+	Event    interface{} `json:"event"`
+}
+
+type tokenInfo struct {
+	decimals  int
+	symbol    string
+	err       error
+	fetchedAt time.Time
+}
+
+var (
+	nep5Queue   = make(chan EventMessage, nep5QueueSize)
+	tokens      = map[string]*tokenInfo{}
+	tokensMutex sync.Mutex
+)
+
+// queueTransfer hands transfer notifications to the decoder, any other event is ignored
+func queueTransfer(m EventMessage) {
+	params, _ := m.Event.([]interface{})
+	if len(params) == 0 {
+		return
+	}
+	param, _ := params[0].(map[string]interface{})
+	if eventName(param) != "transfer" {
+		return
+	}
+	select {
+	case nep5Queue <- m:
+	default:
+		log.Printf("nep5 queue is full, dropping transfer of %s", m.TxId)
+	}
+}
+
+// decodeTransfers publishes the queued transfers in the order they arrived
+func decodeTransfers() {
+	for m := range nep5Queue {
+		t, err := decodeTransfer(m)
+		if err != nil {
+			d := NEP5Diagnostic{Contract: m.Contract, TxId: m.TxId, Error: err.Error(), Event: m.Event}
+			sendMessage("nep5/diagnostics", d)
+			continue
+		}
+		info := lookupToken(m.Contract)
+		if info.err != nil {
+			sendMessage("nep5/diagnostics", NEP5Diagnostic{
+				Contract: m.Contract,
+				TxId:     m.TxId,
+				Error:    "can't get the decimals of the token: " + info.err.Error(),
+				Event:    m.Event,
+			})
+		} else {
+			decimals := info.decimals
+			t.Decimals = &decimals
+			t.Symbol = info.symbol
+			amount, _ := new(big.Int).SetString(t.RawAmount, 10)
+			t.Amount = scaleAmount(amount, decimals)
+		}
+		sendMessage("nep5/transfer", t)
+		sendMessage("nep5/transfer?contract="+t.Contract, t)
+		recordHistory("nep5/transfer", t.Contract, t)
+		publishTransferActivity(t)
+	}
+}
+
+// decodeTransfer reads the transfer(from, to, amount) arguments of a notification
+func decodeTransfer(m EventMessage) (NEP5Transfer, error) {
+	t := NEP5Transfer{Contract: m.Contract, TxId: m.TxId}
+	params, _ := m.Event.([]interface{})
+	if len(params) != 4 {
+		return t, fmt.Errorf("transfer has %d arguments, expected 4", len(params))
+	}
+	args := make([]map[string]interface{}, len(params))
+	for i, p := range params {
+		arg, ok := p.(map[string]interface{})
+		if !ok {
+			return t, fmt.Errorf("argument %d is not a contract parameter", i)
+		}
+		args[i] = arg
+	}
+
+	var err error
+	if t.From, err = decodeAccount(args[1]); err != nil {
+		return t, fmt.Errorf("from: %v", err)
+	}
+	if t.To, err = decodeAccount(args[2]); err != nil {
+		return t, fmt.Errorf("to: %v", err)
+	}
+	if t.From == nil && t.To == nil {
+		return t, fmt.Errorf("transfer has neither sender nor receiver")
+	}
+	amount, err := decodeInteger(args[3])
+	if err != nil {
+		return t, fmt.Errorf("amount: %v", err)
+	}
+	if amount.Sign() < 0 {
+		return t, fmt.Errorf("amount: %v is negative", amount)
+	}
+	t.RawAmount = amount.String()
+	return t, nil
+}
+
+// decodeAccount reads a script hash argument, an empty byte array means there is no account
+func decodeAccount(arg map[string]interface{}) (*NEP5Account, error) {
+	if arg["type"] != "ByteArray" {
+		return nil, fmt.Errorf("expected a ByteArray, got %v", arg["type"])
+	}
+	value, _ := arg["value"].(string)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	address, err := neoutils.ScriptHashToAddress(b)
+	if err != nil {
+		return nil, err
+	}
+	return &NEP5Account{ScriptHash: neoutils.ScriptHashToHex(b), Address: address}, nil
+}
+
+// decodeInteger reads an Integer argument or a ByteArray holding a little endian two's complement integer
+func decodeInteger(arg map[string]interface{}) (*big.Int, error) {
+	switch arg["type"] {
+	case "Integer":
+		n, ok := new(big.Int).SetString(fmt.Sprint(arg["value"]), 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer %v", arg["value"])
+		}
+		return n, nil
+	case "ByteArray":
+		value, _ := arg["value"].(string)
+		b, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return leToBigInt(b), nil
+	}
+	return nil, fmt.Errorf("expected an Integer or a ByteArray, got %v", arg["type"])
+}
+
+func leToBigInt(b []byte) *big.Int {
+	n := new(big.Int).SetBytes(neoutils.ReverseBytes(b))
+	if len(b) > 0 && b[len(b)-1]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return n
+}
+
+// scaleAmount formats an integer amount with the given number of decimals, eg: 150000000, 8 -> 1.50000000
+func scaleAmount(amount *big.Int, decimals int) string {
+	digits := amount.String()
+	if decimals <= 0 {
+		return digits
+	}
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+	return digits[:len(digits)-decimals] + "." + digits[len(digits)-decimals:]
+}
+
+// lookupToken returns the decimals and symbol of a token, querying them once per contract
+func lookupToken(contract string) *tokenInfo {
+	tokensMutex.Lock()
+	info, ok := tokens[contract]
+	tokensMutex.Unlock()
+	if ok && (info.err == nil || time.Since(info.fetchedAt) < tokenRetryPeriod) {
+		return info
+	}
+
+	info = &tokenInfo{fetchedAt: time.Now()}
+	info.decimals, info.symbol, info.err = fetchToken(contract)
+	if info.err != nil {
+		log.Printf("can't get token info of %s: %v", contract, info.err)
+	}
+	tokensMutex.Lock()
+	tokens[contract] = info
+	tokensMutex.Unlock()
+	return info
+}
+
+// tokenScript builds a script calling methods without arguments on a contract, each leaves its result on the stack
+func tokenScript(scriptHash []byte, methods ...string) string {
+	script := ""
+	for _, method := range methods {
+		// PUSH0 PACK (empty argument array), push the method name, APPCALL the contract
+		script += "00c1" + fmt.Sprintf("%02x", len(method)) + hex.EncodeToString([]byte(method)) + "67" + hex.EncodeToString(scriptHash)
+	}
+	return script
+}
+
+// fetchToken calls decimals and symbol through InvokeScript, trying the configured nodes in turn
+func fetchToken(contract string) (int, string, error) {
+	scriptHash, err := neoutils.HexToScriptHash(contract)
+	if err != nil {
+		return 0, "", err
+	}
+	script := tokenScript(scriptHash, "decimals", "symbol")
+	err = fmt.Errorf("no node to query")
+	for _, node := range getConfig().Nodes {
+		res := neorpc.NewClient(node.RPC).InvokeScript(script)
+		if res.ErrorResponse != nil {
+			err = fmt.Errorf("%s: %s", node.RPC, res.ErrorResponse.Error.Message)
+			continue
+		}
+		if res.Result.State == "" {
+			// The request failed, InvokeScript doesn't return the error
+			err = fmt.Errorf("%s didn't answer", node.RPC)
+			continue
+		}
+		if strings.Contains(res.Result.State, "FAULT") || len(res.Result.Stack) != 2 {
+			return 0, "", fmt.Errorf("decimals and symbol can't be called on %s", contract)
+		}
+		decimals, err := stackInteger(res.Result.Stack[0].Type, res.Result.Stack[0].Value)
+		if err != nil || decimals < 0 || decimals > 255 {
+			return 0, "", fmt.Errorf("invalid decimals %q", res.Result.Stack[0].Value)
+		}
+		return int(decimals), stackString(res.Result.Stack[1].Type, res.Result.Stack[1].Value), nil
+	}
+	return 0, "", err
+}
+
+func stackInteger(typ string, value string) (int64, error) {
+	if typ == "Integer" {
+		return strconv.ParseInt(value, 10, 64)
+	}
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) > 8 {
+		return 0, fmt.Errorf("invalid integer %q", value)
+	}
+	return leToBigInt(b).Int64(), nil
+}
+
+func stackString(typ string, value string) string {
+	if typ == "String" {
+		return value
+	}
+	b, err := hex.DecodeString(value)
+	if err != nil || !utf8.Valid(b) {
+		return ""
+	}
+	return string(b)
+}
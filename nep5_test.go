@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/corollari/neo-ws-pub-sub/neoutils"
+)
+
+// Transfer notification of the readme, emitted on mainnet by 0x314b5aac1cdd01d10661b00886197f2194c3c89b
+// in 0xd6f5185a19abad3f3bbea88ac4ec63b449ac38908bd7761dce75e445502bc76f
+func mainnetTransfer() EventMessage {
+	return EventMessage{
+		Contract: "0x314b5aac1cdd01d10661b00886197f2194c3c89b",
+		TxId:     "0xd6f5185a19abad3f3bbea88ac4ec63b449ac38908bd7761dce75e445502bc76f",
+		Event: []interface{}{
+			map[string]interface{}{"type": "ByteArray", "value": "7472616e73666572"},
+			map[string]interface{}{"type": "ByteArray", "value": "30074a2d88bab26f74142c188231e92ad401dbf6"},
+			map[string]interface{}{"type": "ByteArray", "value": "8ba6205856117b0f3909cd88209aa919ec9c14b8"},
+			map[string]interface{}{"type": "ByteArray", "value": "00c39dd000"},
+		},
+	}
+}
+
+func TestDecodeTransfer(t *testing.T) {
+	transfer, err := decodeTransfer(mainnetTransfer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.From == nil || transfer.From.Address != "AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA" || transfer.From.ScriptHash != "0xf6db01d42ae93182182c14746fb2ba882d4a0730" {
+		t.Errorf("unexpected sender %+v", transfer.From)
+	}
+	if transfer.To == nil || transfer.To.Address != "AUWGapjQ1rThjZDYF3rK1HPfY4UjENhXom" || transfer.To.ScriptHash != "0xb8149cec19a99a2088cd09390f7b11565820a68b" {
+		t.Errorf("unexpected receiver %+v", transfer.To)
+	}
+	if transfer.RawAmount != "3500000000" || transfer.Contract != "0x314b5aac1cdd01d10661b00886197f2194c3c89b" {
+		t.Errorf("unexpected transfer %+v", transfer)
+	}
+
+	// Mints have no sender
+	mint := mainnetTransfer()
+	mint.Event.([]interface{})[1] = map[string]interface{}{"type": "ByteArray", "value": ""}
+	if transfer, err := decodeTransfer(mint); err != nil || transfer.From != nil || transfer.To == nil {
+		t.Errorf("unexpected mint %+v, %v", transfer, err)
+	}
+
+	// Notifications that don't follow the standard end up in the diagnostics with the reason
+	malformed := map[string]func(event []interface{}) []interface{}{
+		"transfer has 3 arguments, expected 4": func(event []interface{}) []interface{} { return event[:3] },
+		"argument 2 is not a contract parameter": func(event []interface{}) []interface{} {
+			event[2] = "8ba6205856117b0f3909cd88209aa919ec9c14b8"
+			return event
+		},
+		"from: expected a ByteArray, got Integer": func(event []interface{}) []interface{} {
+			event[1] = map[string]interface{}{"type": "Integer", "value": "1"}
+			return event
+		},
+		"to: encoding/hex": func(event []interface{}) []interface{} {
+			event[2] = map[string]interface{}{"type": "ByteArray", "value": "8ba620zz"}
+			return event
+		},
+		"transfer has neither sender nor receiver": func(event []interface{}) []interface{} {
+			event[1] = map[string]interface{}{"type": "ByteArray", "value": ""}
+			event[2] = map[string]interface{}{"type": "ByteArray", "value": ""}
+			return event
+		},
+		"amount: expected an Integer or a ByteArray, got Boolean": func(event []interface{}) []interface{} {
+			event[3] = map[string]interface{}{"type": "Boolean", "value": true}
+			return event
+		},
+		"amount: -1 is negative": func(event []interface{}) []interface{} {
+			event[3] = map[string]interface{}{"type": "ByteArray", "value": "ff"}
+			return event
+		},
+	}
+	for reason, change := range malformed {
+		m := mainnetTransfer()
+		m.Event = change(m.Event.([]interface{}))
+		if _, err := decodeTransfer(m); err == nil || !strings.HasPrefix(err.Error(), reason) {
+			t.Errorf("expected %q, got %v", reason, err)
+		}
+	}
+}
+
+func TestDecodeTransfersPublishesDiagnostics(t *testing.T) {
+	c, _ := newTestClient(true)
+	if r := c.handleCommand(command{Op: opSubscribe, Channel: "nep5/diagnostics"}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	defer c.unsubscribe("1")
+	go decodeTransfers()
+	defer func() { nep5Queue = make(chan EventMessage, nep5QueueSize) }()
+
+	m := mainnetTransfer()
+	m.Event = m.Event.([]interface{})[:3]
+	queueTransfer(m)
+	frames := receive(t, c, 2)
+	if !strings.Contains(frames[1], `"error":"transfer has 3 arguments, expected 4"`) || !strings.Contains(frames[1], `"txid":"`+m.TxId+`"`) {
+		t.Errorf("unexpected diagnostic %s", frames[1])
+	}
+	close(nep5Queue)
+}
+
+func TestDecodeInteger(t *testing.T) {
+	tests := []struct {
+		typ      string
+		value    interface{}
+		expected string
+	}{
+		{"Integer", "3500000000", "3500000000"},
+		{"Integer", float64(12), "12"},
+		{"ByteArray", "00c39dd000", "3500000000"},
+		{"ByteArray", "", "0"},
+		{"ByteArray", "80", "-128"},
+		{"ByteArray", "8000", "128"},
+		{"ByteArray", "ffff", "-1"},
+		{"ByteArray", "0001", "256"},
+	}
+	for _, test := range tests {
+		n, err := decodeInteger(map[string]interface{}{"type": test.typ, "value": test.value})
+		if err != nil || n.String() != test.expected {
+			t.Errorf("%s %v: got %v, %v, expected %s", test.typ, test.value, n, err, test.expected)
+		}
+	}
+	for _, arg := range []map[string]interface{}{
+		{"type": "Integer", "value": "1.5"},
+		{"type": "ByteArray", "value": "0g"},
+		{"type": "String", "value": "1"},
+	} {
+		if n, err := decodeInteger(arg); err == nil {
+			t.Errorf("%v decoded as %v", arg, n)
+		}
+	}
+}
+
+func TestLeToBigInt(t *testing.T) {
+	tests := map[string]int64{
+		"":         0,
+		"01":       1,
+		"7f":       127,
+		"80":       -128,
+		"ff":       -1,
+		"0080":     -32768,
+		"00c39dd0": -794967296,
+		"00e1f505": 100000000,
+	}
+	for value, expected := range tests {
+		b, _ := hex.DecodeString(value)
+		if n := leToBigInt(b); n.Int64() != expected {
+			t.Errorf("%s: got %v, expected %d", value, n, expected)
+		}
+	}
+}
+
+func TestScaleAmount(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		decimals int
+		expected string
+	}{
+		{3500000000, 8, "35.00000000"},
+		{150000000, 8, "1.50000000"},
+		{1, 8, "0.00000001"},
+		{0, 8, "0.00000000"},
+		{12345, 0, "12345"},
+		{12345, 2, "123.45"},
+		{100, 2, "1.00"},
+		{99, 2, "0.99"},
+	}
+	for _, test := range tests {
+		if scaled := scaleAmount(big.NewInt(test.amount), test.decimals); scaled != test.expected {
+			t.Errorf("%d with %d decimals: got %s, expected %s", test.amount, test.decimals, scaled, test.expected)
+		}
+	}
+}
+
+func TestTokenScript(t *testing.T) {
+	scriptHash, err := neoutils.HexToScriptHash("0x314b5aac1cdd01d10661b00886197f2194c3c89b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The contract is called as in the scripts of the block of the readme: APPCALL 9bc8c394...
+	expected := "00c108" + hex.EncodeToString([]byte("decimals")) + "679bc8c394217f198608b06106d101dd1cac5a4b31" +
+		"00c106" + hex.EncodeToString([]byte("symbol")) + "679bc8c394217f198608b06106d101dd1cac5a4b31"
+	if script := tokenScript(scriptHash, "decimals", "symbol"); script != expected {
+		t.Errorf("got %s, expected %s", script, expected)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+	"github.com/corollari/neo-ws-pub-sub/neotx"
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+	"github.com/corollari/neo-ws-pub-sub/neoutils"
+)
+
+const defaultSeenSeconds = 600
+
+type P2PConfig struct {
+	MaxPeers         int    `json:"maxPeers"`         //nodes connected to at the same time
+	SeenSeconds      int    `json:"seenSeconds"`      //how long announced transactions are remembered to publish them once
+	RPCFallback      bool   `json:"rpcFallback"`      //ask the RPC endpoint of a node for the transactions it doesn't send over P2P
+	AddressBook      string `json:"addressBook"`      //file keeping the nodes announced by the peers, discovery is off when empty
+	Resync           bool   `json:"resync"`           //skip invalid messages instead of disconnecting from the node
+	MaxViolations    int    `json:"maxViolations"`    //invalid messages skipped on a connection when resync is set before disconnecting
+	HandshakeSeconds int    `json:"handshakeSeconds"` //to connect to a node and exchange versions
+	IdleSeconds      int    `json:"idleSeconds"`      //without any message from a connected node before disconnecting
+}
+
+// System fees of the transaction types that have one, in GAS, as set in the protocol of both networks
+var systemFees = map[network.TransactionType]int64{
+	network.EnrollmentTransaction: 1000,
+	network.IssueTransaction:      500,
+	network.PublishTransaction:    500,
+	network.RegisterTransaction:   10000,
+}
+
+func p2pSettings(config Configuration) (maxPeers int, seenTTL time.Duration) {
+	maxPeers, seenTTL = neotx.DefaultMaxPeers, defaultSeenSeconds*time.Second
+	if config.P2P != nil {
+		if config.P2P.MaxPeers > 0 {
+			maxPeers = config.P2P.MaxPeers
+		}
+		if config.P2P.SeenSeconds > 0 {
+			seenTTL = time.Duration(config.P2P.SeenSeconds) * time.Second
+		}
+	}
+	if maxPeers > len(config.Nodes) && !discovery(config) {
+		maxPeers = len(config.Nodes)
+	}
+	return maxPeers, seenTTL
+}
+
+func p2pAddresses(nodes []NodeAddresses) []string {
+	addresses := make([]string, len(nodes))
+	for i, node := range nodes {
+		addresses[i] = node.P2P
+	}
+	return addresses
+}
+
+// discovery tells whether nodes other than the configured ones are connected to
+func discovery(config Configuration) bool {
+	return config.P2P != nil && config.P2P.AddressBook != ""
+}
+
+// framingPolicy is what the connections do with messages whose header or checksum is invalid
+func framingPolicy(config Configuration) (policy neotx.FramingPolicy, maxViolations int) {
+	if config.P2P == nil {
+		return neotx.DisconnectOnViolation, 0
+	}
+	if config.P2P.Resync {
+		policy = neotx.ResyncOnViolation
+	}
+	return policy, config.P2P.MaxViolations
+}
+
+// p2pTimeouts are the handshake and idle timeouts of the connections, 0 for the defaults
+func p2pTimeouts(config Configuration) (handshake, idle time.Duration) {
+	if config.P2P == nil {
+		return 0, 0
+	}
+	return time.Duration(config.P2P.HandshakeSeconds) * time.Second, time.Duration(config.P2P.IdleSeconds) * time.Second
+}
+
+func rpcFallback() bool {
+	config := getConfig().P2P
+	return config != nil && config.RPCFallback
+}
+
+// fixed8String formats a Fixed8 amount the way NEO nodes do, eg: 150000000 -> 1.5
+func fixed8String(value int64) string {
+	sign := ""
+	if value < 0 {
+		sign, value = "-", -value
+	}
+	s := strconv.FormatInt(value/100000000, 10)
+	if fraction := value % 100000000; fraction != 0 {
+		s += "." + strings.TrimRight(strconv.FormatInt(100000000+fraction, 10)[1:], "0")
+	}
+	return sign + s
+}
+
+func hashString(h network.Hash) string {
+	return "0x" + hex.EncodeToString(h.ToBytes())
+}
+
+func systemFee(t *network.Transaction) int64 {
+	switch t.Type {
+	case network.InvocationTransaction:
+		return t.Gas
+	case network.IssueTransaction:
+		// Issuing the native assets is free, and so is any issue from version 1
+		if t.Version >= 1 {
+			return 0
+		}
+		native := true
+		for _, out := range t.Outputs {
+			asset := hashString(out.AssetID)
+			native = native && (asset == assetAliases["neo"] || asset == assetAliases["gas"])
+		}
+		if native {
+			return 0
+		}
+	case network.RegisterTransaction:
+		// Registering the governing (NEO) or the utility (GAS) token is free
+		if t.Asset != nil && t.Asset.AssetType <= 0x01 {
+			return 0
+		}
+	}
+	return systemFees[t.Type] * 100000000
+}
+
+// transactionResult describes a transaction received over P2P like getrawtransaction does
+// for one in the mempool. The network fee of a transaction with inputs is left empty, it needs
+// their values.
+func transactionResult(t *network.Transaction) neorpc.GetRawTransactionResult {
+	r := neorpc.GetRawTransactionResult{
+		Txid:    hashString(t.Hash()),
+		Size:    t.Size(),
+		Type:    t.Type.String(),
+		Version: int(t.Version),
+		SysFee:  fixed8String(systemFee(t)),
+	}
+	if len(t.Inputs) == 0 && t.Type != network.ClaimTransaction && t.Type != network.IssueTransaction {
+		// Nothing is spent, only claims and issues can create GAS from nothing
+		r.NetFee = "0"
+	}
+	r.Attributes = make([]struct {
+		Usage string `json:"usage"`
+		Data  string `json:"data"`
+	}, len(t.Attributes))
+	for i, a := range t.Attributes {
+		r.Attributes[i].Usage = a.Usage.String()
+		r.Attributes[i].Data = hex.EncodeToString(a.Data)
+	}
+	r.Vin = make([]struct {
+		Txid string `json:"txid"`
+		Vout int    `json:"vout"`
+	}, len(t.Inputs))
+	for i, in := range t.Inputs {
+		r.Vin[i].Txid = hashString(in.PrevHash)
+		r.Vin[i].Vout = int(in.PrevIndex)
+	}
+	if t.Type == network.ClaimTransaction {
+		r.Claims = make([]struct {
+			Txid string `json:"txid"`
+			Vout int    `json:"vout"`
+		}, len(t.Claims))
+		for i, claim := range t.Claims {
+			r.Claims[i].Txid = hashString(claim.PrevHash)
+			r.Claims[i].Vout = int(claim.PrevIndex)
+		}
+	}
+	r.Vout = make([]struct {
+		N       int    `json:"n"`
+		Asset   string `json:"asset"`
+		Value   string `json:"value"`
+		Address string `json:"address"`
+	}, len(t.Outputs))
+	for i, out := range t.Outputs {
+		r.Vout[i].N = i
+		r.Vout[i].Asset = hashString(out.AssetID)
+		r.Vout[i].Value = fixed8String(out.Value)
+		r.Vout[i].Address, _ = neoutils.ScriptHashToAddress(out.ScriptHash[:])
+	}
+	r.Scripts = make([]struct {
+		Invocation   string `json:"invocation"`
+		Verification string `json:"verification"`
+	}, len(t.Witnesses))
+	for i, w := range t.Witnesses {
+		r.Scripts[i].Invocation = hex.EncodeToString(w.InvocationScript)
+		r.Scripts[i].Verification = hex.EncodeToString(w.VerificationScript)
+	}
+	if t.Type == network.InvocationTransaction {
+		r.Script = hex.EncodeToString(t.Script)
+		r.Gas = fixed8String(t.Gas)
+	}
+	return r
+}
+
+// blockResult describes a block received over P2P like getblock does, the network fees of its
+// transactions are left empty as in transactionResult.
+func blockResult(b *network.Block) neorpc.GetBlockResult {
+	r := neorpc.GetBlockResult{
+		Hash:              hashString(b.Hash()),
+		Size:              b.Size(),
+		Version:           int(b.Version),
+		Previousblockhash: hashString(b.PrevHash),
+		Merkleroot:        hashString(b.MerkleRoot),
+		Time:              int(b.Timestamp),
+		Index:             int(b.Index),
+		Nonce:             fmt.Sprintf("%016x", b.ConsensusData),
+		Confirmations:     1,
+	}
+	r.Nextconsensus, _ = neoutils.ScriptHashToAddress(b.NextConsensus[:])
+	r.Script.Invocation = hex.EncodeToString(b.Witness.InvocationScript)
+	r.Script.Verification = hex.EncodeToString(b.Witness.VerificationScript)
+	txs := make([]neorpc.GetRawTransactionResult, len(b.Transactions))
+	for i, t := range b.Transactions {
+		txs[i] = transactionResult(t)
+	}
+	// The transactions of a block share most of their fields with getrawtransaction
+	raw, _ := json.Marshal(txs)
+	json.Unmarshal(raw, &r.Tx)
+	for i, t := range b.Transactions {
+		if t.Type == network.MinerTransaction {
+			r.Tx[i].Nonce = int64(t.Nonce)
+		}
+	}
+	return r
+}
+
+// updatePeers hands a reloaded node list to the peer manager, it is used when a connection has to be replaced
+func updatePeers(nodes []NodeAddresses) {
+	neoHandler.addNodes(nodes)
+	upstreamMutex.Lock()
+	peers := p2pPeers
+	upstreamMutex.Unlock()
+	if peers == nil {
+		return
+	}
+	if err := peers.SetPeers(p2pAddresses(nodes)); err != nil {
+		log.Printf("can't update the P2P nodes: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+	"github.com/corollari/neo-ws-pub-sub/neotx/network"
+)
+
+// Block 5249790 as received over P2P and as getblock returns it (the example of the readme)
+const (
+	rawBlock5249790 = "00000000424fe99344c1a35cbafab6792b57e48e4596b3d8cadf99162dc2b34976c480f5ceb801ec0e1d252b9c9a9ed7360130b4ab073d5219dce62da87ad7f4727fb863259a725efe1a5000aa28e59cb267ee8f4e4e04879cfe60ba3b296b1ff08f112f6071756f01fd450140e3d5b93963011fce63ce0529dd105a87395babea4f5d5840110113a677584c99f51ce57196204bcbd73393a72998278bfdc30540b10d7a9e5e342b4265aea9d340bc2b3992246e0049645685d85b29b757ec3b5b0e249c038cd18ad682f8e18d438c9ff2b89cf63bd94cf26a6d16f23c9b377ad03c8fd07d076a73b9e801ab9c07406e254f902d5f648b68a7c0652bcf9b57b5dadb7c6d2d159514bde83b90e30433246efdc81e612c6ad1d8fab2f73c3382dccdc5d09536b1342f70a2d6493df5da40c0d3cfd4d3453e8e4c78cf53978e6adaf0f6bdf071bec8b912a9c8e5ff51f5fcf046096d8b2a88558cb5fe32371c709136a9b99624e8ff6029c8655f638a87bf40772752c328486cd0ed89a931c2613c81fee06e3a717c0f5b00f228d6f1b0192befada0d522fd943da8136f8992b0580aa61173c1867ca623dee558063c965a37f15521024c7b7fb6c310fccf1ba33b082519d82964ea93868d676662d4a59ad548df0e7d21025bdf3f181f53e9696227843950deb72dcd374ded17c057159513c3d0abe20b6421035e819642a8915a2572f972ddbdbe3042ae6437349295edce9bdc3b8884bbf9a32103b209fd4f53a7170ea4444e0cb0a6bb6a53c2bd016926989cf85f9b0fba17a70c2103b8d9d5771d8f513aa0869b9cc8d50986403b78c6da36890638c3d46a5adce04a2102ca0e27697b9c248f6f16e085fd0061e26f44da85b58ee835c110caa5ec3ba5542102df48f60e8f3e01c48ff40b9b7f1310d7a8b2a193188befe1c2e3df740e89509357ae060000aa28e59c00000000d1015a0500bea7d01414b197bb42bb224fe63c20bbc93dd1e183ae1cb120144649f940788c16c01e70d39e3613252ef7a58dbc53c1087472616e7366657267a9fe67930cdd180863395620af7a3f0109d2c0b7f166f470c61e6df75140000000000000000001204649f940788c16c01e70d39e3613252ef7a58dbc0000014140eab6fbbf8839314cd21118329f8bfc8048c99f1d77851e32a2fb6ffcf56c4cffb021d4b0fc0168af13b2a246566fedee0fa387fffcbc0eda2c5abe9b16f7f52b232102eb9704f6676a4e332b0a91057ddfe9bba4126b453e7104f9616f1a081e702694acd10159203236613166663031323834313564376166323737396438383038623534306238149a9763d8cd9d160af3162f44f50123afe58bca5652c10b7061794f7264657247617367a87c7976662f9b2012c2a5ace6a0dbd6f532d259000000000000000000019eb97a0b300f2c58e8d91bca9634734917dbd0ea0a46304c61c5f0c158508923010002e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60e803000000000000a87c7976662f9b2012c2a5ace6a0dbd6f532d259e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c6010de1a01000000009a9763d8cd9d160af3162f44f50123afe58bca560141403a16ac944a11ba2bc470257b8f7ad651e72ace4d8755c8b0a4947b288b4fe0e017215ffd97bf000c225fe8432204d196a16ec85daae5c7523d58e8ef2b97ed56232103fc8d713440a5febf9dbd6d61b96234453b5c7a75ba5841c5cf04ec4351a9e3d4acd10159203134366538636239363763346365623361623361366534353132336336303739143a36d8cd56c4dfbdf636a892ed786af4e4c695f352c10b7061794f7264657247617367a87c7976662f9b2012c2a5ace6a0dbd6f532d2590000000000000000000134bbdf6e63e3ca2a55faa73461f5cb7608140c3207a68292135004d5b52375ae010002e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60e803000000000000a87c7976662f9b2012c2a5ace6a0dbd6f532d259e72d286979ee6cb1b7e65dfddfb2e384100b8d148e7758de42e4168b71792c60d03b1b01000000003a36d8cd56c4dfbdf636a892ed786af4e4c695f3014140c870c95a84c5cc846c1ca5b09621d94d4d7343a44a6b3df3eaa2c8ec9a539232532f0f0668efa28669f531680d0419c346805c74e76fd7d7939fc55e9238c8242321028032387622db11004d901ac1bea972e0ca417e84c590cf031e7eaffed6e8498dac8000000134256eac1d7a9f5086cceea24a8c17ea5989063d10475fc730260a0d878f34a90000019b7cffdaa674beae0f930ebe6085af9093e5fe56b34a5c220ccdcf6efc336fc500b4f13501000000774aba48c85edda93ea3c2ae9d6830b5f25b78630141408e55b007686bf29cc8cdc2f65e7b5b448e2efe5a68e71c6f35f617edce8603fe376fa9d3edb6ed1295866fcc50db9f0ac7c5f14bf4b12fbd308cea47753896302321026c69fc74aaf06273d34fdc2d24382140155714f65901b83b34d3c99a7e4eaf85acd1015a050056218300144649f940788c16c01e70d39e3613252ef7a58dbc1459a6e5472a2d026c76e3cb76fc5d01aba86728a653c1087472616e73666572679bc8c394217f198608b06106d101dd1cac5a4b31f1666f3e3341286df7020000000000000000012059a6e5472a2d026c76e3cb76fc5d01aba86728a60000014140ba5421c8bb68385fc7d7a813acf61180fa04a984275a36586024d907f208af1e05af99e0f040c00ddfe26b02d16485ec724064bb03c3af00112f5f13f4bc8b5c23210366186cebdb804cfd4af553ab5ffceb6acc99326b312f8cb08e949f29134d8afcac"
+
+	getBlock5249790 = `{"confirmations":1,"hash":"0x715c921fa65352b657afd8db82a1e65d7ea0cf6686fc30f3bf80a607cc6fff4d","index":5249790,"merkleroot":"0x63b87f72f4d77aa82de6dc19523d07abb4300136d79e9a9c2b251d0eec01b8ce","nextconsensus":"ANuupE2wgsHYi8VTqSUSoMsyxbJ8P3szu7","nonce":"8fee67b29ce528aa","previousblockhash":"0xf580c47649b3c22d1699dfcad8b396458ee4572b79b6faba5ca3c14493e94f42","script":{"invocation":"40e3d5b93963011fce63ce0529dd105a87395babea4f5d5840110113a677584c99f51ce57196204bcbd73393a72998278bfdc30540b10d7a9e5e342b4265aea9d340bc2b3992246e0049645685d85b29b757ec3b5b0e249c038cd18ad682f8e18d438c9ff2b89cf63bd94cf26a6d16f23c9b377ad03c8fd07d076a73b9e801ab9c07406e254f902d5f648b68a7c0652bcf9b57b5dadb7c6d2d159514bde83b90e30433246efdc81e612c6ad1d8fab2f73c3382dccdc5d09536b1342f70a2d6493df5da40c0d3cfd4d3453e8e4c78cf53978e6adaf0f6bdf071bec8b912a9c8e5ff51f5fcf046096d8b2a88558cb5fe32371c709136a9b99624e8ff6029c8655f638a87bf40772752c328486cd0ed89a931c2613c81fee06e3a717c0f5b00f228d6f1b0192befada0d522fd943da8136f8992b0580aa61173c1867ca623dee558063c965a37","verification":"5521024c7b7fb6c310fccf1ba33b082519d82964ea93868d676662d4a59ad548df0e7d21025bdf3f181f53e9696227843950deb72dcd374ded17c057159513c3d0abe20b6421035e819642a8915a2572f972ddbdbe3042ae6437349295edce9bdc3b8884bbf9a32103b209fd4f53a7170ea4444e0cb0a6bb6a53c2bd016926989cf85f9b0fba17a70c2103b8d9d5771d8f513aa0869b9cc8d50986403b78c6da36890638c3d46a5adce04a2102ca0e27697b9c248f6f16e085fd0061e26f44da85b58ee835c110caa5ec3ba5542102df48f60e8f3e01c48ff40b9b7f1310d7a8b2a193188befe1c2e3df740e89509357ae"},"size":2064,"time":1584568869,"tx":[{"attributes":[],"net_fee":"0","nonce":2632263850,"scripts":[],"size":10,"sys_fee":"0","txid":"0x47e026ec2366be9ab834eb262f21311d28bd6cdfc90b3876e4f5c49d510f3c31","type":"MinerTransaction","version":0,"vin":[],"vout":[]},{"attributes":[{"data":"4649f940788c16c01e70d39e3613252ef7a58dbc","usage":"Script"}],"gas":"0","net_fee":"0","script":"0500bea7d01414b197bb42bb224fe63c20bbc93dd1e183ae1cb120144649f940788c16c01e70d39e3613252ef7a58dbc53c1087472616e7366657267a9fe67930cdd180863395620af7a3f0109d2c0b7f166f470c61e6df75140","scripts":[{"invocation":"40eab6fbbf8839314cd21118329f8bfc8048c99f1d77851e32a2fb6ffcf56c4cffb021d4b0fc0168af13b2a246566fedee0fa387fffcbc0eda2c5abe9b16f7f52b","verification":"2102eb9704f6676a4e332b0a91057ddfe9bba4126b453e7104f9616f1a081e702694ac"}],"size":228,"sys_fee":"0","txid":"0x086b9af57f2c621894327f95c581f4050d3f96ce818d2b13a473e4ea98aae4f7","type":"InvocationTransaction","version":1,"vin":[],"vout":[]},{"attributes":[],"gas":"0","net_fee":"0","script":"203236613166663031323834313564376166323737396438383038623534306238149a9763d8cd9d160af3162f44f50123afe58bca5652c10b7061794f7264657247617367a87c7976662f9b2012c2a5ace6a0dbd6f532d259","scripts":[{"invocation":"403a16ac944a11ba2bc470257b8f7ad651e72ace4d8755c8b0a4947b288b4fe0e017215ffd97bf000c225fe8432204d196a16ec85daae5c7523d58e8ef2b97ed56","verification":"2103fc8d713440a5febf9dbd6d61b96234453b5c7a75ba5841c5cf04ec4351a9e3d4ac"}],"size":360,"sys_fee":"0","txid":"0x56028d91ec5630151a9725422ce2dd5a42da04a20e4359402cefd868bef681c9","type":"InvocationTransaction","version":1,"vin":[{"txid":"0x23895058c1f0c5614c30460aead0db1749733496ca1bd9e8582c0f300b7ab99e","vout":1}],"vout":[{"address":"AX8kHN1rYFdtGj4V1G4Ncqt75MaVpQS4jp","asset":"0x602c79718b16e442de58778e148d0b1084e3b2dffd5de6b7b16cee7969282de7","n":0,"value":"0.00001"},{"address":"AVsH4oZrmtGVDC95m4xY5wNtLZChdFzqiC","asset":"0x602c79718b16e442de58778e148d0b1084e3b2dffd5de6b7b16cee7969282de7","n":1,"value":"0.18538"}]},{"attributes":[],"gas":"0","net_fee":"0","script":"203134366538636239363763346365623361623361366534353132336336303739143a36d8cd56c4dfbdf636a892ed786af4e4c695f352c10b7061794f7264657247617367a87c7976662f9b2012c2a5ace6a0dbd6f532d259","scripts":[{"invocation":"40c870c95a84c5cc846c1ca5b09621d94d4d7343a44a6b3df3eaa2c8ec9a539232532f0f0668efa28669f531680d0419c346805c74e76fd7d7939fc55e9238c824","verification":"21028032387622db11004d901ac1bea972e0ca417e84c590cf031e7eaffed6e8498dac"}],"size":360,"sys_fee":"0","txid":"0xc10f1cca2eec7ee3fde687eee411ad1c92c7bcbdb715c052d71ba1029967142f","type":"InvocationTransaction","version":1,"vin":[{"txid":"0xae7523b5d50450139282a607320c140876cbf56134a7fa552acae3636edfbb34","vout":1}],"vout":[{"address":"AX8kHN1rYFdtGj4V1G4Ncqt75MaVpQS4jp","asset":"0x602c79718b16e442de58778e148d0b1084e3b2dffd5de6b7b16cee7969282de7","n":0,"value":"0.00001"},{"address":"AM5gYTDHwBqiMXZ8xmY7ciFDUZ1oEBKcN5","asset":"0x602c79718b16e442de58778e148d0b1084e3b2dffd5de6b7b16cee7969282de7","n":1,"value":"0.18562"}]},{"attributes":[],"net_fee":"0","scripts":[{"invocation":"408e55b007686bf29cc8cdc2f65e7b5b448e2efe5a68e71c6f35f617edce8603fe376fa9d3edb6ed1295866fcc50db9f0ac7c5f14bf4b12fbd308cea4775389630","verification":"21026c69fc74aaf06273d34fdc2d24382140155714f65901b83b34d3c99a7e4eaf85ac"}],"size":202,"sys_fee":"0","txid":"0xc72ba18597b99a76fb15701d7667926846ede86f0125e4b7222b81857d09c6e5","type":"ContractTransaction","version":0,"vin":[{"txid":"0xa9348f870d0a2630c75f47103d068959ea178c4aa2eecc86509f7a1dac6e2534","vout":0}],"vout":[{"address":"ASedaViTE9NdgunCjjeaZDufLcPYQEC3vx","asset":"0xc56f33fc6ecfcd0c225c4ab356fee59390af8560be0e930faebe74a6daff7c9b","n":0,"value":"52"}]},{"attributes":[{"data":"59a6e5472a2d026c76e3cb76fc5d01aba86728a6","usage":"Script"}],"gas":"0","net_fee":"0","script":"050056218300144649f940788c16c01e70d39e3613252ef7a58dbc1459a6e5472a2d026c76e3cb76fc5d01aba86728a653c1087472616e73666572679bc8c394217f198608b06106d101dd1cac5a4b31f1666f3e3341286df702","scripts":[{"invocation":"40ba5421c8bb68385fc7d7a813acf61180fa04a984275a36586024d907f208af1e05af99e0f040c00ddfe26b02d16485ec724064bb03c3af00112f5f13f4bc8b5c","verification":"210366186cebdb804cfd4af553ab5ffceb6acc99326b312f8cb08e949f29134d8afcac"}],"size":228,"sys_fee":"0","txid":"0xf9d35a9c7258efd474d7ae3827a2377e73399ac8b0c67399034f78b329cd95a4","type":"InvocationTransaction","version":1,"vin":[],"vout":[]}],"version":0}`
+)
+
+func decodeBlock(t *testing.T, raw string) *network.Block {
+	b, _ := hex.DecodeString(raw)
+	block := &network.Block{}
+	if err := block.Decode(bytes.NewBuffer(b), 0); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestBlockResultMatchesGetBlock(t *testing.T) {
+	var expected neorpc.GetBlockResult
+	if err := json.Unmarshal([]byte(getBlock5249790), &expected); err != nil {
+		t.Fatal(err)
+	}
+	block := decodeBlock(t, rawBlock5249790)
+	r := blockResult(block)
+
+	// The network fee of the transactions spending inputs needs their values, it is left empty
+	for i, tx := range block.Transactions {
+		if len(tx.Inputs) > 0 {
+			if r.Tx[i].NetFee != "" {
+				t.Errorf("transaction %d has a network fee %q without knowing its inputs", i, r.Tx[i].NetFee)
+			}
+			r.Tx[i].NetFee = expected.Tx[i].NetFee
+		}
+	}
+	if !reflect.DeepEqual(r, expected) {
+		got, _ := json.Marshal(r)
+		t.Errorf("got %s, expected %s", got, getBlock5249790)
+	}
+}
+
+func TestTransactionResultMatchesGetBlock(t *testing.T) {
+	var expected neorpc.GetBlockResult
+	json.Unmarshal([]byte(getBlock5249790), &expected)
+	block := decodeBlock(t, rawBlock5249790)
+
+	// ContractTransaction sending 52 NEO and an InvocationTransaction with GAS outputs
+	for _, i := range []int{2, 4} {
+		r := transactionResult(block.Transactions[i])
+		e := expected.Tx[i]
+		if r.Txid != e.Txid || r.Size != e.Size || r.Type != e.Type || r.SysFee != e.SysFee || r.NetFee != "" {
+			t.Errorf("transaction %d: got %+v, expected %+v", i, r, e)
+		}
+		if len(r.Vout) != len(e.Vout) {
+			t.Fatalf("transaction %d: got %d outputs, expected %d", i, len(r.Vout), len(e.Vout))
+		}
+		for n, out := range e.Vout {
+			out := out.(map[string]interface{})
+			if r.Vout[n].Value != out["value"] || r.Vout[n].Address != out["address"] || r.Vout[n].Asset != out["asset"] {
+				t.Errorf("transaction %d: got output %+v, expected %v", i, r.Vout[n], out)
+			}
+		}
+	}
+}
+
+func TestSystemFee(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		expected string
+	}{
+		{
+			"genesis RegisterTransaction of NEO",
+			"400000455b7b226c616e67223a227a682d434e222c226e616d65223a22e5b08fe89a81e882a1227d2c7b226c616e67223a22656e222c226e616d65223a22416e745368617265227d5d0000c16ff28623000000da1745e9b549bd0bfa1a569971c77eba30cd5a4b00000000",
+			"0",
+		},
+		{
+			"genesis IssueTransaction of NEO",
+			"01000000019b7cffdaa674beae0f930ebe6085af9093e5fe56b34a5c220ccdcf6efc336fc50000c16ff28623005fa99d93303775fe50ca119c327759313eccfa1c01000151",
+			"0",
+		},
+	}
+	for _, test := range tests {
+		b, _ := hex.DecodeString(test.raw)
+		tx := &network.Transaction{}
+		if err := tx.Decode(bytes.NewBuffer(b), 0); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if r := transactionResult(tx); r.SysFee != test.expected {
+			t.Errorf("%s: sys_fee %s, expected %s", test.name, r.SysFee, test.expected)
+		}
+	}
+
+	tx := &network.Transaction{Type: network.RegisterTransaction, Asset: &network.AssetRegistration{AssetType: 0x60}}
+	if fee := fixed8String(systemFee(tx)); fee != "10000" {
+		t.Errorf("registering a token costs %s", fee)
+	}
+	tx = &network.Transaction{Type: network.InvocationTransaction, Gas: 123000000}
+	if r := transactionResult(tx); r.SysFee != "1.23" || r.Gas != "1.23" || r.NetFee != "0" {
+		t.Errorf("unexpected fees %+v", r)
+	}
+	tx = &network.Transaction{Type: network.PublishTransaction}
+	if fee := fixed8String(systemFee(tx)); fee != "500" {
+		t.Errorf("publishing a contract costs %s", fee)
+	}
+}
+
+func TestFixed8String(t *testing.T) {
+	tests := map[int64]string{
+		0:                "0",
+		1:                "0.00000001",
+		1000:             "0.00001",
+		18538000:         "0.18538",
+		150000000:        "1.5",
+		5200000000:       "52",
+		10000000000000:   "100000",
+		-150000000:       "-1.5",
+		-1:               "-0.00000001",
+		9999999999999999: "99999999.99999999",
+	}
+	for value, expected := range tests {
+		if s := fixed8String(value); s != expected {
+			t.Errorf("%d: got %s, expected %s", value, s, expected)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+)
+
+// Control protocol spoken on the multiplexed endpoint.
+// Clients send commands such as
+//
+//	{"op":"subscribe","channel":"event","contract":"0x...","id":"my-ref"}
+//	{"op":"subscribe","channel":"event","params":{"filter":["name:transfer,arg1:30074a..."]}}
+//	{"op":"unsubscribe","subscription":"1"}
+//
+// and every message pushed afterwards is wrapped in an envelope carrying the
+// subscription it belongs to.
+const (
+	opSubscribe    = "subscribe"
+	opUnsubscribe  = "unsubscribe"
+	opSubscribed   = "subscribed"
+	opUnsubscribed = "unsubscribed"
+	opMessage      = "message"
+	opError        = "error"
+)
+
+type command struct {
+	Op           string        `json:"op"`
+	ID           string        `json:"id"` // Client chosen reference, echoed back in the reply
+	Channel      string        `json:"channel"`
+	Contract     string        `json:"contract"`
+	Params       commandParams `json:"params"` // Same as the query parameters of the path based endpoints
+	Subscription string        `json:"subscription"`
+	Since        *uint64       `json:"since"`     // Replay buffered messages after this sequence number
+	FromBlock    *int64        `json:"fromBlock"` // Replay buffered messages from this block on
+}
+
+// commandParams accept a string or a list of strings for each parameter
+type commandParams map[string]paramValues
+
+type paramValues []string
+
+func (v *paramValues) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*v = paramValues{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("parameters must be a string or a list of strings")
+	}
+	*v = many
+	return nil
+}
+
+func (cmd command) params() url.Values {
+	values := url.Values{}
+	for name, v := range cmd.Params {
+		values[name] = v
+	}
+	if cmd.Contract != "" {
+		values.Set("contract", cmd.Contract)
+	}
+	return values
+}
+
+type reply struct {
+	Op           string `json:"op"`
+	ID           string `json:"id,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Channel      string `json:"channel,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Reason       string `json:"reason,omitempty"` // Why the server ended a subscription
+}
+
+type envelope struct {
+	Op           string          `json:"op"`
+	Subscription string          `json:"subscription"`
+	Channel      string          `json:"channel"`
+	Seq          uint64          `json:"seq"`
+	Dropped      int64           `json:"dropped,omitempty"` // Messages lost since the previous one because the connection was too slow
+	Data         json.RawMessage `json:"data"`
+}
+
+// Handle a multiplexed websocket connection, subscriptions are managed through commands sent by the client
+func handleMultiplexedConnection(ws *websocket.Conn) {
+	c := newClient(ws, true)
+	go c.readCommands(ws)
+	c.writeLoop()
+}
+
+func (c *client) readCommands(ws *websocket.Conn) {
+	defer c.stop()
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var cmd command
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			c.reply(reply{Op: opError, Error: "malformed command: " + err.Error()})
+			continue
+		}
+		if r := c.handleCommand(cmd); r != nil {
+			c.reply(r)
+		}
+	}
+}
+
+// handleCommand runs a command and returns the reply to send, successful subscriptions
+// are acknowledged by the subscription itself so the reply precedes any replayed message.
+func (c *client) handleCommand(cmd command) *reply {
+	switch cmd.Op {
+	case opSubscribe:
+		from := &cursor{since: cmd.Since, fromBlock: cmd.FromBlock}
+		_, err := c.subscribe(cmd.Channel, cmd.params(), from, func(sub *subscription) WebSocketMessage {
+			return reply{Op: opSubscribed, ID: cmd.ID, Subscription: sub.id, Channel: sub.channel}
+		})
+		if err != nil {
+			return &reply{Op: opError, ID: cmd.ID, Error: err.Error()}
+		}
+		return nil
+	case opUnsubscribe:
+		if !c.unsubscribe(cmd.Subscription) {
+			return &reply{Op: opError, ID: cmd.ID, Subscription: cmd.Subscription, Error: "unknown subscription"}
+		}
+		return &reply{Op: opUnsubscribed, ID: cmd.ID, Subscription: cmd.Subscription}
+	}
+	return &reply{Op: opError, ID: cmd.ID, Error: "unknown op " + cmd.Op}
+}
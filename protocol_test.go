@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHandleCommand(t *testing.T) {
+	contract := "0x00000000000000000000000000000000000000c1"
+	c, _ := newTestClient(true)
+
+	if r := c.handleCommand(command{Op: opSubscribe, ID: "ref", Channel: "event", Contract: contract}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	sendMessage(contract, map[string]int{"n": 1})
+	frames := receive(t, c, 2)
+	expected := []string{
+		`{"op":"subscribed","id":"ref","subscription":"1","channel":"event"}`,
+		`{"op":"message","subscription":"1","channel":"event","seq":1,"data":{"n":1}}`,
+	}
+	for i := range expected {
+		if frames[i] != expected[i] {
+			t.Errorf("got %s, expected %s", frames[i], expected[i])
+		}
+	}
+
+	tests := []struct {
+		command command
+		reply   reply
+	}{
+		{command{Op: opSubscribe, ID: "a", Channel: "blocks"}, reply{Op: opError, ID: "a", Error: `unknown channel "blocks"`}},
+		{command{Op: opUnsubscribe, ID: "b", Subscription: "1"}, reply{Op: opUnsubscribed, ID: "b", Subscription: "1"}},
+		{command{Op: opUnsubscribe, ID: "c", Subscription: "1"}, reply{Op: opError, ID: "c", Subscription: "1", Error: "unknown subscription"}},
+		{command{Op: "publish", ID: "d"}, reply{Op: opError, ID: "d", Error: "unknown op publish"}},
+	}
+	for _, test := range tests {
+		if r := c.handleCommand(test.command); r == nil || *r != test.reply {
+			t.Errorf("%+v: got %+v, expected %+v", test.command, r, test.reply)
+		}
+	}
+}
+
+func TestSubscribeReplaysAfterTheAcknowledgement(t *testing.T) {
+	contract := "0x00000000000000000000000000000000000000c2"
+	for n := 1; n <= 3; n++ {
+		sendMessage(contract, map[string]int{"n": n})
+	}
+	c, _ := newTestClient(true)
+	since := uint64(1)
+	if r := c.handleCommand(command{Op: opSubscribe, Channel: "event", Contract: contract, Since: &since}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	frames := receive(t, c, 3)
+	var ack reply
+	if err := json.Unmarshal([]byte(frames[0]), &ack); err != nil || ack.Op != opSubscribed {
+		t.Fatalf("the acknowledgement came after %s", frames[0])
+	}
+	for i, seq := range []uint64{2, 3} {
+		var e envelope
+		if err := json.Unmarshal([]byte(frames[i+1]), &e); err != nil || e.Seq != seq {
+			t.Errorf("got %s, expected message %d", frames[i+1], seq)
+		}
+	}
+
+	since = 10
+	r := c.handleCommand(command{Op: opSubscribe, Channel: "event", Contract: contract, Since: &since})
+	if r == nil || r.Op != opError {
+		t.Errorf("a cursor ahead of the stream was accepted: %+v", r)
+	}
+}
+
+func TestCommandParams(t *testing.T) {
+	var cmd command
+	data := `{"op":"subscribe","channel":"event","contract":"0x01","params":{"filter":["a","b"],"other":"c"}}`
+	if err := json.Unmarshal([]byte(data), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	params := cmd.params()
+	if len(params["filter"]) != 2 || params.Get("other") != "c" || params.Get("contract") != "0x01" {
+		t.Errorf("unexpected parameters %v", params)
+	}
+	if err := json.Unmarshal([]byte(`{"params":{"filter":1}}`), &cmd); err == nil {
+		t.Error("a numeric parameter was accepted")
+	}
+}
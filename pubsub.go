@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// subscription ties a channel to the client that asked for it.
+// channel is the public name ("event", "block", ...) while key is the entry in the
+// subscriptions table (for contract filtered events this is the contract hash).
+type subscription struct {
+	id      string
+	channel string
+	key     string
+	index   index // Set when the messages are selected server side for the key
+	client  *client
+}
+
+type delivery struct {
+	sub      *subscription // nil for control replies on multiplexed connections
+	seq      uint64
+	data     json.RawMessage
+	ingested time.Time // When the message was received from upstream, zero for replays and replies
+}
+
+// replay is what a subscription has to receive before its live messages:
+// the acknowledgement of the subscribe command and the backlog it asked for.
+type replay struct {
+	sub     *subscription
+	ack     json.RawMessage
+	entries []backlogEntry
+}
+
+// What to do when a message arrives for a connection whose queue is full
+type overflowPolicy string
+
+const (
+	overflowDropOldest overflowPolicy = "dropOldest"
+	overflowDropNewest overflowPolicy = "dropNewest"
+	overflowDisconnect overflowPolicy = "disconnect"
+
+	defaultQueueSize = 64
+
+	// Close code sent to clients disconnected by the overflowDisconnect policy
+	closeSlowConsumer = 4000
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch p := overflowPolicy(s); p {
+	case overflowDropOldest, overflowDropNewest, overflowDisconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// transport is how frames reach a client, either a websocket or a server-sent events stream
+type transport interface {
+	// WriteFrame sends a message, id is its sequence number (0 for control replies)
+	WriteFrame(data []byte, id uint64) error
+	KeepAlive() error
+	// CloseWith tells the client why the server is closing the connection
+	CloseWith(code int, reason string)
+	Close() error
+}
+
+type wsTransport struct {
+	ws *websocket.Conn
+}
+
+func (t wsTransport) WriteFrame(data []byte, id uint64) error {
+	t.ws.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return t.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t wsTransport) KeepAlive() error {
+	t.ws.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return t.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (t wsTransport) CloseWith(code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	t.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+}
+
+func (t wsTransport) Close() error {
+	return t.ws.Close()
+}
+
+// client is a connection to a subscriber.
+// Connections opened on the path based endpoints (/event, /block...) hold a single
+// subscription and receive the raw messages, multiplexed connections can hold any
+// number of subscriptions and every message is wrapped in an envelope.
+type client struct {
+	conn        transport
+	pingPeriod  time.Duration
+	multiplexed bool
+	meta        bool // Path based client that asked for metadata fields in its messages
+	send        chan delivery
+	replies     chan json.RawMessage // Control replies, apart from the messages so the overflow policy never drops them
+	done        chan struct{}
+	closeOnce   sync.Once
+	policy      overflowPolicy
+	queueMutex  sync.Mutex // serializes producers so dropOldest always makes room
+	dropped     int64      // messages dropped since the last one delivered, read atomically
+
+	replayMutex sync.Mutex
+	replays     []replay
+	replayReady chan struct{}
+
+	// Close frame sent when the client is stopped by the server
+	closeCode   int
+	closeReason string
+
+	mu     sync.Mutex
+	subs   map[string]*subscription
+	nextID uint64
+}
+
+func newClient(ws *websocket.Conn, multiplexed bool) *client {
+	return newClientWithTransport(wsTransport{ws}, clientPingPeriod, multiplexed)
+}
+
+func newClientWithTransport(conn transport, pingPeriod time.Duration, multiplexed bool) *client {
+	policy, _ := parseOverflowPolicy(getConfig().OverflowPolicy)
+	return &client{
+		conn:        conn,
+		pingPeriod:  pingPeriod,
+		multiplexed: multiplexed,
+		send:        make(chan delivery, getConfig().SubscriberQueueSize),
+		replies:     make(chan json.RawMessage, getConfig().SubscriberQueueSize),
+		done:        make(chan struct{}),
+		replayReady: make(chan struct{}, 1),
+		policy:      policy,
+		subs:        map[string]*subscription{},
+	}
+}
+
+// index is a selection of messages computed on the server and published under its own key,
+// it only runs while some subscription retains it.
+type index interface {
+	retain()
+	release()
+}
+
+// route is where the messages of a subscription are published
+type route struct {
+	key   string
+	index index
+	// New subscriptions without a cursor get the whole backlog, for short lived channels
+	fullReplay bool
+}
+
+type unknownChannelError string
+
+func (e unknownChannelError) Error() string {
+	return fmt.Sprintf("unknown channel %q", string(e))
+}
+
+// validContract tells if s is a script hash the way contracts appear in events, 0x followed by 20 bytes in hex
+func validContract(s string) bool {
+	if !strings.HasPrefix(s, "0x") {
+		return false
+	}
+	b, err := hex.DecodeString(s[2:])
+	return err == nil && len(b) == 20
+}
+
+// resolveChannel maps a public channel name and its parameters to the key used
+// in the subscriptions table.
+func resolveChannel(channel string, params url.Values) (route, error) {
+	switch channel {
+	case "event":
+		contract := params.Get("contract")
+		if contract != "" && !validContract(contract) {
+			return route{}, fmt.Errorf("invalid contract %q, expected a 0x prefixed script hash", contract)
+		}
+		if filters, ok := params["filter"]; ok {
+			f, err := parseEventFilter(contract, filters)
+			if err != nil {
+				return route{}, err
+			}
+			return route{key: f.key, index: f}, nil
+		}
+		if contract != "" {
+			return route{key: contract}, nil
+		}
+		return route{key: channel}, nil
+	case "nep5/transfer":
+		if contract := params.Get("contract"); contract != "" {
+			if !validContract(contract) {
+				return route{}, fmt.Errorf("invalid contract %q, expected a 0x prefixed script hash", contract)
+			}
+			return route{key: channel + "?contract=" + contract}, nil
+		}
+		return route{key: channel}, nil
+	case "mempool/tx":
+		if hasMempoolFilter(params) {
+			f, err := parseMempoolFilter(params)
+			if err != nil {
+				return route{}, err
+			}
+			return route{key: f.key, index: f}, nil
+		}
+		return route{key: channel}, nil
+	case "block", "consensus", "nep5/diagnostics":
+		return route{key: channel}, nil
+	}
+	if strings.HasPrefix(channel, "address/") {
+		address := strings.TrimPrefix(channel, "address/")
+		if !validAddress(address) {
+			return route{}, fmt.Errorf("invalid NEO address %q", address)
+		}
+		return route{key: channel, index: addressWatch(address)}, nil
+	}
+	if strings.HasPrefix(channel, txTrackingChannelPrefix) {
+		txid := strings.TrimPrefix(channel, txTrackingChannelPrefix)
+		if !validTxID(txid) {
+			return route{}, fmt.Errorf("invalid transaction hash %q", txid)
+		}
+		txid = normalizeTxID(txid)
+		return route{key: txChannel(txid), index: txWatch(txid), fullReplay: true}, nil
+	}
+	return route{}, unknownChannelError(channel)
+}
+
+// subscribe adds a subscription to the client, ack builds the reply sent before any of its messages
+func (c *client) subscribe(channel string, params url.Values, from *cursor, ack func(*subscription) WebSocketMessage) (*subscription, error) {
+	route, err := resolveChannel(channel, params)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return nil, fmt.Errorf("connection is closing")
+	default:
+	}
+	c.nextID++
+	sub := &subscription{
+		id:      strconv.FormatUint(c.nextID, 10),
+		channel: channel,
+		key:     route.key,
+		index:   route.index,
+		client:  c,
+	}
+	var ackData json.RawMessage
+	if ack != nil {
+		ackData, _ = json.Marshal(ack(sub))
+	}
+	if route.fullReplay && (from == nil || (from.since == nil && from.fromBlock == nil)) {
+		from = &cursor{all: true}
+	}
+	if err := subscribe(sub, from, ackData); err != nil {
+		return nil, err
+	}
+	c.subs[sub.id] = sub
+	return sub, nil
+}
+
+func (c *client) unsubscribe(id string) bool {
+	c.mu.Lock()
+	sub, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+	if ok {
+		unsubscribe(sub)
+	}
+	return ok
+}
+
+// end finishes a subscription whose channel was closed by the server. Multiplexed
+// connections are told with an unsubscribed reply, the others are closed.
+func (c *client) end(sub *subscription, reason string) {
+	c.mu.Lock()
+	_, ok := c.subs[sub.id]
+	delete(c.subs, sub.id)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	if c.multiplexed {
+		go c.reply(reply{Op: opUnsubscribed, Subscription: sub.id, Channel: sub.channel, Reason: reason})
+		return
+	}
+	c.kick(websocket.CloseNormalClosure, reason)
+}
+
+// reply hands a control reply to the writer, it is never dropped by the overflow policy.
+func (c *client) reply(message WebSocketMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	select {
+	case c.replies <- data:
+	case <-c.done:
+	}
+}
+
+// enqueue queues a message for the writer applying the overflow policy when the queue is full
+func (c *client) enqueue(d delivery) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+	for {
+		select {
+		case c.send <- d:
+			return
+		default:
+		}
+
+		switch c.policy {
+		case overflowDropNewest:
+			c.drop(d)
+			return
+		case overflowDisconnect:
+			c.drop(d)
+			c.kick(closeSlowConsumer, "slow consumer")
+			return
+		default:
+			select {
+			case oldest := <-c.send:
+				c.drop(oldest)
+			default:
+			}
+		}
+	}
+}
+
+func (c *client) drop(d delivery) {
+	atomic.AddInt64(&c.dropped, 1)
+	if d.sub != nil {
+		droppedMessages.With(channelLabel(d.sub.key)).Inc()
+	}
+}
+
+// queueReplay hands a backlog to the writer, it must be called before the
+// subscription starts receiving live messages.
+func (c *client) queueReplay(r replay) {
+	c.replayMutex.Lock()
+	c.replays = append(c.replays, r)
+	c.replayMutex.Unlock()
+	select {
+	case c.replayReady <- struct{}{}:
+	default:
+	}
+}
+
+func (c *client) flushReplays() error {
+	c.replayMutex.Lock()
+	replays := c.replays
+	c.replays = nil
+	c.replayMutex.Unlock()
+	for _, r := range replays {
+		if r.ack != nil {
+			if err := c.write(delivery{data: r.ack}); err != nil {
+				return err
+			}
+		}
+		for _, e := range r.entries {
+			if err := c.write(delivery{sub: r.sub, seq: e.seq, data: e.data}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *client) write(d delivery) error {
+	err := c.conn.WriteFrame(c.frame(d), d.seq)
+	if err == nil && !d.ingested.IsZero() {
+		deliveryLatency.Observe(time.Since(d.ingested).Seconds())
+	}
+	return err
+}
+
+func (c *client) stop() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// kick stops the client sending it a close frame with the given code
+func (c *client) kick(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// writeLoop pushes deliveries and keep-alives to the connection until a write fails
+// or the client is stopped.
+func (c *client) writeLoop() {
+	atomic.AddInt64(&connected, 1)
+	untrack := trackClient(c)
+	defer untrack()
+	t := time.NewTicker(c.pingPeriod)
+
+loop:
+	for {
+		var err error
+		select {
+		case <-c.done:
+			if c.closeCode == websocket.CloseGoingAway || c.closeCode == websocket.CloseNormalClosure {
+				// The server is shutting down or the stream is complete, what is already queued is still delivered
+				c.flushQueue()
+			}
+			if c.closeCode != 0 {
+				c.conn.CloseWith(c.closeCode, c.closeReason)
+			}
+			break loop
+		case <-t.C:
+			err = c.conn.KeepAlive()
+		case <-c.replayReady:
+			err = c.flushReplays()
+		case d := <-c.send:
+			// A pending backlog always goes out before the live messages of its subscription
+			err = c.flushReplays()
+			if err == nil {
+				err = c.write(d)
+			}
+		case data := <-c.replies:
+			err = c.writeReply(data)
+		}
+		if err != nil {
+			break
+		}
+	}
+	atomic.AddInt64(&connected, -1)
+	atomic.AddInt64(&failed, 1)
+
+	t.Stop()
+	c.close()
+}
+
+// writeReply sends a control reply after the messages that were queued before it, such as
+// the last ones of the subscription it ends.
+func (c *client) writeReply(data json.RawMessage) error {
+	if err := c.flushReplays(); err != nil {
+		return err
+	}
+queued:
+	for n := len(c.send); n > 0; n-- {
+		select {
+		case d := <-c.send:
+			if err := c.write(d); err != nil {
+				return err
+			}
+		default:
+			// Taken by the overflow policy meanwhile
+			break queued
+		}
+	}
+	return c.write(delivery{data: data})
+}
+
+// flushQueue writes the pending backlogs, queued messages and replies, stopping at the first error
+func (c *client) flushQueue() {
+	if c.flushReplays() != nil {
+		return
+	}
+	for {
+		select {
+		case d := <-c.send:
+			if c.write(d) != nil {
+				return
+			}
+		case data := <-c.replies:
+			if c.writeReply(data) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// frame builds the text frame for a delivery. Messages of multiplexed connections are wrapped
+// in an envelope with their sequence number and how many messages were dropped since the
+// previous one, the path based endpoints get them as they were published unless they
+// opted in to have these fields added to them.
+func (c *client) frame(d delivery) []byte {
+	if d.sub == nil || (!c.multiplexed && !c.meta) {
+		return d.data
+	}
+	dropped := atomic.SwapInt64(&c.dropped, 0)
+	if !c.multiplexed {
+		data := annotate(d.data, "seq", int64(d.seq))
+		if dropped > 0 {
+			data = annotate(data, "dropped", dropped)
+		}
+		return data
+	}
+	data, _ := json.Marshal(envelope{
+		Op:           opMessage,
+		Subscription: d.sub.id,
+		Channel:      d.sub.channel,
+		Seq:          d.seq,
+		Dropped:      dropped,
+		Data:         d.data,
+	})
+	return data
+}
+
+// annotate adds a top level field to a JSON object, this is how metadata reaches
+// clients of the path based endpoints without changing the shape of their messages.
+func annotate(data []byte, name string, value int64) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "{%q:%d", name, value)
+	if len(bytes.TrimSpace(data[1:])) > 1 {
+		b.WriteByte(',')
+	}
+	b.Write(data[1:])
+	return b.Bytes()
+}
+
+func (c *client) close() {
+	c.stop()
+	c.conn.Close()
+
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = map[string]*subscription{}
+	c.mu.Unlock()
+	for _, sub := range subs {
+		unsubscribe(sub)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingTransport keeps what is written to a client
+type recordingTransport struct {
+	mu          sync.Mutex
+	frames      []string
+	ids         []uint64
+	closeCode   int
+	closeReason string
+}
+
+func (t *recordingTransport) WriteFrame(data []byte, id uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.frames = append(t.frames, string(data))
+	t.ids = append(t.ids, id)
+	return nil
+}
+
+func (t *recordingTransport) KeepAlive() error {
+	return nil
+}
+
+func (t *recordingTransport) CloseWith(code int, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeCode, t.closeReason = code, reason
+}
+
+func (t *recordingTransport) Close() error {
+	return nil
+}
+
+func (t *recordingTransport) written() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.frames...)
+}
+
+func newTestClient(multiplexed bool) (*client, *recordingTransport) {
+	transport := &recordingTransport{}
+	return newClientWithTransport(transport, time.Hour, multiplexed), transport
+}
+
+// receive does the job of the writer until n frames have been written to the client
+func receive(t *testing.T, c *client, n int) []string {
+	transport := c.conn.(*recordingTransport)
+	deadline := time.After(time.Second)
+	for len(transport.written()) < n {
+		c.flushReplays()
+		select {
+		case d := <-c.send:
+			c.flushReplays()
+			c.write(d)
+		case data := <-c.replies:
+			c.writeReply(data)
+		case <-c.replayReady:
+		case <-deadline:
+			t.Fatalf("got %v, expected %d frames", transport.written(), n)
+		}
+	}
+	return transport.written()
+}
+
+func TestEnqueueOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy  overflowPolicy
+		queued  []uint64
+		dropped int64
+		kicked  bool
+	}{
+		{overflowDropOldest, []uint64{2, 3}, 1, false},
+		{overflowDropNewest, []uint64{1, 2}, 1, false},
+		{overflowDisconnect, []uint64{1, 2}, 1, true},
+	}
+	for _, test := range tests {
+		c, _ := newTestClient(true)
+		c.send, c.policy = make(chan delivery, 2), test.policy
+		sub := &subscription{id: "1", channel: "block", key: "block", client: c}
+		for seq := uint64(1); seq <= 3; seq++ {
+			c.enqueue(delivery{sub: sub, seq: seq, data: json.RawMessage(`{}`)})
+		}
+		queued := []uint64{}
+		for len(c.send) > 0 {
+			queued = append(queued, (<-c.send).seq)
+		}
+		if len(queued) != len(test.queued) || queued[0] != test.queued[0] || queued[1] != test.queued[1] {
+			t.Errorf("%s: queued %v, expected %v", test.policy, queued, test.queued)
+		}
+		if dropped := atomic.LoadInt64(&c.dropped); dropped != test.dropped {
+			t.Errorf("%s: %d dropped", test.policy, dropped)
+		}
+		select {
+		case <-c.done:
+			if !test.kicked || c.closeCode != closeSlowConsumer {
+				t.Errorf("%s: stopped with code %d", test.policy, c.closeCode)
+			}
+		default:
+			if test.kicked {
+				t.Errorf("%s: the client wasn't disconnected", test.policy)
+			}
+		}
+	}
+}
+
+func TestRepliesAreNeverDropped(t *testing.T) {
+	c, _ := newTestClient(true)
+	c.send, c.policy = make(chan delivery, 1), overflowDropOldest
+	sub := &subscription{id: "1", channel: "block", key: "block", client: c}
+	c.enqueue(delivery{sub: sub, seq: 1, data: json.RawMessage(`{}`)})
+	c.reply(reply{Op: opUnsubscribed, Subscription: "1", Channel: "block"})
+	c.enqueue(delivery{sub: sub, seq: 2, data: json.RawMessage(`{}`)})
+	c.enqueue(delivery{sub: sub, seq: 3, data: json.RawMessage(`{}`)})
+
+	// Only messages were evicted to make room
+	frames := receive(t, c, 2)
+	expected := []string{
+		`{"op":"message","subscription":"1","channel":"block","seq":3,"dropped":2,"data":{}}`,
+		`{"op":"unsubscribed","subscription":"1","channel":"block"}`,
+	}
+	for i := range expected {
+		if frames[i] != expected[i] {
+			t.Errorf("got %s, expected %s", frames[i], expected[i])
+		}
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, s := range []string{"dropOldest", "dropNewest", "disconnect"} {
+		if p, err := parseOverflowPolicy(s); err != nil || string(p) != s {
+			t.Errorf("%s: got %q, %v", s, p, err)
+		}
+	}
+	if _, err := parseOverflowPolicy("dropAll"); err == nil {
+		t.Error("an unknown policy was accepted")
+	}
+}
+
+func TestResolveChannel(t *testing.T) {
+	contract := "0xfb84b0950e8fd366af566b2911d6183e4b0367f7"
+	tests := []struct {
+		channel string
+		params  url.Values
+		key     string
+		err     string
+	}{
+		{"block", nil, "block", ""},
+		{"event", nil, "event", ""},
+		{"event", url.Values{"contract": {contract}}, contract, ""},
+		{"event", url.Values{"contract": {"fb84b0950e8fd366af566b2911d6183e4b0367f7"}}, "", "invalid contract"},
+		{"event", url.Values{"contract": {"0xabc"}}, "", "invalid contract"},
+		{"event", url.Values{"contract": {contract}, "filter": {"name:transfer"}}, "event?contract=" + contract + "&filter=name:transfer", ""},
+		{"event", url.Values{"filter": {"value:transfer"}}, "", "unknown filter field"},
+		{"nep5/transfer", url.Values{"contract": {contract}}, "nep5/transfer?contract=" + contract, ""},
+		{"nep5/transfer", url.Values{"contract": {"abc"}}, "", "invalid contract"},
+		{"mempool/tx", nil, "mempool/tx", ""},
+		{"mempool/tx", url.Values{"type": {"contract"}}, "mempool/tx?type=ContractTransaction", ""},
+		{"address/AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA", nil, "address/AL9ppCyxgPbhaGgVPJHH8qmfoQCSCutQrA", ""},
+		{"address/AL9pp", nil, "", "invalid NEO address"},
+		{"tx/" + strings.Repeat("AB", 32), nil, "tx/0x" + strings.Repeat("ab", 32), ""},
+		{"tx/0x01", nil, "", "invalid transaction hash"},
+		{"blocks", nil, "", `unknown channel "blocks"`},
+	}
+	for _, test := range tests {
+		route, err := resolveChannel(test.channel, test.params)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %v: expected %q, got %v", test.channel, test.params, test.err, err)
+			}
+			continue
+		}
+		if err != nil || route.key != test.key {
+			t.Errorf("%s %v: got %q, %v, expected %q", test.channel, test.params, route.key, err, test.key)
+		}
+	}
+}
+
+func TestFrame(t *testing.T) {
+	data := json.RawMessage(`{"index":10}`)
+
+	// Path based clients get the messages as they were published, even after drops
+	legacy, _ := newTestClient(false)
+	sub := &subscription{id: "1", channel: "block", key: "block", client: legacy}
+	atomic.StoreInt64(&legacy.dropped, 2)
+	if frame := string(legacy.frame(delivery{sub: sub, seq: 7, data: data})); frame != string(data) {
+		t.Errorf("unexpected frame %s", frame)
+	}
+	// unless they asked for the metadata fields
+	legacy.meta = true
+	if frame := string(legacy.frame(delivery{sub: sub, seq: 8, data: data})); frame != `{"dropped":2,"seq":8,"index":10}` {
+		t.Errorf("unexpected frame %s", frame)
+	}
+	if frame := string(legacy.frame(delivery{sub: sub, seq: 9, data: data})); frame != `{"seq":9,"index":10}` {
+		t.Errorf("the drops were reported twice: %s", frame)
+	}
+
+	multiplexed, _ := newTestClient(true)
+	sub = &subscription{id: "3", channel: "block", key: "block", client: multiplexed}
+	atomic.StoreInt64(&multiplexed.dropped, 2)
+	expected := `{"op":"message","subscription":"3","channel":"block","seq":7,"dropped":2,"data":{"index":10}}`
+	if frame := string(multiplexed.frame(delivery{sub: sub, seq: 7, data: data})); frame != expected {
+		t.Errorf("got %s, expected %s", frame, expected)
+	}
+	expected = `{"op":"message","subscription":"3","channel":"block","seq":8,"data":{"index":10}}`
+	if frame := string(multiplexed.frame(delivery{sub: sub, seq: 8, data: data})); frame != expected {
+		t.Errorf("the drops were reported twice: %s", frame)
+	}
+	// Control replies are sent as they are
+	if frame := string(multiplexed.frame(delivery{data: json.RawMessage(`{"op":"error"}`)})); frame != `{"op":"error"}` {
+		t.Errorf("unexpected reply %s", frame)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	tests := map[string]string{
+		`{"a":1}`: `{"dropped":3,"a":1}`,
+		`{}`:      `{"dropped":3}`,
+		`{ }`:     `{"dropped":3 }`,
+		`[1]`:     `[1]`,
+		`"text"`:  `"text"`,
+	}
+	for data, expected := range tests {
+		if annotated := string(annotate([]byte(data), "dropped", 3)); annotated != expected {
+			t.Errorf("%s: got %s, expected %s", data, annotated, expected)
+		}
+	}
+}
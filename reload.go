@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/metrics"
+)
+
+// Fields that are only read on start, a reload keeps their current value
+var restartOnlyFields = map[string]bool{
+	"magic":    true,
+	"port":     true,
+	"history":  true,
+	"webhooks": true,
+	"p2p":      true,
+}
+
+var configReloads = metrics.NewCounterVec("pubsub_config_reloads_total", "Configuration reloads, by result", "result")
+
+// reloadResult is the outcome of a reload, the last one is served by /admin/reload
+type reloadResult struct {
+	Time            time.Time `json:"time"`
+	OK              bool      `json:"ok"`
+	Error           string    `json:"error,omitempty"`
+	Changed         []string  `json:"changed"`
+	RestartRequired []string  `json:"restartRequired,omitempty"` // Changed but not applied until the next restart
+}
+
+var (
+	reloadMutex sync.Mutex
+	lastReload  *reloadResult
+)
+
+// changedFields lists the config fields that differ, by their name in the config file
+func changedFields(old, new Configuration) []string {
+	changed := []string{}
+	a, b := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+	return changed
+}
+
+// reloadConfiguration reads the config file again and applies it without dropping any
+// subscriber. The new node list is used the next time a node has to be picked and the
+// events provider is only reconnected when its url changed.
+func reloadConfiguration() reloadResult {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	result := reloadResult{Time: time.Now(), Changed: []string{}}
+	config, err := readConfiguration()
+	if err != nil {
+		result.Error = err.Error()
+		lastReload = &result
+		configReloads.With("error").Inc()
+		log.Printf("config reload failed: %v", err)
+		return result
+	}
+
+	configMutex.Lock()
+	old := currentConfig
+	for _, field := range changedFields(old, config) {
+		if restartOnlyFields[field] {
+			result.RestartRequired = append(result.RestartRequired, field)
+		} else {
+			result.Changed = append(result.Changed, field)
+		}
+	}
+	// Keep what can't change while running
+	config.Magic = old.Magic
+	config.Port = old.Port
+	config.History = old.History
+	config.Webhooks = old.Webhooks
+	config.P2P = old.P2P
+	currentConfig = config
+	configMutex.Unlock()
+
+	if config.WebsocketEventsProvider != old.WebsocketEventsProvider {
+		restartRelay()
+	}
+	if !reflect.DeepEqual(config.Nodes, old.Nodes) {
+		updatePeers(config.Nodes)
+	}
+
+	result.OK = true
+	lastReload = &result
+	configReloads.With("ok").Inc()
+	log.Printf("config reloaded from %s, changed: %v", configFile, result.Changed)
+	if len(result.RestartRequired) > 0 {
+		log.Printf("config fields %v changed but need a restart to apply", result.RestartRequired)
+	}
+	return result
+}
+
+// restartRelay drops the connection to the events provider, relayEvents then dials the
+// provider of the current config.
+func restartRelay() {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	if relayConn != nil {
+		relayConn.Close()
+	}
+}
+
+// Serves /admin/reload, POST reloads the config and GET shows the outcome of the last reload
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	var result *reloadResult
+	switch r.Method {
+	case "POST":
+		res := reloadConfiguration()
+		result = &res
+	case "GET":
+		reloadMutex.Lock()
+		result = lastReload
+		reloadMutex.Unlock()
+		if result == nil {
+			http.Error(w, "The config hasn't been reloaded yet", 404)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.OK {
+		w.WriteHeader(400)
+	}
+	json.NewEncoder(w).Encode(result)
+}
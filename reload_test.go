@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangedFields(t *testing.T) {
+	old := validConfiguration()
+	if changed := changedFields(old, old); len(changed) != 0 {
+		t.Errorf("an identical config changed %v", changed)
+	}
+
+	config := validConfiguration()
+	config.WebsocketEventsProvider = "wss://other/ws/"
+	config.Nodes = append(config.Nodes, NodeAddresses{P2P: "seed2.ngd.network:10333", RPC: "http://seed2.ngd.network:10332"})
+	config.Port = 9000
+	config.Shutdown = &ShutdownConfig{TimeoutSeconds: 5}
+	expected := []string{"nodes", "websocketEventsProvider", "port", "shutdown"}
+	if changed := changedFields(old, config); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("got %v, expected %v", changed, expected)
+	}
+
+	// Sections are compared by value
+	a, b := validConfiguration(), validConfiguration()
+	a.Readiness, b.Readiness = &ReadinessConfig{BlockWindowSeconds: 60}, &ReadinessConfig{BlockWindowSeconds: 60}
+	if changed := changedFields(a, b); len(changed) != 0 {
+		t.Errorf("equal sections changed %v", changed)
+	}
+}
+
+func TestRestartOnlyFields(t *testing.T) {
+	// Every field that can't be reloaded is a field of the config file
+	fields := map[string]bool{}
+	for _, field := range changedFields(Configuration{}, Configuration{
+		Magic:    1,
+		Port:     1,
+		History:  &HistoryConfig{},
+		Webhooks: &WebhooksConfig{},
+		P2P:      &P2PConfig{},
+	}) {
+		fields[field] = true
+	}
+	if !reflect.DeepEqual(fields, restartOnlyFields) {
+		t.Errorf("restart only fields %v don't match %v", restartOnlyFields, fields)
+	}
+}
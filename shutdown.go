@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neotx"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultShutdownTimeoutSeconds = 10
+	defaultReconnectDelaySeconds  = 30
+)
+
+type ShutdownConfig struct {
+	TimeoutSeconds        int `json:"timeoutSeconds"`        //deadline for draining clients and flushing webhooks before exiting
+	ReconnectDelaySeconds int `json:"reconnectDelaySeconds"` //clients are told to wait a random delay up to this before reconnecting
+}
+
+// closing is closed when the server starts shutting down, nothing reconnects upstream afterwards
+var closing = make(chan struct{})
+
+func isClosing() bool {
+	select {
+	case <-closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// The upstream connections currently open, closed on shutdown
+var (
+	upstreamMutex sync.Mutex
+	p2pPeers      *neotx.PeerManager
+	relayConn     *websocket.Conn
+)
+
+func setPeerManager(m *neotx.PeerManager) bool {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	if isClosing() {
+		return false
+	}
+	p2pPeers = m
+	return true
+}
+
+func setRelayConn(c *websocket.Conn) bool {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	if isClosing() {
+		return false
+	}
+	relayConn = c
+	return true
+}
+
+// Connections that have to be told the server is going away
+var (
+	liveMutex   sync.Mutex
+	liveClients = map[*client]struct{}{}
+	livePings   = map[*websocket.Conn]struct{}{}
+	liveWait    sync.WaitGroup
+)
+
+// trackClient registers a client until its writer exits, a client that shows up
+// while shutting down isn't registered and is sent away right away. closing is
+// checked under liveMutex so no client is added once shutdown waits for them.
+func trackClient(c *client) func() {
+	liveMutex.Lock()
+	if isClosing() {
+		liveMutex.Unlock()
+		c.kick(websocket.CloseGoingAway, reconnectReason())
+		return func() {}
+	}
+	liveClients[c] = struct{}{}
+	liveWait.Add(1)
+	liveMutex.Unlock()
+	return func() {
+		liveMutex.Lock()
+		delete(liveClients, c)
+		liveMutex.Unlock()
+		liveWait.Done()
+	}
+}
+
+func trackPing(ws *websocket.Conn) func() {
+	liveMutex.Lock()
+	livePings[ws] = struct{}{}
+	liveMutex.Unlock()
+	return func() {
+		liveMutex.Lock()
+		delete(livePings, ws)
+		liveMutex.Unlock()
+	}
+}
+
+// reconnectReason is the close reason sent on shutdown. The delay is spread among
+// clients so they don't all come back at the same time.
+func reconnectReason() string {
+	max := defaultReconnectDelaySeconds
+	if config := getConfig().Shutdown; config != nil && config.ReconnectDelaySeconds > 0 {
+		max = config.ReconnectDelaySeconds
+	}
+	return fmt.Sprintf("server restarting, reconnect in %ds", 1+rand.Intn(max))
+}
+
+func shutdownTimeout() time.Duration {
+	if config := getConfig().Shutdown; config != nil && config.TimeoutSeconds > 0 {
+		return time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	return defaultShutdownTimeoutSeconds * time.Second
+}
+
+// shutdown stops accepting connections, disconnects from upstream so no new messages
+// come in, lets every client receive what is already queued for it, closes them with
+// a going away frame and flushes the webhooks and the history log.
+func shutdown(server *http.Server) {
+	deadline := time.Now().Add(shutdownTimeout())
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	upstreamMutex.Lock()
+	close(closing)
+	if p2pPeers != nil {
+		p2pPeers.Close()
+	}
+	if relayConn != nil {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		relayConn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+		relayConn.Close()
+	}
+	upstreamMutex.Unlock()
+
+	// Stops the listener right away, the SSE streams are waited for below
+	served := make(chan error, 1)
+	go func() { served <- server.Shutdown(ctx) }()
+
+	liveMutex.Lock()
+	for c := range liveClients {
+		c.kick(websocket.CloseGoingAway, reconnectReason())
+	}
+	for ws := range livePings {
+		message := websocket.FormatCloseMessage(websocket.CloseGoingAway, reconnectReason())
+		ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+	}
+	liveMutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		liveWait.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("shutdown deadline reached before every client was drained")
+	}
+	if err := <-served; err != nil {
+		log.Printf("http server shutdown: %v", err)
+	}
+
+	webhooks.Close(time.Until(deadline))
+	if history != nil {
+		if err := history.Close(); err != nil {
+			log.Printf("closing history: %v", err)
+		}
+	}
+}
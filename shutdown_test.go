@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownDrainsClients(t *testing.T) {
+	defer func() { closing = make(chan struct{}) }()
+	contract := "0x00000000000000000000000000000000000000f1"
+	c, transport := newTestClient(false)
+	if _, err := c.subscribe("event", url.Values{"contract": {contract}}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	sendMessage(contract, map[string]int{"n": 1})
+	stopped := make(chan struct{})
+	go func() {
+		c.writeLoop()
+		close(stopped)
+	}()
+
+	shutdown(&http.Server{})
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the client wasn't closed")
+	}
+	if frames := transport.written(); len(frames) != 1 || frames[0] != `{"n":1}` {
+		t.Errorf("the queued message wasn't delivered: %v", frames)
+	}
+	if transport.closeCode != websocket.CloseGoingAway || !strings.HasPrefix(transport.closeReason, "server restarting, reconnect in ") {
+		t.Errorf("closed with %d %q", transport.closeCode, transport.closeReason)
+	}
+
+	// Clients showing up afterwards are sent away
+	late, transport := newTestClient(false)
+	late.writeLoop()
+	if transport.closeCode != websocket.CloseGoingAway {
+		t.Errorf("a late client was closed with %d", transport.closeCode)
+	}
+	liveMutex.Lock()
+	_, tracked := liveClients[late]
+	liveMutex.Unlock()
+	if tracked {
+		t.Error("a late client was tracked")
+	}
+	w := httptest.NewRecorder()
+	handleSSE(w, httptest.NewRequest("GET", "/sse/block", nil))
+	if w.Code != 503 {
+		t.Errorf("a stream was opened with status %d", w.Code)
+	}
+}
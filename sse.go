@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Comments are sent this often so proxies don't drop idle streams
+	sseKeepAlivePeriod = 15 * time.Second
+
+	// Delay browsers wait before reconnecting a dropped stream
+	sseRetry = 5 * time.Second
+)
+
+// sseTransport writes frames as a text/event-stream, the id of each event is the
+// message sequence number so a reconnecting browser resumes through Last-Event-ID.
+type sseTransport struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (t sseTransport) write(b []byte) error {
+	if _, err := t.w.Write(b); err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+func (t sseTransport) WriteFrame(data []byte, id uint64) error {
+	var b bytes.Buffer
+	if id != 0 {
+		fmt.Fprintf(&b, "id: %d\n", id)
+	}
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	return t.write(b.Bytes())
+}
+
+func (t sseTransport) KeepAlive() error {
+	return t.write([]byte(": keep-alive\n\n"))
+}
+
+func (t sseTransport) CloseWith(code int, reason string) {
+	t.event("close", map[string]interface{}{"code": code, "reason": reason})
+}
+
+// event writes a named event, which browsers dispatch to the listeners of that name instead of onmessage
+func (t sseTransport) event(name string, message interface{}) error {
+	data, _ := json.Marshal(message)
+	return t.write([]byte("event: " + name + "\ndata: " + string(data) + "\n\n"))
+}
+
+func (t sseTransport) Close() error {
+	// The stream ends when the handler returns
+	return nil
+}
+
+// Serves the channels as server-sent events, eg: /sse/block or /sse/event?contract=0x...&filter=name:transfer
+func handleSSE(w http.ResponseWriter, r *http.Request) {
+	channel := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sse/"), "/")
+
+	if isClosing() {
+		http.Error(w, "The server is shutting down", 503)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", 500)
+		return
+	}
+	from, err := parseCursor(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	resuming := false
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" && from.since == nil {
+		seq, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID header", 400)
+			return
+		}
+		from.since = &seq
+		resuming = true
+	}
+
+	stream := sseTransport{w, flusher}
+	c := newClientWithTransport(stream, sseKeepAlivePeriod, false)
+	c.meta = r.URL.Query().Get("meta") == "true"
+	_, err = c.subscribe(channel, r.URL.Query(), from, nil)
+	// Browsers reconnect on their own with the last id they got, an error would stop them for
+	// good when the server lost track of it, so they are told to reset and get the live stream.
+	var reset error
+	if _, stale := err.(cursorError); stale && resuming {
+		reset = err
+		_, err = c.subscribe(channel, r.URL.Query(), nil, nil)
+	}
+	if err != nil {
+		status := 400
+		if _, unknown := err.(unknownChannelError); unknown {
+			status = 404
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry/time.Millisecond)
+	flusher.Flush()
+	if reset != nil {
+		stream.event("reset", map[string]string{"reason": reset.Error()})
+	}
+
+	go func() {
+		select {
+		case <-r.Context().Done():
+			c.stop()
+		case <-c.done:
+		}
+	}()
+	c.writeLoop()
+}
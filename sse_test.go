@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent returns the lines of the next event of a stream
+func readEvent(t *testing.T, r *bufio.Reader) string {
+	lines := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("the stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, line)
+	}
+}
+
+func openStream(t *testing.T, url string, lastEventID string) (*http.Response, *bufio.Reader) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("content type %q", contentType)
+	}
+	r := bufio.NewReader(res.Body)
+	if retry := readEvent(t, r); retry != "retry: 5000" {
+		t.Errorf("unexpected first event %q", retry)
+	}
+	return res, r
+}
+
+func TestSSE(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handleSSE))
+	defer server.Close()
+	contract := "0x00000000000000000000000000000000000000d1"
+
+	res, r := openStream(t, server.URL+"/sse/event?contract="+contract, "")
+	sendMessage(contract, map[string]int{"n": 1})
+	sendMessage(contract, map[string]int{"n": 2})
+	for _, expected := range []string{"id: 1\ndata: {\"n\":1}", "id: 2\ndata: {\"n\":2}"} {
+		if e := readEvent(t, r); e != expected {
+			t.Errorf("got %q, expected %q", e, expected)
+		}
+	}
+	res.Body.Close()
+
+	// A reconnecting browser resumes after the last event it got
+	res, r = openStream(t, server.URL+"/sse/event?contract="+contract, "1")
+	if e := readEvent(t, r); e != "id: 2\ndata: {\"n\":2}" {
+		t.Errorf("unexpected replay %q", e)
+	}
+	res.Body.Close()
+
+	tests := map[string]int{
+		"/sse/event?contract=0x01": 400,
+		"/sse/blocks":              404,
+		"/sse/event?contract=" + contract + "&since=abc":     400,
+		"/sse/event?contract=" + contract + "&since=10":      400,
+		"/sse/event?contract=" + contract + "&fromBlock=abc": 400,
+	}
+	for path, status := range tests {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("%s: status %d, expected %d", path, res.StatusCode, status)
+		}
+	}
+}
+
+func TestSSEResetsLostStreams(t *testing.T) {
+	defer setConfig(func(config *Configuration) { config.ReplayBufferSize = 1 })()
+	server := httptest.NewServer(http.HandlerFunc(handleSSE))
+	defer server.Close()
+	contract := "0x00000000000000000000000000000000000000d2"
+	sendMessage(contract, map[string]int{"n": 1})
+	sendMessage(contract, map[string]int{"n": 2})
+
+	// Browsers that come back with an id the server can't resume from start over with the live stream
+	for _, lastEventID := range []string{"0", "9"} {
+		res, r := openStream(t, server.URL+"/sse/event?contract="+contract, lastEventID)
+		if e := readEvent(t, r); !strings.HasPrefix(e, "event: reset\ndata: {\"reason\":\"cursor "+lastEventID) {
+			t.Errorf("%s: unexpected first event %q", lastEventID, e)
+		}
+		sendMessage(contract, map[string]string{"id": lastEventID})
+		if e := readEvent(t, r); !strings.HasSuffix(e, "data: {\"id\":\""+lastEventID+"\"}") {
+			t.Errorf("%s: unexpected event %q", lastEventID, e)
+		}
+		res.Body.Close()
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/corollari/neo-ws-pub-sub/neorpc"
+)
+
+const (
+	defaultConfirmationDepth = 1
+	defaultTxTimeoutSeconds  = 3600
+	txTrackingChannelPrefix  = "tx/"
+	closeReasonTxConfirmed   = "confirmed"
+	closeReasonTxExpired     = "expired"
+)
+
+type TxTrackingConfig struct {
+	ConfirmationDepth int `json:"confirmationDepth"` //confirmations sent before a tx/<txid> channel is closed
+	TimeoutSeconds    int `json:"timeoutSeconds"`    //time a transaction has to be included in a block before it expires
+}
+
+// TxStatus is published on tx/<txid> as the transaction goes from the mempool to its confirmation
+type TxStatus struct {
+	Status        string         `json:"status"` // seen_in_mempool | included | events | confirmations | expired
+	TxId          string         `json:"txid"`
+	Block         *int64         `json:"block,omitempty"`
+	BlockHash     string         `json:"blockHash,omitempty"`
+	Events        []EventMessage `json:"events,omitempty"`
+	Confirmations int            `json:"confirmations,omitempty"`
+}
+
+// txWatch is the index of a transaction, it is only followed while someone is subscribed to it
+type txWatch string
+
+// txTracker is the lifecycle of a followed transaction
+type txTracker struct {
+	refs     int
+	seen     bool
+	included *int64 // Index of the block including the transaction
+	done     bool   // The final message has been published, the channel is being closed
+	expiry   *time.Timer
+}
+
+var (
+	trackedTxsMutex sync.Mutex
+	trackedTxs      = map[string]*txTracker{} // by normalized txid
+)
+
+// normalizeTxID formats a transaction hash the way RPC nodes do, inventories carry it without the 0x
+func normalizeTxID(txid string) string {
+	return "0x" + strings.ToLower(strings.TrimPrefix(txid, "0x"))
+}
+
+func validTxID(txid string) bool {
+	b, err := hex.DecodeString(strings.TrimPrefix(txid, "0x"))
+	return err == nil && len(b) == 32
+}
+
+func txChannel(txid string) string {
+	return txTrackingChannelPrefix + txid
+}
+
+func txTrackingConfig() (depth int, timeout time.Duration) {
+	depth, timeout = defaultConfirmationDepth, defaultTxTimeoutSeconds*time.Second
+	if config := getConfig().TxTracking; config != nil {
+		if config.ConfirmationDepth > 0 {
+			depth = config.ConfirmationDepth
+		}
+		if config.TimeoutSeconds > 0 {
+			timeout = time.Duration(config.TimeoutSeconds) * time.Second
+		}
+	}
+	return depth, timeout
+}
+
+// retain starts following a transaction, checking with the nodes whether it is already in a block
+func (w txWatch) retain() {
+	txid := string(w)
+	trackedTxsMutex.Lock()
+	defer trackedTxsMutex.Unlock()
+	if t, ok := trackedTxs[txid]; ok {
+		t.refs++
+		return
+	}
+	_, timeout := txTrackingConfig()
+	trackedTxs[txid] = &txTracker{
+		refs:   1,
+		expiry: time.AfterFunc(timeout, func() { expireTx(txid) }),
+	}
+	go lookupTx(txid)
+}
+
+// release stops following a transaction once nobody is waiting for it
+func (w txWatch) release() {
+	trackedTxsMutex.Lock()
+	defer trackedTxsMutex.Unlock()
+	t, ok := trackedTxs[string(w)]
+	if !ok {
+		return
+	}
+	if t.refs--; t.refs <= 0 {
+		t.expiry.Stop()
+		delete(trackedTxs, string(w))
+	}
+}
+
+// txAction is a message to publish on a transaction channel, and the reason to close it afterwards if it is the last one
+type txAction struct {
+	status TxStatus
+	close  string
+}
+
+func runTxActions(actions []txAction) {
+	for _, a := range actions {
+		sendMessage(txChannel(a.status.TxId), a.status)
+		if a.close != "" {
+			closeChannel(txChannel(a.status.TxId), a.close)
+		}
+	}
+}
+
+// include records the block of a transaction, it must be called with trackedTxsMutex held
+func (t *txTracker) include(txid string, height int64, hash string, confirmations int, actions []txAction) []txAction {
+	t.included = &height
+	t.expiry.Stop()
+	if confirmations < 1 {
+		confirmations = 1
+	}
+	actions = append(actions, txAction{status: TxStatus{Status: "included", TxId: txid, Block: &height, BlockHash: hash}})
+	return t.confirm(txid, confirmations, actions)
+}
+
+// confirm reports the confirmations of an included transaction, it must be called with trackedTxsMutex held
+func (t *txTracker) confirm(txid string, confirmations int, actions []txAction) []txAction {
+	depth, _ := txTrackingConfig()
+	if confirmations > depth {
+		confirmations = depth
+	}
+	a := txAction{status: TxStatus{Status: "confirmations", TxId: txid, Confirmations: confirmations}}
+	if confirmations >= depth {
+		t.done = true
+		a.close = closeReasonTxConfirmed
+	}
+	return append(actions, a)
+}
+
+// lookupTx asks the configured nodes about a transaction that just started being followed,
+// it may have been included before anyone subscribed.
+func lookupTx(txid string) {
+	for _, node := range getConfig().Nodes {
+		client := neorpc.NewClient(node.RPC)
+		raw := client.GetRawTransaction(txid)
+		if raw.ErrorResponse != nil || raw.Result.Txid == "" {
+			continue
+		}
+		if raw.Result.Blockhash == "" {
+			// Known by the node but still in its mempool
+			trackTxSeen(txid)
+			return
+		}
+		block := client.GetBlock(raw.Result.Blockhash)
+		if block.ErrorResponse != nil || block.Result.Hash == "" {
+			continue
+		}
+		var actions []txAction
+		trackedTxsMutex.Lock()
+		if t, ok := trackedTxs[txid]; ok && t.included == nil && !t.done {
+			actions = t.include(txid, int64(block.Result.Index), block.Result.Hash, raw.Result.Confirmations, actions)
+		}
+		trackedTxsMutex.Unlock()
+		runTxActions(actions)
+		return
+	}
+}
+
+// trackTxSeen reports a transaction announced by the P2P network
+func trackTxSeen(txid string) {
+	txid = normalizeTxID(txid)
+	trackedTxsMutex.Lock()
+	t, ok := trackedTxs[txid]
+	if !ok || t.seen || t.included != nil || t.done {
+		trackedTxsMutex.Unlock()
+		return
+	}
+	t.seen = true
+	trackedTxsMutex.Unlock()
+	runTxActions([]txAction{{status: TxStatus{Status: "seen_in_mempool", TxId: txid}}})
+}
+
+// trackTxEvent forwards the notifications of a followed transaction
+func trackTxEvent(m EventMessage) {
+	txid := normalizeTxID(m.TxId)
+	trackedTxsMutex.Lock()
+	t, ok := trackedTxs[txid]
+	following := ok && !t.done
+	trackedTxsMutex.Unlock()
+	if following {
+		runTxActions([]txAction{{status: TxStatus{Status: "events", TxId: txid, Events: []EventMessage{m}}}})
+	}
+}
+
+// trackTxBlock marks the followed transactions included in a block and counts the confirmations
+// of the ones included before it.
+func trackTxBlock(block map[string]interface{}) {
+	index, ok := block["index"].(float64)
+	if !ok {
+		return
+	}
+	height := int64(index)
+	hash, _ := block["hash"].(string)
+	txs, _ := block["tx"].([]interface{})
+
+	var actions []txAction
+	trackedTxsMutex.Lock()
+	if len(trackedTxs) == 0 {
+		trackedTxsMutex.Unlock()
+		return
+	}
+	for txid, t := range trackedTxs {
+		if t.done || t.included == nil {
+			continue
+		}
+		if height > *t.included {
+			actions = t.confirm(txid, int(height-*t.included)+1, actions)
+		}
+	}
+	for _, raw := range txs {
+		tx, _ := raw.(map[string]interface{})
+		txid, _ := tx["txid"].(string)
+		txid = normalizeTxID(txid)
+		if t, ok := trackedTxs[txid]; ok && t.included == nil && !t.done {
+			actions = t.include(txid, height, hash, 1, actions)
+		}
+	}
+	trackedTxsMutex.Unlock()
+	runTxActions(actions)
+}
+
+// expireTx gives up on a transaction that wasn't included in a block in time
+func expireTx(txid string) {
+	trackedTxsMutex.Lock()
+	t, ok := trackedTxs[txid]
+	if !ok || t.included != nil || t.done {
+		trackedTxsMutex.Unlock()
+		return
+	}
+	t.done = true
+	trackedTxsMutex.Unlock()
+	runTxActions([]txAction{{status: TxStatus{Status: "expired", TxId: txid}, close: closeReasonTxExpired}})
+}
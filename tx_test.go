@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTxLifecycle(t *testing.T) {
+	defer setConfig(func(config *Configuration) {
+		config.Nodes = nil
+		config.TxTracking = &TxTrackingConfig{ConfirmationDepth: 2}
+	})()
+	txid := "0x" + strings.Repeat("a1", 32)
+	requested := "tx/" + strings.ToUpper(txid[2:])
+	c, _ := newTestClient(true)
+	if r := c.handleCommand(command{Op: opSubscribe, Channel: requested}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+
+	trackTxSeen(txid[2:])
+	trackTxSeen(txid)
+	trackTxEvent(EventMessage{TxId: txid, Contract: "0x01", Event: []interface{}{}})
+	trackTxBlock(map[string]interface{}{"index": float64(10), "hash": "0xb10", "tx": []interface{}{map[string]interface{}{"txid": txid}}})
+	trackTxBlock(map[string]interface{}{"index": float64(11), "hash": "0xb11", "tx": []interface{}{}})
+	trackTxBlock(map[string]interface{}{"index": float64(12), "hash": "0xb12", "tx": []interface{}{}})
+
+	// Replies carry the channel the way it was asked for
+	channel := `"channel":"` + requested + `"`
+	expected := []string{
+		`{"op":"subscribed","subscription":"1",` + channel + `}`,
+		`{"op":"message","subscription":"1",` + channel + `,"seq":1,"data":{"status":"seen_in_mempool","txid":"` + txid + `"}}`,
+		`{"op":"message","subscription":"1",` + channel + `,"seq":2,"data":{"status":"events","txid":"` + txid + `","events":[{"txid":"` + txid + `","contract":"0x01","event":[]}]}}`,
+		`{"op":"message","subscription":"1",` + channel + `,"seq":3,"data":{"status":"included","txid":"` + txid + `","block":10,"blockHash":"0xb10"}}`,
+		`{"op":"message","subscription":"1",` + channel + `,"seq":4,"data":{"status":"confirmations","txid":"` + txid + `","confirmations":1}}`,
+		`{"op":"message","subscription":"1",` + channel + `,"seq":5,"data":{"status":"confirmations","txid":"` + txid + `","confirmations":2}}`,
+		`{"op":"unsubscribed","subscription":"1",` + channel + `,"reason":"confirmed"}`,
+	}
+	frames := receive(t, c, len(expected))
+	for i := range expected {
+		if frames[i] != expected[i] {
+			t.Errorf("got %s, expected %s", frames[i], expected[i])
+		}
+	}
+	if len(frames) > len(expected) {
+		t.Errorf("unexpected frames %v", frames[len(expected):])
+	}
+	if lookupChannel("tx/"+txid) != nil {
+		t.Error("the channel wasn't closed")
+	}
+}
+
+func TestTxExpires(t *testing.T) {
+	defer setConfig(func(config *Configuration) { config.Nodes = nil })()
+	txid := "0x" + strings.Repeat("a2", 32)
+	c, _ := newTestClient(true)
+	if r := c.handleCommand(command{Op: opSubscribe, Channel: "tx/" + txid}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	expireTx(txid)
+	// Blocks don't matter anymore
+	trackTxBlock(map[string]interface{}{"index": float64(10), "hash": "0xb10", "tx": []interface{}{map[string]interface{}{"txid": txid}}})
+
+	frames := receive(t, c, 3)
+	if !strings.Contains(frames[1], `"status":"expired"`) || !strings.Contains(frames[2], `"reason":"expired"`) {
+		t.Errorf("unexpected frames %v", frames)
+	}
+	if len(frames) > 3 {
+		t.Errorf("unexpected frames %v", frames[3:])
+	}
+}
+
+func TestTxWatchIsShared(t *testing.T) {
+	defer setConfig(func(config *Configuration) { config.Nodes = nil })()
+	txid := "0x" + strings.Repeat("a3", 32)
+	w := txWatch(txid)
+	w.retain()
+	w.retain()
+	w.release()
+	trackedTxsMutex.Lock()
+	_, followed := trackedTxs[txid]
+	trackedTxsMutex.Unlock()
+	if !followed {
+		t.Error("the transaction stopped being followed while still watched")
+	}
+	w.release()
+	trackedTxsMutex.Lock()
+	_, followed = trackedTxs[txid]
+	trackedTxsMutex.Unlock()
+	if followed {
+		t.Error("the transaction is still followed")
+	}
+}
+
+func TestTxReplaysEarlierMessages(t *testing.T) {
+	defer setConfig(func(config *Configuration) { config.Nodes = nil })()
+	txid := "0x" + strings.Repeat("a4", 32)
+	first, _ := newTestClient(true)
+	if r := first.handleCommand(command{Op: opSubscribe, Channel: "tx/" + txid}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	trackTxSeen(txid)
+
+	// Subscribing without a cursor gets what was published before
+	late, _ := newTestClient(true)
+	if r := late.handleCommand(command{Op: opSubscribe, Channel: "tx/" + txid}); r != nil {
+		t.Fatalf("unexpected reply %+v", r)
+	}
+	frames := receive(t, late, 2)
+	if !strings.Contains(frames[1], `"seq":1`) || !strings.Contains(frames[1], `"status":"seen_in_mempool"`) {
+		t.Errorf("the earlier message wasn't replayed: %v", frames)
+	}
+	first.unsubscribe("1")
+	late.unsubscribe("1")
+}
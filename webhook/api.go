@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Handler serves the admin API, mounted with the prefix stripped:
+//
+//	GET    /                     list the hooks
+//	POST   /                     register a hook, the body is a Hook
+//	DELETE /<id>                 remove a hook
+//	GET    /<id>/deadletters     deliveries that failed on every attempt
+func (d *Dispatcher) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case parts[0] == "" && r.Method == "GET":
+			writeJSON(w, 200, d.Hooks())
+		case parts[0] == "" && r.Method == "POST":
+			var h Hook
+			if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+				http.Error(w, "invalid hook: "+err.Error(), 400)
+				return
+			}
+			h, err := d.Register(h)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			h.Secret = ""
+			writeJSON(w, 201, h)
+		case len(parts) == 1 && r.Method == "DELETE":
+			ok, err := d.Remove(parts[0])
+			if !ok {
+				http.Error(w, "unknown hook", 404)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			w.WriteHeader(204)
+		case len(parts) == 2 && parts[1] == "deadletters" && r.Method == "GET":
+			letters, ok := d.DeadLetters(parts[0])
+			if !ok {
+				http.Error(w, "unknown hook", 404)
+				return
+			}
+			writeJSON(w, 200, letters)
+		default:
+			http.Error(w, "not found", 404)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
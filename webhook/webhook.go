@@ -0,0 +1,419 @@
+// Package webhook delivers published messages to HTTP endpoints.
+// Each delivery is a POST signed with HMAC-SHA256 using the hook secret, failed
+// deliveries are retried with exponential backoff and end up in a dead-letter
+// list once every attempt has failed.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-PubSub-Signature" // "sha256=" followed by the hex HMAC of the body
+	DeliveryHeader  = "X-PubSub-Delivery"  // Unique id of the delivery, the same across retries
+
+	DefaultMaxAttempts    = 8
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 5 * time.Minute
+	DefaultQueueSize      = 1024
+	DefaultDeadLetters    = 100
+	DefaultTimeout        = 10 * time.Second
+)
+
+// Hook is a registered endpoint. Contract optionally restricts the event channel to a contract.
+type Hook struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Channel  string `json:"channel"`
+	Contract string `json:"contract,omitempty"`
+	Secret   string `json:"secret,omitempty"`
+}
+
+// Payload is the body POSTed to hooks
+type Payload struct {
+	Hook     string          `json:"hook"`
+	Delivery string          `json:"delivery"`
+	Channel  string          `json:"channel"`
+	Seq      uint64          `json:"seq"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// DeadLetter is a delivery that failed on every attempt
+type DeadLetter struct {
+	Payload  Payload   `json:"payload"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+type Options struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	QueueSize      int // Deliveries buffered per hook, the newest are dropped when it is full
+	DeadLetters    int // Failed deliveries kept per hook
+	Timeout        time.Duration
+
+	// StoreFile persists the hooks added through the API, ignored when empty
+	StoreFile string
+
+	// Resolve validates the channel of a hook and returns the key messages are published under.
+	// release, which can be nil, is called once the hook is removed.
+	Resolve func(channel string, contract string) (key string, release func(), err error)
+}
+
+type hookState struct {
+	Hook
+	persistent bool // Added through the API, kept in the store file
+	key        string
+	release    func()
+	queue      chan Payload
+	done       chan struct{}
+
+	mu          sync.Mutex
+	deadLetters []DeadLetter
+}
+
+// Dispatcher fans messages out to the registered hooks, each hook has its own worker so
+// a slow endpoint doesn't delay the others.
+type Dispatcher struct {
+	options Options
+	client  *http.Client
+
+	mu    sync.RWMutex
+	hooks map[string]*hookState
+	wg    sync.WaitGroup
+
+	stop     chan struct{} // Closed when Close gives up waiting, the workers abandon their retries
+	stopOnce sync.Once
+}
+
+func NewDispatcher(options Options) *Dispatcher {
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = DefaultMaxAttempts
+	}
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = DefaultInitialBackoff
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DefaultMaxBackoff
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.DeadLetters <= 0 {
+		options.DeadLetters = DefaultDeadLetters
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.Resolve == nil {
+		options.Resolve = func(channel string, contract string) (string, func(), error) { return channel, nil, nil }
+	}
+	return &Dispatcher{
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+		hooks:   map[string]*hookState{},
+		stop:    make(chan struct{}),
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Add registers a hook and starts its worker, an ID is generated when it is empty
+func (d *Dispatcher) Add(h Hook) (Hook, error) {
+	return d.add(h, false)
+}
+
+// Register adds a hook and saves it to the store file so it survives restarts
+func (d *Dispatcher) Register(h Hook) (Hook, error) {
+	h, err := d.add(h, true)
+	if err != nil {
+		return h, err
+	}
+	return h, d.save()
+}
+
+func (d *Dispatcher) add(h Hook, persistent bool) (Hook, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return h, fmt.Errorf("invalid hook url %q", h.URL)
+	}
+	key, release, err := d.options.Resolve(h.Channel, h.Contract)
+	if err != nil {
+		return h, err
+	}
+	if release == nil {
+		release = func() {}
+	}
+	if h.ID == "" {
+		h.ID = randomID()
+	}
+
+	d.mu.Lock()
+	if _, exists := d.hooks[h.ID]; exists {
+		d.mu.Unlock()
+		release()
+		return h, fmt.Errorf("hook %s already exists", h.ID)
+	}
+	s := &hookState{
+		Hook:       h,
+		persistent: persistent,
+		key:        key,
+		release:    release,
+		queue:      make(chan Payload, d.options.QueueSize),
+		done:       make(chan struct{}),
+	}
+	d.hooks[h.ID] = s
+	d.wg.Add(1)
+	d.mu.Unlock()
+
+	go d.worker(s)
+	return h, nil
+}
+
+// Remove unregisters a hook, deliveries still queued for it are discarded
+func (d *Dispatcher) Remove(id string) (bool, error) {
+	d.mu.Lock()
+	s, ok := d.hooks[id]
+	delete(d.hooks, id)
+	d.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	close(s.done)
+	s.release()
+	if s.persistent {
+		return true, d.save()
+	}
+	return true, nil
+}
+
+// Hooks lists the registered hooks without their secrets
+func (d *Dispatcher) Hooks() []Hook {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	hooks := make([]Hook, 0, len(d.hooks))
+	for _, s := range d.hooks {
+		h := s.Hook
+		h.Secret = ""
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks
+}
+
+func (d *Dispatcher) DeadLetters(id string) ([]DeadLetter, bool) {
+	d.mu.RLock()
+	s, ok := d.hooks[id]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]DeadLetter{}, s.deadLetters...), true
+}
+
+// Watched tells if some hook is registered on key
+func (d *Dispatcher) Watched(key string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, s := range d.hooks {
+		if s.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish queues a message for every hook registered on key
+func (d *Dispatcher) Publish(key string, seq uint64, data json.RawMessage) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, s := range d.hooks {
+		if s.key != key {
+			continue
+		}
+		p := Payload{Hook: s.ID, Delivery: randomID(), Channel: s.Channel, Seq: seq, Data: data}
+		select {
+		case s.queue <- p:
+		default:
+			log.Printf("webhook %s queue is full, dropping delivery", s.ID)
+		}
+	}
+}
+
+func (d *Dispatcher) worker(s *hookState) {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-d.stop:
+			return
+		case p, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			d.deliver(s, p)
+		}
+	}
+}
+
+// deliver POSTs a payload until it succeeds or runs out of attempts
+func (d *Dispatcher) deliver(s *hookState, p Payload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	backoff := d.options.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err = d.post(s.Hook, p.Delivery, body)
+		if err == nil {
+			return
+		}
+		if attempt >= d.options.MaxAttempts {
+			s.mu.Lock()
+			s.deadLetters = append(s.deadLetters, DeadLetter{p, attempt, err.Error(), time.Now()})
+			if len(s.deadLetters) > d.options.DeadLetters {
+				s.deadLetters = s.deadLetters[len(s.deadLetters)-d.options.DeadLetters:]
+			}
+			s.mu.Unlock()
+			log.Printf("webhook %s delivery %s failed after %d attempts: %v", s.ID, p.Delivery, attempt, err)
+			return
+		}
+		select {
+		case <-s.done:
+			return
+		case <-d.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > d.options.MaxBackoff {
+			backoff = d.options.MaxBackoff
+		}
+	}
+}
+
+// Sign returns the signature header value for a body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) post(h Hook, delivery string, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, delivery)
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, body))
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", res.Status)
+	}
+	return nil
+}
+
+// Close stops accepting hooks and waits until the queued deliveries are done or the timeout
+// expires, in which case the deliveries still pending are abandoned.
+func (d *Dispatcher) Close(timeout time.Duration) {
+	d.mu.Lock()
+	for _, s := range d.hooks {
+		close(s.queue)
+		s.release()
+	}
+	d.hooks = map[string]*hookState{}
+	d.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		d.stopOnce.Do(func() { close(d.stop) })
+	}
+}
+
+// Load registers the hooks saved in the store file, a missing file is not an error
+func (d *Dispatcher) Load() error {
+	if d.options.StoreFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.options.StoreFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return fmt.Errorf("%s: %v", d.options.StoreFile, err)
+	}
+	for _, h := range hooks {
+		if _, err := d.add(h, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes the hooks added through the API to the store file
+func (d *Dispatcher) save() error {
+	if d.options.StoreFile == "" {
+		return nil
+	}
+	d.mu.RLock()
+	hooks := []Hook{}
+	for _, s := range d.hooks {
+		if s.persistent {
+			hooks = append(hooks, s.Hook)
+		}
+	}
+	d.mu.RUnlock()
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.options.StoreFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.options.StoreFile)
+}
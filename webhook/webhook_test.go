@@ -0,0 +1,167 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testOptions() Options {
+	return Options{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+}
+
+func TestDeliverySignedAndRetried(t *testing.T) {
+	var calls int32
+	received := make(chan Payload, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != Sign("s3cret", body) {
+			t.Errorf("bad signature %q", r.Header.Get(SignatureHeader))
+		}
+		// Fail the first attempt to exercise the retry
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		var p Payload
+		json.Unmarshal(body, &p)
+		received <- p
+	}))
+	defer receiver.Close()
+
+	d := NewDispatcher(testOptions())
+	h, err := d.Add(Hook{URL: receiver.URL, Channel: "block", Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Publish("event", 1, json.RawMessage(`{}`))
+	d.Publish("block", 7, json.RawMessage(`{"index":1}`))
+
+	select {
+	case p := <-received:
+		if p.Hook != h.ID || p.Seq != 7 || string(p.Data) != `{"index":1}` {
+			t.Fatalf("unexpected payload %+v", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("delivery not received")
+	}
+	d.Close(time.Second)
+	if calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer receiver.Close()
+
+	d := NewDispatcher(testOptions())
+	h, _ := d.Add(Hook{URL: receiver.URL, Channel: "block"})
+	d.Publish("block", 1, json.RawMessage(`{}`))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		letters, _ := d.DeadLetters(h.ID)
+		if len(letters) == 1 {
+			if letters[0].Attempts != 3 {
+				t.Fatalf("expected 3 attempts, got %d", letters[0].Attempts)
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("delivery never reached the dead-letter list")
+}
+
+func TestRegisterPersists(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhook")
+	defer os.RemoveAll(dir)
+	options := testOptions()
+	options.StoreFile = filepath.Join(dir, "hooks.json")
+
+	d := NewDispatcher(options)
+	if _, err := d.Add(Hook{ID: "static", URL: "http://localhost/a", Channel: "block"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register(Hook{ID: "api", URL: "http://localhost/b", Channel: "event", Secret: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register(Hook{URL: "ftp://localhost", Channel: "event"}); err == nil {
+		t.Fatal("invalid url accepted")
+	}
+	d.Close(time.Second)
+
+	reloaded := NewDispatcher(options)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	hooks := reloaded.Hooks()
+	if len(hooks) != 1 || hooks[0].ID != "api" || hooks[0].Secret != "" {
+		t.Fatalf("unexpected hooks after reload %+v", hooks)
+	}
+	reloaded.Close(time.Second)
+}
+
+func TestRemoveReleasesTheChannel(t *testing.T) {
+	var retained int32
+	options := testOptions()
+	options.Resolve = func(channel string, contract string) (string, func(), error) {
+		atomic.AddInt32(&retained, 1)
+		return channel, func() { atomic.AddInt32(&retained, -1) }, nil
+	}
+	d := NewDispatcher(options)
+	h, err := d.Add(Hook{ID: "a", URL: "http://127.0.0.1:1/", Channel: "address/AK2nJJpJr6o664CWJKi1QRXjqeic2zRp8y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Add(Hook{ID: "a", URL: "http://127.0.0.1:1/", Channel: "block"}); err == nil {
+		t.Fatal("a duplicated id was accepted")
+	}
+	if retained != 1 || !d.Watched(h.Channel) {
+		t.Fatalf("%d channels retained", retained)
+	}
+	d.Remove(h.ID)
+	if retained != 0 || d.Watched(h.Channel) {
+		t.Errorf("%d channels retained after the hook was removed", retained)
+	}
+}
+
+func TestCloseAbandonsRetries(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(503)
+	}))
+	defer receiver.Close()
+
+	d := NewDispatcher(Options{MaxAttempts: 5, InitialBackoff: 50 * time.Millisecond})
+	d.Add(Hook{URL: receiver.URL, Channel: "block"})
+	d.Publish("block", 1, json.RawMessage(`{}`))
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The worker is waiting to retry when the timeout expires
+	d.Close(10 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the worker kept retrying after Close")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d attempts", n)
+	}
+}
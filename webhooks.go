@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/corollari/neo-ws-pub-sub/webhook"
+)
+
+type WebhooksConfig struct {
+	Hooks       []webhook.Hook `json:"hooks"`
+	StoreFile   string         `json:"storeFile"` //hooks registered through the admin API are saved here
+	MaxAttempts int            `json:"maxAttempts"`
+}
+
+var webhooks = webhook.NewDispatcher(webhook.Options{})
+
+func startWebhooks(config *WebhooksConfig) error {
+	if config == nil {
+		config = &WebhooksConfig{}
+	}
+	webhooks = webhook.NewDispatcher(webhook.Options{
+		MaxAttempts: config.MaxAttempts,
+		StoreFile:   config.StoreFile,
+		Resolve: func(channel string, contract string) (string, func(), error) {
+			route, err := resolveChannel(channel, url.Values{"contract": {contract}})
+			if err != nil || route.index == nil {
+				return route.key, nil, err
+			}
+			// Channels selected on the server, like address/ and tx/, are only published while retained
+			route.index.retain()
+			return route.key, route.index.release, nil
+		},
+	})
+	for _, h := range config.Hooks {
+		if _, err := webhooks.Add(h); err != nil {
+			return err
+		}
+	}
+	return webhooks.Load()
+}